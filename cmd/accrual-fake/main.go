@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/inkpics/gophermart/internal/accrualfake"
+)
+
+func main() {
+	var runAddr string
+	var configPath string
+	var reward float64
+	var invalidRatio float64
+	var cfg accrualfake.Config
+
+	flag.StringVar(&runAddr, "a", os.Getenv("RUN_ADDRESS"), "service address")
+	flag.StringVar(&configPath, "c", os.Getenv("ACCRUAL_FAKE_CONFIG"), "rules config file")
+	flag.Float64Var(&reward, "reward", 10, "default reward percentage")
+	flag.Float64Var(&invalidRatio, "invalid", 0, "default ratio of INVALID orders")
+	flag.Float64Var(&cfg.BaseAmount, "base", 1000, "purchase amount the reward is calculated from")
+	flag.DurationVar(&cfg.Latency, "latency", 0, "artificial response latency")
+	flag.DurationVar(&cfg.ProcessingDelay, "processing", 0, "time an order stays in PROCESSING")
+	flag.IntVar(&cfg.RateLimit, "rpm", 0, "requests per minute before answering 429")
+	flag.Parse()
+
+	if runAddr == "" {
+		runAddr = "localhost:8081"
+	}
+
+	if configPath != "" {
+		fileCfg, err := accrualfake.LoadConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg = mergeConfig(fileCfg, cfg)
+	}
+	cfg.Rules = append(cfg.Rules, accrualfake.Rule{Reward: reward, InvalidRatio: invalidRatio})
+
+	log.Printf("fake accrual system listening on %s", runAddr)
+	log.Fatal(http.ListenAndServe(runAddr, accrualfake.New(cfg).Handler()))
+}
+
+// mergeConfig дополняет конфигурацию из файла явно заданными флагами
+func mergeConfig(fileCfg, flagCfg accrualfake.Config) accrualfake.Config {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["base"] || fileCfg.BaseAmount == 0 {
+		fileCfg.BaseAmount = flagCfg.BaseAmount
+	}
+	if set["latency"] {
+		fileCfg.Latency = flagCfg.Latency
+	}
+	if set["processing"] {
+		fileCfg.ProcessingDelay = flagCfg.ProcessingDelay
+	}
+	if set["rpm"] {
+		fileCfg.RateLimit = flagCfg.RateLimit
+	}
+
+	return fileCfg
+}
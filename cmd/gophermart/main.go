@@ -1,36 +1,84 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/inkpics/gophermart/internal/app"
+	"github.com/inkpics/gophermart/internal/config"
+	"github.com/inkpics/gophermart/internal/logging"
+	"github.com/inkpics/gophermart/internal/tracing"
 )
 
 func main() {
-	var runAddr string
-	var databaseAddr string
-	var accrualAddr string
+	args := os.Args[1:]
 
-	flag.StringVar(&runAddr, "a", os.Getenv("RUN_ADDRESS"), "service address")
-	flag.StringVar(&databaseAddr, "d", os.Getenv("DATABASE_URI"), "database address")
-	flag.StringVar(&accrualAddr, "r", os.Getenv("ACCRUAL_SYSTEM_ADDRESS"), "accrual address")
-	flag.Parse()
-
-	if runAddr == "" {
-		runAddr = "localhost:8080"
+	// gophermart config print [флаги] — вывод действующей конфигурации со скрытыми секретами
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		cfg, err := config.Load("gophermart config print", args[2:], os.Getenv, os.Stderr)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		err = cfg.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	if databaseAddr == "" {
-		log.Print("no database connection provided!")
+	cfg, err := config.Load("gophermart", args, os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	log.Printf("database connection string is %s", databaseAddr)
-
-	err := app.Start(runAddr, databaseAddr, accrualAddr)
+	level, err := logging.ParseLevel(cfg.Log.Level)
 	if err != nil {
 		log.Fatal(err)
 	}
+	logger, err := logging.New(os.Stderr, level, cfg.Log.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	logger.Info("configuration loaded", "dsn", cfg.Database.URI, "accrual", cfg.Accrual.Address, "grpc", cfg.GRPCAddress)
+
+	err = run(logger, cfg)
+	if err != nil {
+		logger.Error("service stopped with error", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger, cfg config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Trace.Exporter)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			logger.Error("flush traces", "error", err)
+		}
+	}()
+
+	return app.Start(ctx, logger, cfg)
 }
@@ -0,0 +1,197 @@
+package accrualfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Rule задаёт расчёт для заказов, номер которых начинается с Prefix. Пустой префикс подходит любому заказу.
+type Rule struct {
+	Prefix string `json:"prefix"`
+	// процент вознаграждения от BaseAmount
+	Reward float64 `json:"reward"`
+	// доля заказов, признаваемых INVALID, от 0 до 1
+	InvalidRatio float64 `json:"invalid_ratio"`
+}
+
+type Config struct {
+	Rules []Rule `json:"rules"`
+	// сумма покупки, от которой считается вознаграждение
+	BaseAmount float64 `json:"base_amount"`
+	// задержка перед каждым ответом
+	Latency time.Duration `json:"latency"`
+	// время, в течение которого заказ находится в статусе PROCESSING
+	ProcessingDelay time.Duration `json:"processing_delay"`
+	// допустимое число запросов в минуту, 0 — без ограничений
+	RateLimit int `json:"rate_limit"`
+}
+
+type configJSON struct {
+	Rules           []Rule  `json:"rules"`
+	BaseAmount      float64 `json:"base_amount"`
+	Latency         string  `json:"latency"`
+	ProcessingDelay string  `json:"processing_delay"`
+	RateLimit       int     `json:"rate_limit"`
+}
+
+// LoadConfig читает конфигурацию из JSON-файла; длительности задаются строками вида "150ms"
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read config: %w", err)
+	}
+
+	var cj configJSON
+	err = json.Unmarshal(data, &cj)
+	if err != nil {
+		return cfg, fmt.Errorf("parse config: %w", err)
+	}
+
+	cfg.Rules = cj.Rules
+	cfg.BaseAmount = cj.BaseAmount
+	cfg.RateLimit = cj.RateLimit
+	if cj.Latency != "" {
+		cfg.Latency, err = time.ParseDuration(cj.Latency)
+		if err != nil {
+			return cfg, fmt.Errorf("parse latency: %w", err)
+		}
+	}
+	if cj.ProcessingDelay != "" {
+		cfg.ProcessingDelay, err = time.ParseDuration(cj.ProcessingDelay)
+		if err != nil {
+			return cfg, fmt.Errorf("parse processing delay: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+type Server struct {
+	cfg Config
+	now func() time.Time
+
+	mu          sync.Mutex
+	seen        map[string]time.Time
+	windowStart time.Time
+	requests    int
+}
+
+func New(cfg Config) *Server {
+	if cfg.BaseAmount <= 0 {
+		cfg.BaseAmount = 1000
+	}
+	if len(cfg.Rules) == 0 {
+		cfg.Rules = []Rule{{Reward: 10}}
+	}
+
+	return &Server{
+		cfg:  cfg,
+		now:  time.Now,
+		seen: make(map[string]time.Time),
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	e := echo.New()
+	e.HideBanner = true
+
+	// получение информации о расчёте начислений баллов лояльности
+	e.GET("/api/orders/:number", s.Order)
+
+	return e
+}
+
+type orderJSON struct {
+	OrderNumber string   `json:"order"`
+	Status      string   `json:"status"`
+	Accrual     *float64 `json:"accrual,omitempty"`
+}
+
+func (s *Server) Order(c echo.Context) error {
+	// StatusOK 200 — успешная обработка запроса
+	// StatusTooManyRequests 429 — превышено количество запросов к сервису
+
+	if s.cfg.Latency > 0 {
+		time.Sleep(s.cfg.Latency)
+	}
+
+	number := c.Param("number")
+
+	retryAfter, registeredAt := s.register(number)
+	if retryAfter > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return c.String(http.StatusTooManyRequests, fmt.Sprintf("No more than %d requests per minute allowed", s.cfg.RateLimit))
+	}
+
+	if s.now().Sub(registeredAt) < s.cfg.ProcessingDelay {
+		return c.JSON(http.StatusOK, orderJSON{OrderNumber: number, Status: "PROCESSING"})
+	}
+
+	rule := s.rule(number)
+	if fraction(number) < rule.InvalidRatio {
+		return c.JSON(http.StatusOK, orderJSON{OrderNumber: number, Status: "INVALID"})
+	}
+
+	accrual := math.Round(s.cfg.BaseAmount*rule.Reward) / 100
+	return c.JSON(http.StatusOK, orderJSON{OrderNumber: number, Status: "PROCESSED", Accrual: &accrual})
+}
+
+// register учитывает запрос в ограничении частоты и запоминает время первого обращения к заказу.
+// Если лимит исчерпан, возвращает число секунд до начала следующей минуты.
+func (s *Server) register(number string) (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.cfg.RateLimit > 0 {
+		if now.Sub(s.windowStart) >= time.Minute {
+			s.windowStart = now
+			s.requests = 0
+		}
+		if s.requests >= s.cfg.RateLimit {
+			return int(math.Ceil(s.windowStart.Add(time.Minute).Sub(now).Seconds())), time.Time{}
+		}
+		s.requests++
+	}
+
+	registeredAt, ok := s.seen[number]
+	if !ok {
+		registeredAt = now
+		s.seen[number] = registeredAt
+	}
+
+	return 0, registeredAt
+}
+
+// rule выбирает правило с самым длинным подходящим префиксом
+func (s *Server) rule(number string) Rule {
+	var result Rule
+	found := false
+	for _, r := range s.cfg.Rules {
+		if strings.HasPrefix(number, r.Prefix) && (!found || len(r.Prefix) > len(result.Prefix)) {
+			result = r
+			found = true
+		}
+	}
+	return result
+}
+
+// fraction детерминированно отображает номер заказа в [0, 1), чтобы повторные запросы
+// по одному заказу давали одинаковый результат
+func fraction(number string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(number))
+	return float64(h.Sum64()%10000) / 10000
+}
@@ -0,0 +1,99 @@
+package accrualfake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, s *Server, number string) (*http.Response, orderJSON) {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil)
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, request)
+
+	result := recorder.Result()
+	defer result.Body.Close()
+
+	var o orderJSON
+	if result.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(result.Body).Decode(&o); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+	}
+	return result, o
+}
+
+func TestServer_Order(t *testing.T) {
+	now := time.Now()
+	s := New(Config{
+		Rules: []Rule{
+			{Reward: 5},
+			{Prefix: "12", Reward: 20},
+			{Prefix: "9", InvalidRatio: 1},
+		},
+		ProcessingDelay: time.Second,
+	})
+	s.now = func() time.Time { return now }
+
+	_, o := get(t, s, "125764357")
+	if o.Status != "PROCESSING" || o.Accrual != nil {
+		t.Fatalf("expected new order to be PROCESSING without accrual; got %+v", o)
+	}
+	get(t, s, "5347754565")
+
+	now = now.Add(time.Second)
+	tests := []struct {
+		number  string
+		status  string
+		accrual float64
+	}{
+		{number: "125764357", status: "PROCESSED", accrual: 200},
+		{number: "5347754565", status: "PROCESSED", accrual: 50},
+		{number: "87643", status: "PROCESSING"},
+	}
+	for _, tt := range tests {
+		_, o := get(t, s, tt.number)
+		if o.Status != tt.status {
+			t.Errorf("order %s: expected status %v; got %v", tt.number, tt.status, o.Status)
+		}
+		if tt.status == "PROCESSED" && (o.Accrual == nil || *o.Accrual != tt.accrual) {
+			t.Errorf("order %s: expected accrual %v; got %v", tt.number, tt.accrual, o.Accrual)
+		}
+	}
+
+	get(t, s, "9740174550")
+	now = now.Add(time.Second)
+	if _, o := get(t, s, "9740174550"); o.Status != "INVALID" {
+		t.Errorf("expected INVALID; got %v", o.Status)
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	now := time.Now()
+	s := New(Config{RateLimit: 2})
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if result, _ := get(t, s, "125764357"); result.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: expected status %v; got %v", i, http.StatusOK, result.StatusCode)
+		}
+	}
+
+	now = now.Add(15 * time.Second)
+	result, _ := get(t, s, "125764357")
+	if result.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %v; got %v", http.StatusTooManyRequests, result.StatusCode)
+	}
+	if got := result.Header.Get("Retry-After"); got != "45" {
+		t.Errorf("expected Retry-After 45; got %v", got)
+	}
+
+	now = now.Add(45 * time.Second)
+	if result, _ := get(t, s, "125764357"); result.StatusCode != http.StatusOK {
+		t.Errorf("expected status %v after window; got %v", http.StatusOK, result.StatusCode)
+	}
+}
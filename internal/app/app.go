@@ -1,48 +1,310 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 
+	"github.com/inkpics/gophermart/internal/config"
+	"github.com/inkpics/gophermart/internal/logging"
+	"github.com/inkpics/gophermart/internal/openapi"
 	"github.com/inkpics/gophermart/internal/proc"
+	"github.com/inkpics/gophermart/internal/tracing"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-func Start(runAddr, databaseAddr, accrualAddr string) error {
-	p, err := proc.New(runAddr, databaseAddr, accrualAddr)
+// accrualBreaker — экземпляр сервиса, состояние автомата которого публикуется в /debug/vars.
+// Переменная expvar публикуется один раз, а Start только подменяет экземпляр: повторная
+// публикация под тем же именем паникует.
+var accrualBreaker atomic.Pointer[proc.Proc]
+
+func init() {
+	expvar.Publish("accrual_breaker", expvar.Func(func() any {
+		p := accrualBreaker.Load()
+		if p == nil {
+			return nil
+		}
+		return p.AccrualBreaker()
+	}))
+}
+
+// Start запускает сервис и блокируется до отмены ctx, после чего перестаёт принимать
+// соединения, дожидается обрабатываемых запросов и фоновых задач и закрывает хранилище
+func Start(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	p, err := proc.New(ctx, logger, cfg)
 	if err != nil {
 		return fmt.Errorf("handler: %w", err)
 	}
+	defer p.Close()
+
+	accrualBreaker.Store(p)
+	defer accrualBreaker.CompareAndSwap(p, nil)
 
-	go p.AccrualLoop()
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var workers sync.WaitGroup
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		p.AccrualLoop(workersCtx)
+	}()
+	go func() {
+		defer workers.Done()
+		p.Sweeper(workersCtx)
+	}()
 
 	e := echo.New()
-	e.Use(middleware.Gzip())
+	e.HideBanner = true
+	e.HidePort = true
+	e.HTTPErrorHandler = p.HTTPErrorHandler
+	e.Use(logging.Middleware(logger))
+	e.Use(otelecho.Middleware(tracing.ServiceName))
+	e.Use(p.Metrics().Middleware)
+	if cfg.TLS.Enabled() && cfg.TLS.HSTSMaxAge > 0 {
+		e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+			HSTSMaxAge: int(cfg.TLS.HSTSMaxAge.Seconds()),
+		}))
+	}
+	e.Use(middleware.BodyLimit(cfg.HTTP.BodyLimit))
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		// поток событий сбрасывается клиенту после каждого события, сжатие ему не нужно;
+		// соединение WebSocket забирается у HTTP-сервера
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/api/user/events" || c.Path() == "/api/user/ws"
+		},
+	}))
 	e.Use(middleware.Decompress())
 
+	routes(e, p)
+
+	srv := &http.Server{
+		Addr:         cfg.RunAddress,
+		Handler:      e,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(p.CloseEvents)
+	servers := []*http.Server{srv}
+
+	if cfg.TLS.Enabled() {
+		srv.TLSConfig, err = tlsConfig(logger, cfg.TLS, cfg.RunAddress)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+
+		if cfg.TLS.RedirectAddress != "" {
+			servers = append(servers, &http.Server{
+				Addr:        cfg.TLS.RedirectAddress,
+				Handler:     redirectHandler(cfg.RunAddress),
+				ReadTimeout: cfg.HTTP.ReadTimeout,
+				IdleTimeout: cfg.HTTP.IdleTimeout,
+			})
+		}
+	}
+
+	serveErr := make(chan error, len(servers))
+	for _, s := range servers {
+		s := s
+		logger.Info("starting server", "address", s.Addr, "tls", s.TLSConfig != nil)
+		go func() {
+			if s.TLSConfig != nil {
+				serveErr <- s.ListenAndServeTLS("", "")
+			} else {
+				serveErr <- s.ListenAndServe()
+			}
+		}()
+	}
+
+	var grpcSrv *grpc.Server
+	if cfg.GRPCAddress != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			return fmt.Errorf("grpc listen: %w", err)
+		}
+
+		var opts []grpc.ServerOption
+		if srv.TLSConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(srv.TLSConfig)))
+		}
+		grpcSrv = p.NewGRPCServer(opts...)
+
+		logger.Info("starting grpc server", "address", cfg.GRPCAddress, "tls", srv.TLSConfig != nil)
+		go func() {
+			serveErr <- grpcSrv.Serve(lis)
+		}()
+	}
+
+	select {
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+		logger.Info("shutting down", "timeout", cfg.HTTP.ShutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		shutdownErr := s.Shutdown(shutdownCtx)
+		if shutdownErr != nil && err == nil {
+			err = fmt.Errorf("shutdown: %w", shutdownErr)
+		}
+	}
+	if grpcSrv != nil {
+		stopGRPC(shutdownCtx, grpcSrv)
+	}
+
+	stopWorkers()
+	workers.Wait()
+
+	return err
+}
+
+// stopGRPC дожидается завершения вызовов gRPC, а по истечении ctx прерывает оставшиеся
+func stopGRPC(ctx context.Context, s *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Stop()
+		<-done
+	}
+}
+
+// routes регистрирует обработчики API; каждый маршрут описан в internal/openapi/openapi.json
+func routes(e *echo.Echo, p *proc.Proc) {
+	// проверка, что процесс жив
+	e.GET("/healthz", p.Healthz)
+
+	// проверка готовности: доступность базы данных, версия схемы, состояние системы расчёта
+	e.GET("/readyz", p.Readyz)
+
+	// подробное состояние сервиса для эксплуатации: версия Go, пул соединений базы
+	// и автомат системы расчёта видны только администратору
+	e.GET("/status", p.Status, p.MiddlewareAdmin)
+
+	// метрики в формате Prometheus
+	e.GET("/metrics", p.MetricsHandler)
+
+	// спецификация API в формате OpenAPI 3
+	e.GET("/api/openapi.json", openapi.Handler)
+
+	// документация API
+	e.GET("/api/docs", openapi.Docs)
+
 	// регистрация пользователя
-	e.POST("/api/user/register", p.Register)
+	e.POST("/api/user/register", p.Register, proc.Deprecated("/api/v2/user/register"))
 
 	// аутентификация пользователя
-	e.POST("/api/user/login", p.Login)
+	e.POST("/api/user/login", p.Login, proc.Deprecated("/api/v2/user/login"))
 
 	// загрузка пользователем номера заказа для расчёта
-	e.POST("/api/user/orders", p.SetOrders, p.MiddlewareAuth)
+	e.POST("/api/user/orders", p.SetOrders, proc.Deprecated("/api/v2/user/orders"), p.MiddlewareAuth)
 
 	// получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях
-	e.GET("/api/user/orders", p.Orders, p.MiddlewareAuth)
+	e.GET("/api/user/orders", p.Orders, proc.Deprecated("/api/v2/user/orders"), p.MiddlewareAuth)
 
 	// получение текущего баланса счёта баллов лояльности пользователя
-	e.GET("/api/user/balance", p.Balance, p.MiddlewareAuth)
+	e.GET("/api/user/balance", p.Balance, proc.Deprecated("/api/v2/user/balance"), p.MiddlewareAuth)
 
 	// запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа
-	e.POST("/api/user/balance/withdraw", p.Withdraw, p.MiddlewareAuth)
+	e.POST("/api/user/balance/withdraw", p.Withdraw, proc.Deprecated("/api/v2/user/balance/withdraw"), p.MiddlewareAuth)
 
 	// получение информации о выводе средств с накопительного счёта пользователя
-	e.GET("/api/user/withdrawals", p.Withdrawals, p.MiddlewareAuth)
+	e.GET("/api/user/withdrawals", p.Withdrawals, proc.Deprecated("/api/v2/user/withdrawals"), p.MiddlewareAuth)
+
+	// поток событий пользователя (SSE): изменения статусов заказов и баланса
+	e.GET("/api/user/events", p.Events, p.MiddlewareAuth)
+
+	// уведомления пользователя по WebSocket с подпиской на события
+	e.GET("/api/user/ws", p.Notifications, p.MiddlewareAuth)
+
+	// выписка по счёту за период в формате json, csv или text
+	e.GET("/api/user/statement", p.Statement, p.MiddlewareAuth)
+
+	// сгорающие баллы пользователя по срокам сгорания
+	e.GET("/api/user/balance/expiring", p.ExpiringBalance, p.MiddlewareAuth)
+
+	// статус пользователя по начислениям за скользящее окно
+	e.GET("/api/user/tier", p.Tier, p.MiddlewareAuth)
+
+	// история повышений и понижений статуса
+	e.GET("/api/user/tier/history", p.TierHistory, p.MiddlewareAuth)
+
+	// вторая версия API: идентификаторы заказов и списаний, суммы строками, время в UTC
+	v2 := e.Group("/api/v2")
+
+	// регистрация пользователя
+	v2.POST("/user/register", p.Register)
+
+	// аутентификация пользователя
+	v2.POST("/user/login", p.Login)
+
+	// загрузка номера заказа текстом или в JSON
+	v2.POST("/user/orders", p.SetOrdersV2, p.MiddlewareAuth)
+
+	// пакетная загрузка номеров заказов: JSON-массив или текст, по номеру в строке
+	v2.POST("/user/orders/batch", p.SetOrdersBatch, p.MiddlewareAuth)
+
+	// получение списка загруженных пользователем заказов
+	v2.GET("/user/orders", p.OrdersV2, p.MiddlewareAuth)
+
+	// получение текущего баланса пользователя
+	v2.GET("/user/balance", p.BalanceV2, p.MiddlewareAuth)
+
+	// списание баллов, в ответе баланс после списания
+	v2.POST("/user/balance/withdraw", p.WithdrawV2, p.MiddlewareAuth)
+
+	// получение списка списаний пользователя
+	v2.GET("/user/withdrawals", p.WithdrawalsV2, p.MiddlewareAuth)
+
+	// резервирование баллов на время оплаты заказа
+	v2.POST("/user/reservations", p.Reserve, p.MiddlewareAuth)
+
+	// списание зарезервированных баллов
+	v2.POST("/user/reservations/:id/capture", p.CaptureReservation, p.MiddlewareAuth)
+
+	// снятие резерва
+	v2.POST("/user/reservations/:id/release", p.ReleaseReservation, p.MiddlewareAuth)
+
+	// приём результатов расчёта начислений от системы расчёта
+	e.POST("/api/accrual/webhook", p.AccrualWebhook)
+
+	// возврат баллов по списанию по обратному вызову магазина
+	e.POST("/api/shop/refund", p.ShopRefund)
+
+	// получение списка заказов, исчерпавших попытки расчёта начислений
+	e.GET("/api/admin/orders/dead", p.DeadOrders, p.MiddlewareAdmin)
+
+	// возврат заказа в очередь расчёта начислений
+	e.POST("/api/admin/orders/:number/requeue", p.RequeueOrder, p.MiddlewareAdmin)
+
+	// возврат баллов по списанию администратором
+	e.POST("/api/admin/withdrawals/:id/refund", p.RefundWithdrawal, p.MiddlewareAdmin)
 
-	e.Logger.Fatal(e.Start(runAddr))
+	// состояние автомата защиты системы расчёта начислений
+	e.GET("/api/admin/accrual/status", p.AccrualStatus, p.MiddlewareAdmin)
 
-	return nil
+	// метрики процесса в формате expvar
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()), p.MiddlewareAdmin)
 }
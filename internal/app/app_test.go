@@ -0,0 +1,41 @@
+package app
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/inkpics/gophermart/internal/openapi"
+	"github.com/inkpics/gophermart/internal/proc"
+	"github.com/labstack/echo/v4"
+)
+
+var pathParam = regexp.MustCompile(`:([a-zA-Z_]+)`)
+
+func Test_routesDocumented(t *testing.T) {
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	routes(e, &proc.Proc{})
+
+	registered := make(map[string]bool)
+	for _, r := range e.Routes() {
+		path := pathParam.ReplaceAllString(r.Path, "{$1}")
+		registered[r.Method+" "+path] = true
+
+		item := doc.Paths.Find(path)
+		if item == nil || item.GetOperation(r.Method) == nil {
+			t.Errorf("route %s %s is not described in the specification", r.Method, path)
+		}
+	}
+
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			if !registered[method+" "+path] {
+				t.Errorf("operation %s %s is not registered", method, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/certs"
+	"github.com/inkpics/gophermart/internal/config"
+)
+
+// срок действия самоподписанного сертификата для разработки
+const selfSignedValidFor = 90 * 24 * time.Hour
+
+func tlsConfig(logger *slog.Logger, cfg config.TLS, runAddr string) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if cfg.SelfSigned {
+		host, _, _ := net.SplitHostPort(runAddr)
+		cert, err := certs.SelfSigned([]string{host, "localhost", "127.0.0.1", "::1"}, selfSignedValidFor)
+		if err != nil {
+			return nil, fmt.Errorf("self-signed certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+		return tc, nil
+	}
+
+	r, err := certs.NewReloader(cfg.CertFile, cfg.KeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	tc.GetCertificate = r.GetCertificate
+
+	return tc, nil
+}
+
+// redirectHandler перенаправляет запросы по HTTP на тот же путь на HTTPS-порту сервиса
+func redirectHandler(runAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(runAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,29 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_redirectHandler(t *testing.T) {
+	tests := []struct {
+		runAddr string
+		target  string
+		want    string
+	}{
+		{runAddr: ":8443", target: "http://example.com:8080/api/user/orders?x=1", want: "https://example.com:8443/api/user/orders?x=1"},
+		{runAddr: "0.0.0.0:443", target: "http://example.com/api/user/balance", want: "https://example.com/api/user/balance"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		redirectHandler(tt.runAddr).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, tt.target, nil))
+
+		if recorder.Code != http.StatusPermanentRedirect {
+			t.Errorf("expected status %v; got %v", http.StatusPermanentRedirect, recorder.Code)
+		}
+		if got := recorder.Header().Get("Location"); got != tt.want {
+			t.Errorf("expected redirect to %v; got %v", tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type Config struct {
+	// количество ошибок подряд, после которого автомат размыкается
+	FailureThreshold int
+	// время в разомкнутом состоянии до пробного запроса
+	OpenTimeout time.Duration
+	// количество успешных пробных запросов для замыкания
+	SuccessThreshold int
+	// вызывается при каждой смене состояния
+	OnStateChange func(from, to State)
+}
+
+type Snapshot struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Trips               int64     `json:"trips"`
+	Rejected            int64     `json:"rejected"`
+	OpenedAt            time.Time `json:"opened_at,omitempty"`
+}
+
+type Breaker struct {
+	cfg Config
+	now func() time.Time
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	successes int
+	probing   bool
+	openedAt  time.Time
+	trips     int64
+	rejected  int64
+}
+
+func New(cfg Config) *Breaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.SuccessThreshold <= 0 {
+		cfg.SuccessThreshold = 1
+	}
+
+	return &Breaker{
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// Allow сообщает, можно ли выполнить запрос. В полуразомкнутом состоянии пропускается
+// только один пробный запрос за раз; каждый разрешённый запрос должен завершиться
+// вызовом Success, Failure или Release.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.setState(HalfOpen)
+	}
+
+	switch b.state {
+	case Open:
+		b.rejected++
+		return false
+	case HalfOpen:
+		if b.probing {
+			b.rejected++
+			return false
+		}
+		b.probing = true
+	}
+
+	return true
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != HalfOpen {
+		return
+	}
+
+	b.probing = false
+	b.successes++
+	if b.successes >= b.cfg.SuccessThreshold {
+		b.setState(Closed)
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+		b.trip()
+	case Closed:
+		if b.failures >= b.cfg.FailureThreshold {
+			b.trip()
+		}
+	}
+}
+
+// Release завершает разрешённый запрос, не учитывая его результат: пробный запрос, прерванный
+// вызывающей стороной, ничего не говорит о состоянии сервиса, поэтому место для пробы
+// освобождается, а счётчики не меняются
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) Snapshot() Snapshot {
+	state := b.State()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := Snapshot{
+		State:               state.String(),
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+		Rejected:            b.rejected,
+	}
+	if state != Closed {
+		s.OpenedAt = b.openedAt
+	}
+	return s
+}
+
+func (b *Breaker) trip() {
+	b.trips++
+	b.openedAt = b.now()
+	b.setState(Open)
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+
+	from := b.state
+	b.state = state
+	b.successes = 0
+	if state == Closed {
+		b.failures = 0
+	}
+
+	if b.cfg.OnStateChange != nil {
+		b.cfg.OnStateChange(from, state)
+	}
+}
@@ -0,0 +1,105 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	var transitions []string
+
+	b := New(Config{
+		FailureThreshold: 3,
+		OpenTimeout:      time.Minute,
+		SuccessThreshold: 2,
+		OnStateChange: func(from, to State) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("closed breaker rejected request %d", i)
+		}
+		b.Failure()
+	}
+	if got := b.State(); got != Closed {
+		t.Fatalf("expected state %v; got %v", Closed, got)
+	}
+
+	b.Allow()
+	b.Failure()
+	if got := b.State(); got != Open {
+		t.Fatalf("expected state %v; got %v", Open, got)
+	}
+	if b.Allow() {
+		t.Fatalf("open breaker allowed request")
+	}
+
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatalf("half-open breaker rejected probe")
+	}
+	if b.Allow() {
+		t.Fatalf("half-open breaker allowed second concurrent probe")
+	}
+	b.Failure()
+	if got := b.State(); got != Open {
+		t.Fatalf("expected failed probe to reopen breaker; got %v", got)
+	}
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("half-open breaker rejected probe %d", i)
+		}
+		b.Success()
+	}
+	if got := b.State(); got != Closed {
+		t.Fatalf("expected state %v; got %v", Closed, got)
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("expected transitions %v; got %v", want, transitions)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("expected transitions %v; got %v", want, transitions)
+			break
+		}
+	}
+
+	s := b.Snapshot()
+	if s.Trips != 2 || s.Rejected != 2 {
+		t.Errorf("expected 2 trips and 2 rejections; got %+v", s)
+	}
+}
+
+func TestBreaker_Release(t *testing.T) {
+	now := time.Now()
+	b := New(Config{FailureThreshold: 1, OpenTimeout: time.Minute, SuccessThreshold: 1})
+	b.now = func() time.Time { return now }
+
+	b.Allow()
+	b.Failure()
+	now = now.Add(time.Minute)
+
+	if !b.Allow() {
+		t.Fatalf("half-open breaker rejected probe")
+	}
+	b.Release()
+	if got := b.State(); got != HalfOpen {
+		t.Fatalf("expected released probe to keep state %v; got %v", HalfOpen, got)
+	}
+
+	if !b.Allow() {
+		t.Fatalf("half-open breaker rejected probe after release")
+	}
+	b.Success()
+	if got := b.State(); got != Closed {
+		t.Fatalf("expected state %v; got %v", Closed, got)
+	}
+}
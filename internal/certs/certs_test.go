@@ -0,0 +1,108 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePair(t *testing.T, dir string, cert tls.Certificate, modTime time.Time) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	for name, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: key},
+	} {
+		if err := os.WriteFile(name, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("could not write %s: %v", name, err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatalf("could not touch %s: %v", name, err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestSelfSigned(t *testing.T) {
+	cert, err := SelfSigned([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	if err := cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("expected certificate for localhost: %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("expected certificate for 127.0.0.1: %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("example.com"); err == nil {
+		t.Errorf("expected certificate not to cover example.com")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+
+	first, err := SelfSigned([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	certFile, keyFile := writePair(t, dir, first, start)
+
+	var logs bytes.Buffer
+	r, err := NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatalf("could not create reloader: %v", err)
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	got, _ := r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], first.Certificate[0]) {
+		t.Fatalf("expected initial certificate")
+	}
+
+	second, err := SelfSigned([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	writePair(t, dir, second, start.Add(time.Minute))
+
+	got, _ = r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], first.Certificate[0]) {
+		t.Errorf("expected files not to be checked before interval elapses")
+	}
+
+	now = now.Add(checkInterval)
+	got, _ = r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], second.Certificate[0]) {
+		t.Errorf("expected reloaded certificate")
+	}
+
+	if err := os.WriteFile(keyFile, []byte("broken"), 0o600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+	now = now.Add(checkInterval)
+	got, _ = r.GetCertificate(nil)
+	if !bytes.Equal(got.Certificate[0], second.Certificate[0]) {
+		t.Errorf("expected previous certificate to be kept when files are invalid")
+	}
+	if !strings.Contains(logs.String(), "msg=\"reload certificate\"") {
+		t.Errorf("expected reload error to be logged; got %s", logs.String())
+	}
+}
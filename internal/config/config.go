@@ -0,0 +1,492 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/inkpics/gophermart/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+const masked = "xxxxx"
+
+type Config struct {
+	RunAddress string `yaml:"run_address" toml:"run_address"`
+	// адрес сервера gRPC; пустая строка отключает gRPC
+	GRPCAddress string   `yaml:"grpc_address" toml:"grpc_address"`
+	Database    Database `yaml:"database" toml:"database"`
+	Accrual     Accrual  `yaml:"accrual" toml:"accrual"`
+	Auth        Auth     `yaml:"auth" toml:"auth"`
+	Loyalty     Loyalty  `yaml:"loyalty" toml:"loyalty"`
+	HTTP        HTTP     `yaml:"http" toml:"http"`
+	TLS         TLS      `yaml:"tls" toml:"tls"`
+	Log         Log      `yaml:"log" toml:"log"`
+	Trace       Trace    `yaml:"trace" toml:"trace"`
+}
+
+type Database struct {
+	URI             string        `yaml:"uri" toml:"uri"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+}
+
+type Accrual struct {
+	Address        string        `yaml:"address" toml:"address"`
+	PollInterval   time.Duration `yaml:"poll_interval" toml:"poll_interval"`
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"`
+	// количество неудачных попыток, после которого заказ переводится в статус DEAD
+	MaxAttempts int           `yaml:"max_attempts" toml:"max_attempts"`
+	BaseDelay   time.Duration `yaml:"base_delay" toml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay" toml:"max_delay"`
+	WebhookKey  string        `yaml:"webhook_key" toml:"webhook_key"`
+	Breaker     Breaker       `yaml:"breaker" toml:"breaker"`
+}
+
+type Breaker struct {
+	FailureThreshold int           `yaml:"failure_threshold" toml:"failure_threshold"`
+	OpenTimeout      time.Duration `yaml:"open_timeout" toml:"open_timeout"`
+	SuccessThreshold int           `yaml:"success_threshold" toml:"success_threshold"`
+}
+
+type Auth struct {
+	// ключ подписи cookie пользователя
+	CookieSecret string `yaml:"cookie_secret" toml:"cookie_secret"`
+	AdminToken   string `yaml:"admin_token" toml:"admin_token"`
+	// ключ подписи обратных вызовов магазина о возвратах
+	ShopKey string `yaml:"shop_key" toml:"shop_key"`
+}
+
+type Loyalty struct {
+	// время, через которое неподтверждённый резерв баллов снимается
+	ReservationTTL time.Duration `yaml:"reservation_ttl" toml:"reservation_ttl"`
+	// интервал фоновой проверки истёкших резервов и сгорающих баллов
+	SweepInterval time.Duration `yaml:"sweep_interval" toml:"sweep_interval"`
+	// срок жизни начисленных баллов; 0 — баллы не сгорают
+	PointsTTL time.Duration `yaml:"points_ttl" toml:"points_ttl"`
+	// суммы начислений за TierWindow, с которых присваиваются статусы
+	TierSilver   float64 `yaml:"tier_silver" toml:"tier_silver"`
+	TierGold     float64 `yaml:"tier_gold" toml:"tier_gold"`
+	TierPlatinum float64 `yaml:"tier_platinum" toml:"tier_platinum"`
+	// скользящее окно, за которое суммируются начисления для статуса
+	TierWindow time.Duration `yaml:"tier_window" toml:"tier_window"`
+	// интервал фонового пересчёта статусов, начисления которых вышли из окна
+	TierSweepInterval time.Duration `yaml:"tier_sweep_interval" toml:"tier_sweep_interval"`
+}
+
+type HTTP struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// максимальный размер тела запроса, например "1M"
+	BodyLimit string `yaml:"body_limit" toml:"body_limit"`
+}
+
+type TLS struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// самоподписанный сертификат, создаваемый при запуске; только для разработки
+	SelfSigned bool `yaml:"self_signed" toml:"self_signed"`
+	// адрес дополнительного HTTP-слушателя, перенаправляющего запросы на HTTPS
+	RedirectAddress string `yaml:"redirect_address" toml:"redirect_address"`
+	// 0 отключает заголовок Strict-Transport-Security
+	HSTSMaxAge time.Duration `yaml:"hsts_max_age" toml:"hsts_max_age"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.SelfSigned || t.CertFile != "" || t.KeyFile != ""
+}
+
+type Log struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+}
+
+type Trace struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+}
+
+func Default() Config {
+	return Config{
+		RunAddress: "localhost:8080",
+		Database: Database{
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+		},
+		Accrual: Accrual{
+			PollInterval:   3 * time.Second,
+			RequestTimeout: 10 * time.Second,
+			MaxAttempts:    10,
+			BaseDelay:      3 * time.Second,
+			MaxDelay:       30 * time.Minute,
+			Breaker: Breaker{
+				FailureThreshold: 5,
+				OpenTimeout:      30 * time.Second,
+				SuccessThreshold: 1,
+			},
+		},
+		Auth: Auth{
+			CookieSecret: "e0e10cbb-7713-43b4-9dc7-e198779e130c",
+		},
+		Loyalty: Loyalty{
+			ReservationTTL:    15 * time.Minute,
+			SweepInterval:     time.Minute,
+			TierSilver:        1000,
+			TierGold:          5000,
+			TierPlatinum:      20000,
+			TierWindow:        365 * 24 * time.Hour,
+			TierSweepInterval: time.Hour,
+		},
+		HTTP: HTTP{
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 10 * time.Second,
+			BodyLimit:       "1M",
+		},
+		TLS: TLS{
+			HSTSMaxAge: 365 * 24 * time.Hour,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Trace: Trace{
+			Exporter: "none",
+		},
+	}
+}
+
+// option описывает параметр, задаваемый переменной окружения и флагом
+type option struct {
+	env     string
+	flags   []string
+	usage   string
+	secret  bool
+	pointer func(cfg *Config) any
+}
+
+var options = []option{
+	{env: "RUN_ADDRESS", flags: []string{"a", "run-address"}, usage: "service address", pointer: func(c *Config) any { return &c.RunAddress }},
+	{env: "GRPC_ADDRESS", flags: []string{"g", "grpc-address"}, usage: "gRPC service address, empty disables gRPC", pointer: func(c *Config) any { return &c.GRPCAddress }},
+	{env: "DATABASE_URI", flags: []string{"d", "database-uri"}, usage: "database address", secret: true, pointer: func(c *Config) any { return &c.Database.URI }},
+	{env: "DATABASE_MAX_OPEN_CONNS", flags: []string{"database-max-open-conns"}, usage: "maximum open database connections", pointer: func(c *Config) any { return &c.Database.MaxOpenConns }},
+	{env: "DATABASE_MAX_IDLE_CONNS", flags: []string{"database-max-idle-conns"}, usage: "maximum idle database connections", pointer: func(c *Config) any { return &c.Database.MaxIdleConns }},
+	{env: "DATABASE_CONN_MAX_LIFETIME", flags: []string{"database-conn-max-lifetime"}, usage: "maximum database connection lifetime", pointer: func(c *Config) any { return &c.Database.ConnMaxLifetime }},
+	{env: "ACCRUAL_SYSTEM_ADDRESS", flags: []string{"r", "accrual-address"}, usage: "accrual address", pointer: func(c *Config) any { return &c.Accrual.Address }},
+	{env: "ACCRUAL_POLL_INTERVAL", flags: []string{"accrual-poll-interval"}, usage: "accrual polling interval", pointer: func(c *Config) any { return &c.Accrual.PollInterval }},
+	{env: "ACCRUAL_REQUEST_TIMEOUT", flags: []string{"accrual-request-timeout"}, usage: "accrual request timeout", pointer: func(c *Config) any { return &c.Accrual.RequestTimeout }},
+	{env: "ACCRUAL_MAX_ATTEMPTS", flags: []string{"accrual-max-attempts"}, usage: "failed accrual lookups before an order is dead-lettered", pointer: func(c *Config) any { return &c.Accrual.MaxAttempts }},
+	{env: "ACCRUAL_BASE_DELAY", flags: []string{"accrual-base-delay"}, usage: "first retry delay after a failed accrual lookup", pointer: func(c *Config) any { return &c.Accrual.BaseDelay }},
+	{env: "ACCRUAL_MAX_DELAY", flags: []string{"accrual-max-delay"}, usage: "maximum retry delay after failed accrual lookups", pointer: func(c *Config) any { return &c.Accrual.MaxDelay }},
+	{env: "ACCRUAL_WEBHOOK_KEY", flags: []string{"w", "accrual-webhook-key"}, usage: "accrual webhook signing key", secret: true, pointer: func(c *Config) any { return &c.Accrual.WebhookKey }},
+	{env: "BREAKER_FAILURES", flags: []string{"breaker-failures"}, usage: "accrual failures before the circuit breaker opens", pointer: func(c *Config) any { return &c.Accrual.Breaker.FailureThreshold }},
+	{env: "BREAKER_TIMEOUT", flags: []string{"breaker-timeout"}, usage: "time the accrual circuit breaker stays open", pointer: func(c *Config) any { return &c.Accrual.Breaker.OpenTimeout }},
+	{env: "BREAKER_SUCCESSES", flags: []string{"breaker-successes"}, usage: "successful probes before the circuit breaker closes", pointer: func(c *Config) any { return &c.Accrual.Breaker.SuccessThreshold }},
+	{env: "COOKIE_SECRET", flags: []string{"cookie-secret"}, usage: "user cookie signing key", secret: true, pointer: func(c *Config) any { return &c.Auth.CookieSecret }},
+	{env: "ADMIN_TOKEN", flags: []string{"t", "admin-token"}, usage: "admin api token", secret: true, pointer: func(c *Config) any { return &c.Auth.AdminToken }},
+	{env: "SHOP_KEY", flags: []string{"shop-key"}, usage: "shop refund callback signing key", secret: true, pointer: func(c *Config) any { return &c.Auth.ShopKey }},
+	{env: "RESERVATION_TTL", flags: []string{"reservation-ttl"}, usage: "time until an uncaptured points reservation is released", pointer: func(c *Config) any { return &c.Loyalty.ReservationTTL }},
+	{env: "RESERVATION_SWEEP_INTERVAL", flags: []string{"reservation-sweep-interval"}, usage: "interval of the expired reservations and points sweep", pointer: func(c *Config) any { return &c.Loyalty.SweepInterval }},
+	{env: "POINTS_TTL", flags: []string{"points-ttl"}, usage: "time after accrual when points expire, e.g. 8760h; 0 keeps points forever", pointer: func(c *Config) any { return &c.Loyalty.PointsTTL }},
+	{env: "TIER_SILVER", flags: []string{"tier-silver"}, usage: "accrual total over the tier window for the silver tier", pointer: func(c *Config) any { return &c.Loyalty.TierSilver }},
+	{env: "TIER_GOLD", flags: []string{"tier-gold"}, usage: "accrual total over the tier window for the gold tier", pointer: func(c *Config) any { return &c.Loyalty.TierGold }},
+	{env: "TIER_PLATINUM", flags: []string{"tier-platinum"}, usage: "accrual total over the tier window for the platinum tier", pointer: func(c *Config) any { return &c.Loyalty.TierPlatinum }},
+	{env: "TIER_WINDOW", flags: []string{"tier-window"}, usage: "rolling window of accruals counted for the tier", pointer: func(c *Config) any { return &c.Loyalty.TierWindow }},
+	{env: "TIER_SWEEP_INTERVAL", flags: []string{"tier-sweep-interval"}, usage: "interval of the tier recomputation for accruals leaving the window", pointer: func(c *Config) any { return &c.Loyalty.TierSweepInterval }},
+	{env: "HTTP_READ_TIMEOUT", flags: []string{"http-read-timeout"}, usage: "request read timeout", pointer: func(c *Config) any { return &c.HTTP.ReadTimeout }},
+	{env: "HTTP_WRITE_TIMEOUT", flags: []string{"http-write-timeout"}, usage: "response write timeout", pointer: func(c *Config) any { return &c.HTTP.WriteTimeout }},
+	{env: "HTTP_IDLE_TIMEOUT", flags: []string{"http-idle-timeout"}, usage: "keep-alive idle timeout", pointer: func(c *Config) any { return &c.HTTP.IdleTimeout }},
+	{env: "HTTP_SHUTDOWN_TIMEOUT", flags: []string{"http-shutdown-timeout"}, usage: "time to drain requests on shutdown", pointer: func(c *Config) any { return &c.HTTP.ShutdownTimeout }},
+	{env: "HTTP_BODY_LIMIT", flags: []string{"http-body-limit"}, usage: "maximum request body size, e.g. 1M", pointer: func(c *Config) any { return &c.HTTP.BodyLimit }},
+	{env: "TLS_CERT_FILE", flags: []string{"tls-cert"}, usage: "TLS certificate file, reloaded on change", pointer: func(c *Config) any { return &c.TLS.CertFile }},
+	{env: "TLS_KEY_FILE", flags: []string{"tls-key"}, usage: "TLS private key file, reloaded on change", pointer: func(c *Config) any { return &c.TLS.KeyFile }},
+	{env: "TLS_SELF_SIGNED", flags: []string{"tls-self-signed"}, usage: "serve HTTPS with a generated self-signed certificate (development only)", pointer: func(c *Config) any { return &c.TLS.SelfSigned }},
+	{env: "TLS_REDIRECT_ADDRESS", flags: []string{"tls-redirect-address"}, usage: "address of a plain HTTP listener redirecting to HTTPS", pointer: func(c *Config) any { return &c.TLS.RedirectAddress }},
+	{env: "HSTS_MAX_AGE", flags: []string{"hsts-max-age"}, usage: "Strict-Transport-Security max-age, 0 disables the header", pointer: func(c *Config) any { return &c.TLS.HSTSMaxAge }},
+	{env: "LOG_LEVEL", flags: []string{"log-level"}, usage: "log level: debug, info, warn or error", pointer: func(c *Config) any { return &c.Log.Level }},
+	{env: "LOG_FORMAT", flags: []string{"log-format"}, usage: "log format: json or text", pointer: func(c *Config) any { return &c.Log.Format }},
+	{env: "TRACE_EXPORTER", flags: []string{"trace"}, usage: "trace exporter: none, stdout, file:<path> or otlp", pointer: func(c *Config) any { return &c.Trace.Exporter }},
+}
+
+// Load собирает конфигурацию по возрастанию приоритета: значения по умолчанию, файл
+// (флаг -config или CONFIG_FILE; .yaml, .yml или .toml), переменные окружения, флаги
+func Load(name string, args []string, getenv func(string) string, output io.Writer) (Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	configPath := getenv("CONFIG_FILE")
+	fs.StringVar(&configPath, "config", configPath, "config file (yaml or toml)")
+
+	type flagValue struct {
+		opt   option
+		value string
+	}
+	var set []flagValue
+	for _, opt := range options {
+		opt := opt
+		for _, name := range opt.flags {
+			usage := opt.usage + " (env " + opt.env + ")"
+			store := func(s string) error {
+				set = append(set, flagValue{opt: opt, value: s})
+				return nil
+			}
+			if _, ok := opt.pointer(&cfg).(*bool); ok {
+				fs.BoolFunc(name, usage, store)
+			} else {
+				fs.Func(name, usage, store)
+			}
+		}
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if configPath != "" {
+		err = loadFile(configPath, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, opt := range options {
+		if v, ok := lookup(getenv, opt.env); ok {
+			err = assign(opt.pointer(&cfg), v)
+			if err != nil {
+				return cfg, fmt.Errorf("env %s: %w", opt.env, err)
+			}
+		}
+	}
+
+	for _, f := range set {
+		err = assign(f.opt.pointer(&cfg), f.value)
+		if err != nil {
+			return cfg, fmt.Errorf("flag -%s: %w", f.opt.flags[len(f.opt.flags)-1], err)
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func lookup(getenv func(string) string, name string) (string, bool) {
+	v := getenv(name)
+	return v, v != ""
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func assign(ptr any, s string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = s
+	case *int:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		*p = v
+	case *float64:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		*p = v
+	case *bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		*p = v
+	case *time.Duration:
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, use values like 500ms, 3s or 1m", s)
+		}
+		*p = v
+	default:
+		return fmt.Errorf("unsupported option type %T", ptr)
+	}
+	return nil
+}
+
+// Validate проверяет конфигурацию и перечисляет все найденные ошибки сразу
+func (c Config) Validate() error {
+	var errs []string
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.RunAddress); err != nil {
+		add("run_address %q must be host:port", c.RunAddress)
+	}
+	if c.GRPCAddress != "" {
+		if _, _, err := net.SplitHostPort(c.GRPCAddress); err != nil {
+			add("grpc_address %q must be host:port", c.GRPCAddress)
+		} else if c.GRPCAddress == c.RunAddress {
+			add("grpc_address must differ from run_address")
+		}
+	}
+	if c.Database.URI == "" {
+		add("database.uri is required (flag -d or env DATABASE_URI)")
+	}
+	if c.Database.MaxOpenConns < 1 {
+		add("database.max_open_conns must be at least 1")
+	}
+	if c.Database.MaxIdleConns < 0 || c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		add("database.max_idle_conns must be between 0 and database.max_open_conns")
+	}
+	if c.Accrual.Address != "" {
+		u, err := url.Parse(c.Accrual.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("accrual.address %q must be an http(s) URL like http://localhost:8081", c.Accrual.Address)
+		}
+	}
+	positive := map[string]time.Duration{
+		"accrual.poll_interval":        c.Accrual.PollInterval,
+		"accrual.request_timeout":      c.Accrual.RequestTimeout,
+		"accrual.base_delay":           c.Accrual.BaseDelay,
+		"accrual.breaker.open_timeout": c.Accrual.Breaker.OpenTimeout,
+		"http.shutdown_timeout":        c.HTTP.ShutdownTimeout,
+		"loyalty.reservation_ttl":      c.Loyalty.ReservationTTL,
+		"loyalty.sweep_interval":       c.Loyalty.SweepInterval,
+		"loyalty.tier_window":          c.Loyalty.TierWindow,
+		"loyalty.tier_sweep_interval":  c.Loyalty.TierSweepInterval,
+	}
+	names := make([]string, 0, len(positive))
+	for name := range positive {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if positive[name] <= 0 {
+			add("%s must be positive", name)
+		}
+	}
+	if c.Accrual.MaxDelay < c.Accrual.BaseDelay {
+		add("accrual.max_delay must not be less than accrual.base_delay")
+	}
+	if c.Loyalty.PointsTTL < 0 {
+		add("loyalty.points_ttl must not be negative")
+	}
+	if !(0 < c.Loyalty.TierSilver && c.Loyalty.TierSilver < c.Loyalty.TierGold && c.Loyalty.TierGold < c.Loyalty.TierPlatinum) {
+		add("loyalty tier thresholds must be positive and grow from tier_silver to tier_platinum")
+	}
+	if c.Accrual.MaxAttempts < 1 {
+		add("accrual.max_attempts must be at least 1")
+	}
+	if c.Accrual.Breaker.FailureThreshold < 1 || c.Accrual.Breaker.SuccessThreshold < 1 {
+		add("accrual.breaker thresholds must be at least 1")
+	}
+	if len(c.Auth.CookieSecret) < 16 {
+		add("auth.cookie_secret must be at least 16 characters")
+	}
+	if c.TLS.CertFile != "" && c.TLS.KeyFile == "" || c.TLS.CertFile == "" && c.TLS.KeyFile != "" {
+		add("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.SelfSigned && c.TLS.CertFile != "" {
+		add("tls.self_signed cannot be combined with tls.cert_file")
+	}
+	if c.TLS.RedirectAddress != "" {
+		if !c.TLS.Enabled() {
+			add("tls.redirect_address requires TLS to be enabled")
+		}
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectAddress); err != nil {
+			add("tls.redirect_address %q must be host:port", c.TLS.RedirectAddress)
+		}
+	}
+	if c.TLS.HSTSMaxAge < 0 {
+		add("tls.hsts_max_age must not be negative")
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		add("log.level %q must be one of debug, info, warn, error", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		add("log.format %q must be json or text", c.Log.Format)
+	}
+	if e := c.Trace.Exporter; e != "none" && e != "stdout" && e != "otlp" && !strings.HasPrefix(e, "file:") {
+		add("trace.exporter %q must be none, stdout, otlp or file:<path>", e)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+// Masked возвращает копию конфигурации со скрытыми секретами
+func (c Config) Masked() Config {
+	for _, opt := range options {
+		if !opt.secret {
+			continue
+		}
+		p := opt.pointer(&c).(*string)
+		if *p == "" {
+			continue
+		}
+		if opt.env == "DATABASE_URI" {
+			*p = logging.RedactDSN(*p)
+		} else {
+			*p = masked
+		}
+	}
+	return c
+}
+
+// Print выводит действующую конфигурацию в YAML со скрытыми секретами
+func (c Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(c.Masked())
+	if err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+	return enc.Close()
+}
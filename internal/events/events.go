@@ -0,0 +1,197 @@
+// Package events реализует шину событий внутри процесса: хранилище публикует изменения статусов
+// заказов, балансов и статусов пользователей, а потоки событий пользователей (SSE) подписываются на них.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// типы событий
+const (
+	TypeOrder   = "order"
+	TypeBalance = "balance"
+	TypeTier    = "tier"
+)
+
+// размер буфера канала подписчика; подписчик, не успевающий читать события, отключается и
+// догоняет пропущенное по Last-Event-ID при переподключении
+const subscriberBuffer = 64
+
+type Order struct {
+	Number  string  `json:"number"`
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual,omitempty"`
+}
+
+type Balance struct {
+	Current   float64 `json:"current"`
+	Withdrawn float64 `json:"withdrawn"`
+	Reserved  float64 `json:"reserved"`
+}
+
+// Tier — смена статуса пользователя
+type Tier struct {
+	Tier     string `json:"tier"`
+	Previous string `json:"previous"`
+}
+
+// Event — событие пользователя; заполнено одно из полей Order, Balance и Tier. События передаются
+// между экземплярами сервиса в JSON без идентификатора: его присваивает шина получателя.
+type Event struct {
+	ID      uint64   `json:"-"`
+	Login   string   `json:"login"`
+	Type    string   `json:"type"`
+	Order   *Order   `json:"order,omitempty"`
+	Balance *Balance `json:"balance,omitempty"`
+	Tier    *Tier    `json:"tier,omitempty"`
+}
+
+type Subscription struct {
+	// Replay — события из истории, пропущенные с lastID
+	Replay []Event
+	// Missed сообщает, что история не покрывает всё пропущенное с lastID и клиенту нужно
+	// перечитать состояние целиком
+	Missed bool
+	// C закрывается при отключении медленного подписчика, вызове Close или закрытии шины
+	C <-chan Event
+
+	bus   *Bus
+	login string
+	ch    chan Event
+}
+
+// Close отменяет подписку
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.bus.unsubscribe(s)
+}
+
+// Bus рассылает события подписчикам того же пользователя и хранит последние события для
+// возобновления потока по Last-Event-ID. Экземпляры сервиса нумеруют события независимо, поэтому
+// старшие 32 бита идентификатора — случайная эпоха процесса, младшие — номер события в ней.
+// Идентификатор другой эпохи — от другого экземпляра или до перезапуска — в истории не ищется.
+type Bus struct {
+	mu      sync.Mutex
+	seq     uint64
+	first   uint64
+	history []Event
+	size    int
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// New создаёт шину, хранящую historySize последних событий
+func New(historySize int) *Bus {
+	seq := uint64(newEpoch()) << 32
+	return &Bus{
+		seq:   seq,
+		first: seq + 1,
+		size:  historySize,
+		subs:  make(map[*Subscription]struct{}),
+	}
+}
+
+// newEpoch возвращает случайную ненулевую эпоху процесса
+func newEpoch() uint32 {
+	var b [4]byte
+	for {
+		_, err := rand.Read(b[:])
+		if err != nil {
+			// без источника случайности эпоха берётся из времени запуска
+			return uint32(time.Now().UnixNano()) | 1
+		}
+		if e := binary.BigEndian.Uint32(b[:]); e != 0 {
+			return e
+		}
+	}
+}
+
+// epoch возвращает эпоху из идентификатора события
+func epoch(id uint64) uint32 {
+	return uint32(id >> 32)
+}
+
+// Publish присваивает событию идентификатор и рассылает его подписчикам пользователя
+func (b *Bus) Publish(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.ID = b.seq
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+		b.first = b.history[0].ID
+	}
+
+	for s := range b.subs {
+		if s.login != e.Login {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			b.unsubscribe(s)
+		}
+	}
+
+	return e
+}
+
+// Subscribe подписывает на события пользователя. Если lastID не равен нулю, в Replay попадают
+// события пользователя новее lastID из истории.
+func (b *Bus) Subscribe(login string, lastID uint64) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: ch, bus: b, login: login, ch: ch}
+
+	if lastID != 0 && epoch(lastID) != epoch(b.seq) {
+		// идентификатор выдан другим экземпляром или до перезапуска: его номер ничего не говорит
+		// об истории этого процесса
+		s.Missed = true
+	} else if lastID != 0 {
+		// события с lastID+1 по first-1 вытеснены из истории
+		s.Missed = lastID+1 < b.first || lastID > b.seq
+		for _, e := range b.history {
+			if e.ID > lastID && e.Login == login {
+				s.Replay = append(s.Replay, e)
+			}
+		}
+	}
+
+	if b.closed {
+		close(ch)
+		return s
+	}
+	b.subs[s] = struct{}{}
+
+	return s
+}
+
+// Close отключает всех подписчиков; вызывается при остановке сервера, чтобы потоки событий
+// не задерживали завершение
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		b.unsubscribe(s)
+	}
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.ch)
+}
@@ -0,0 +1,109 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestBus_PublishSubscribe(t *testing.T) {
+	b := New(10)
+
+	alice := b.Subscribe("alice", 0)
+	bob := b.Subscribe("bob", 0)
+	defer bob.Close()
+
+	e := b.Publish(Event{Login: "alice", Type: TypeOrder, Order: &Order{Number: "18", Status: "PROCESSED", Accrual: 10}})
+
+	select {
+	case got := <-alice.C:
+		if got.ID != e.ID || got.Order.Number != "18" {
+			t.Errorf("unexpected event %+v", got)
+		}
+	default:
+		t.Fatal("alice did not receive the event")
+	}
+
+	select {
+	case got := <-bob.C:
+		t.Errorf("bob received alice's event %+v", got)
+	default:
+	}
+
+	alice.Close()
+	if _, ok := <-alice.C; ok {
+		t.Error("expected channel to be closed")
+	}
+	alice.Close()
+}
+
+func TestBus_Replay(t *testing.T) {
+	b := New(3)
+
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, b.Publish(Event{Login: "alice", Type: TypeBalance, Balance: &Balance{Current: float64(i)}}).ID)
+	}
+	b.Publish(Event{Login: "bob", Type: TypeBalance, Balance: &Balance{}})
+
+	tests := []struct {
+		name       string
+		lastID     uint64
+		wantReplay int
+		wantMissed bool
+	}{
+		{name: "no last id", lastID: 0, wantReplay: 0},
+		{name: "up to date", lastID: ids[4], wantReplay: 0},
+		{name: "in history", lastID: ids[3], wantReplay: 1},
+		{name: "evicted", lastID: ids[0], wantReplay: 2, wantMissed: true},
+		{name: "unknown id", lastID: ids[4] + 100, wantReplay: 0, wantMissed: true},
+		// идентификатор другого экземпляра с тем же номером внутри эпохи
+		{name: "other replica", lastID: ids[3] ^ 1<<32, wantReplay: 0, wantMissed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := b.Subscribe("alice", tt.lastID)
+			defer s.Close()
+
+			if len(s.Replay) != tt.wantReplay || s.Missed != tt.wantMissed {
+				t.Errorf("expected replay %d, missed %v; got %d, %v", tt.wantReplay, tt.wantMissed, len(s.Replay), s.Missed)
+			}
+			for _, e := range s.Replay {
+				if e.Login != "alice" || e.ID <= tt.lastID {
+					t.Errorf("unexpected replayed event %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func TestBus_SlowSubscriber(t *testing.T) {
+	b := New(10)
+	s := b.Subscribe("alice", 0)
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(Event{Login: "alice", Type: TypeBalance, Balance: &Balance{}})
+	}
+
+	n := 0
+	for range s.C {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("expected %d buffered events before disconnect; got %d", subscriberBuffer, n)
+	}
+}
+
+func TestBus_Close(t *testing.T) {
+	b := New(10)
+	s := b.Subscribe("alice", 0)
+
+	b.Close()
+	if _, ok := <-s.C; ok {
+		t.Error("expected channel to be closed")
+	}
+
+	late := b.Subscribe("alice", 0)
+	if _, ok := <-late.C; ok {
+		t.Error("expected subscription to a closed bus to be closed")
+	}
+	late.Close()
+}
@@ -0,0 +1,4 @@
+// Package grpcapi содержит описание gRPC API (gophermart.proto) и сгенерированный по нему код.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gophermart.proto
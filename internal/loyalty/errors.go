@@ -0,0 +1,25 @@
+package loyalty
+
+import "errors"
+
+// Ошибки хранилища; Repository возвращает их, а Service передаёт вызывающему или заменяет
+// более точными ошибками ниже.
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrDuplicate         = errors.New("duplicate key")
+	ErrWrongCredentials  = errors.New("wrong credentials")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
+
+// Ошибки бизнес-правил. Service оборачивает их с подробностями, поэтому проверять их нужно
+// через errors.Is.
+var (
+	ErrLoginTaken           = errors.New("login is already in use")
+	ErrMalformedOrderNumber = errors.New("malformed order number")
+	ErrInvalidOrderNumber   = errors.New("order number fails the Luhn check")
+	ErrOrderConflict        = errors.New("order registered by another user")
+	ErrOrderWithdrawn       = errors.New("order already has a withdrawal or an active reservation")
+	ErrInvalidAmount        = errors.New("amount must be positive")
+	ErrRefundExceeded       = errors.New("refund exceeds the withdrawn sum")
+	ErrReservationClosed    = errors.New("reservation is no longer active")
+)
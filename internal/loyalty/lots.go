@@ -0,0 +1,86 @@
+package loyalty
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Lot — партия баллов: начисление за заказ или возврат списания. Списания расходуют партии в
+// порядке начисления (FIFO), остаток партии сгорает в ExpiresAt. Баллы, начисленные до появления
+// сроков, партий не имеют, не сгорают и расходуются последними.
+type Lot struct {
+	ID          string
+	OrderNumber string
+	Amount      float64
+	Remaining   float64
+	AccruedAt   time.Time
+	// ExpiresAt — момент сгорания остатка; нулевое значение — баллы не сгорают
+	ExpiresAt time.Time
+}
+
+// LotExpiresAt возвращает срок сгорания партии, начисленной в accruedAt, при сроке жизни баллов
+// ttl; ttl <= 0 — баллы не сгорают
+func LotExpiresAt(accruedAt time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return accruedAt.Add(ttl)
+}
+
+// ConsumeLots расходует sum с партий lots, упорядоченных по начислению, и возвращает списанное
+// с каждой партии. Суммы считаются с точностью до копейки; то, что не покрыли партии,
+// списывается с баллов без срока.
+func ConsumeLots(lots []Lot, sum float64) []float64 {
+	taken := make([]float64, len(lots))
+	rest := math.Round(sum * 100)
+	for i, l := range lots {
+		if rest <= 0 {
+			break
+		}
+		take := math.Min(math.Round(l.Remaining*100), rest)
+		if take <= 0 {
+			continue
+		}
+		taken[i] = take / 100
+		rest -= take
+	}
+	return taken
+}
+
+// ExpireAmount возвращает, сколько баллов сгорает из остатка remaining при балансе b: сгорание
+// не трогает зарезервированные баллы, остаток партии сгорает после снятия или списания резерва
+func ExpireAmount(b Balance, remaining float64) float64 {
+	return math.Max(0, math.Min(remaining, math.Round(b.Available()*100)/100))
+}
+
+// Expiration — сгоревший остаток партии
+type Expiration struct {
+	ID          string
+	LotID       string
+	OrderNumber string
+	Sum         float64
+	ExpiredAt   time.Time
+}
+
+// ExpiringPoints возвращает партии пользователя со сроком сгорания в порядке сгорания
+func (s *Service) ExpiringPoints(ctx context.Context, login string) ([]Lot, error) {
+	lots, err := s.repo.ExpiringLots(ctx, login)
+	if err != nil {
+		return nil, fmt.Errorf("expiring lots: %w", err)
+	}
+
+	return lots, nil
+}
+
+// ExpirePoints списывает с балансов всех пользователей остатки партий, срок которых наступил,
+// и возвращает число записей о сгорании
+func (s *Service) ExpirePoints(ctx context.Context) (int, error) {
+	n, err := s.repo.ExpireLots(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("expire lots: %w", err)
+	}
+
+	return n, nil
+}
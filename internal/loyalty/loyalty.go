@@ -0,0 +1,440 @@
+// Package loyalty содержит бизнес-правила накопительной системы лояльности независимо от
+// транспорта: регистрацию и вход пользователей, загрузку заказов, баланс, списания, сгорание баллов
+// и статусы пользователей.
+// Обработчики HTTP и gRPC только разбирают запросы и переводят ошибки Service в ответы.
+package loyalty
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// статусы заказа
+const (
+	StatusNew        = "NEW"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+	// StatusDead — заказ исчерпал попытки расчёта и ждёт администратора; пользователю
+	// показывается как StatusProcessing
+	StatusDead = "DEAD"
+)
+
+// Ownership — принадлежность номера заказа относительно пользователя
+type Ownership int
+
+const (
+	// OwnershipNone — номер ещё не зарегистрирован
+	OwnershipNone Ownership = 0
+	// OwnershipUser — номер загружен этим пользователем
+	OwnershipUser Ownership = 1
+	// OwnershipOther — номер загружен другим пользователем
+	OwnershipOther Ownership = -1
+)
+
+type Order struct {
+	ID         string
+	Number     string
+	Status     string
+	Accrual    float64
+	UploadedAt time.Time
+	// ProcessedAt — время начисления; нулевое, пока заказ не обработан
+	ProcessedAt time.Time
+}
+
+// Balance — баллы пользователя. Current — все баллы на счёте, включая зарезервированные
+// Reserved; списать можно только Available.
+type Balance struct {
+	Current   float64
+	Withdrawn float64
+	Reserved  float64
+}
+
+func (b Balance) Available() float64 {
+	return b.Current - b.Reserved
+}
+
+type Withdrawal struct {
+	ID          string
+	OrderNumber string
+	Sum         float64
+	ProcessedAt time.Time
+	// Refunds — возвраты по списанию в порядке проведения
+	Refunds []Refund
+}
+
+// Refunded возвращает сумму, уже возвращённую по списанию
+func (w Withdrawal) Refunded() float64 {
+	var sum float64
+	for _, r := range w.Refunds {
+		sum += r.Sum
+	}
+	return sum
+}
+
+// RefundSum возвращает сумму возврата sum по списанию w: sum == 0 — весь невозвращённый остаток.
+// Суммы сравниваются с точностью до копейки; ErrRefundExceeded, если возвращать больше нечего
+// или sum больше остатка. Реализации Repository проверяют возврат этой функцией.
+func RefundSum(w Withdrawal, sum float64) (float64, error) {
+	remaining := math.Round((w.Sum-w.Refunded())*100) / 100
+	if sum == 0 {
+		sum = remaining
+	}
+	if remaining <= 0 || math.Round(sum*100) > math.Round(remaining*100) {
+		return 0, fmt.Errorf("%w: %v of %v remaining", ErrRefundExceeded, sum, remaining)
+	}
+	return sum, nil
+}
+
+// источники возврата
+const (
+	RefundByAdmin = "admin"
+	RefundByShop  = "shop"
+)
+
+// Refund — возврат баллов по списанию, например при отмене заказа в магазине
+type Refund struct {
+	ID           string
+	WithdrawalID string
+	Sum          float64
+	Source       string
+	// ExternalID — идентификатор возврата в магазине; пустой для возвратов администратора
+	ExternalID  string
+	ProcessedAt time.Time
+}
+
+// Repository хранит пользователей, заказы, балансы и списания
+type Repository interface {
+	// UserRegister создаёт пользователя с нулевым балансом; ErrDuplicate, если логин занят
+	UserRegister(ctx context.Context, login, password string) error
+	// UserLogin возвращает ErrWrongCredentials, если пары логин/пароль нет
+	UserLogin(ctx context.Context, login, password string) error
+	OrderRegistered(ctx context.Context, login, number string) (Ownership, error)
+	// OrderRegister возвращает ErrDuplicate, если номер уже зарегистрирован
+	OrderRegister(ctx context.Context, login, number string) error
+	// OrdersRegisterBatch регистрирует номера в одной транзакции и для каждого номера
+	// возвращает принадлежность до регистрации: OwnershipNone — номер зарегистрирован сейчас
+	OrdersRegisterBatch(ctx context.Context, login string, numbers []string) (map[string]Ownership, error)
+	Orders(ctx context.Context, login string) ([]Order, error)
+	// Order возвращает ErrNotFound, если у пользователя нет заказа с таким номером
+	Order(ctx context.Context, login, number string) (Order, error)
+	UserBalance(ctx context.Context, login string) (Balance, error)
+	// Withdraw списывает sum с баланса; ErrInsufficientFunds, если не хватает доступных баллов,
+	// ErrOrderWithdrawn, если у заказа уже есть списание или активный резерв
+	Withdraw(ctx context.Context, login, number string, sum float64) error
+	// Withdrawals возвращает списания пользователя вместе с возвратами по ним
+	Withdrawals(ctx context.Context, login string) ([]Withdrawal, error)
+	// WithdrawalByOrder возвращает списание в счёт заказа; ErrNotFound, если его нет
+	WithdrawalByOrder(ctx context.Context, number string) (Withdrawal, error)
+	// Refund проводит возврат r по списанию r.WithdrawalID и начисляет баллы обратно; r.Sum == 0 —
+	// возврат всего невозвращённого остатка. ErrNotFound — списания нет, ErrRefundExceeded —
+	// сумма больше остатка. Если возврат с r.ExternalID по этому списанию уже проведён, возвращает
+	// его и ErrDuplicate.
+	Refund(ctx context.Context, r Refund) (Refund, error)
+	// Reserve резервирует sum доступных баллов до expiresAt; ошибки те же, что у Withdraw
+	Reserve(ctx context.Context, login, number string, sum float64, expiresAt time.Time) (Reservation, error)
+	// CaptureReservation списывает зарезервированные баллы и возвращает списание;
+	// ErrNotFound — у пользователя нет резерва, ErrReservationClosed — резерв не активен или истёк
+	CaptureReservation(ctx context.Context, login, id string) (Withdrawal, error)
+	// ReleaseReservation снимает резерв; ошибки те же, что у CaptureReservation
+	ReleaseReservation(ctx context.Context, login, id string) (Reservation, error)
+	// ExpireReservations снимает истёкшие активные резервы и возвращает их количество
+	ExpireReservations(ctx context.Context) (int, error)
+	// ExpiringLots возвращает партии пользователя с ненулевым остатком и сроком сгорания,
+	// упорядоченные по сроку
+	ExpiringLots(ctx context.Context, login string) ([]Lot, error)
+	// ExpireLots списывает остатки партий с наступившим сроком, не трогая зарезервированные
+	// баллы, записывает сгорание и возвращает число записей
+	ExpireLots(ctx context.Context) (int, error)
+	// AccruedSince возвращает сумму начислений пользователя за заказы, обработанные начиная с since
+	AccruedSince(ctx context.Context, login string, since time.Time) (float64, error)
+	// UserTier возвращает статус пользователя; TierBase, если статус не присваивался
+	UserTier(ctx context.Context, login string) (string, error)
+	// SetTier переводит пользователя из change.Previous в change.Tier и записывает смену в историю;
+	// changed == false, если статус пользователя уже не change.Previous
+	SetTier(ctx context.Context, login string, change TierChange) (result TierChange, changed bool, err error)
+	// TieredUsers возвращает пользователей со статусом выше базового
+	TieredUsers(ctx context.Context) ([]string, error)
+	// UntieredUsers возвращает пользователей с базовым статусом, у которых начисления с since
+	// не меньше threshold
+	UntieredUsers(ctx context.Context, since time.Time, threshold float64) ([]string, error)
+	TierHistory(ctx context.Context, login string) ([]TierChange, error)
+}
+
+// номера пакетной загрузки регистрируются транзакциями по batchChunkSize штук, чтобы не держать
+// долгих блокировок
+const batchChunkSize = 100
+
+// DefaultReservationTTL — время жизни резерва, если Config.ReservationTTL не задан
+const DefaultReservationTTL = 15 * time.Minute
+
+type Config struct {
+	// ReservationTTL — время, через которое неподтверждённый резерв снимается
+	ReservationTTL time.Duration
+	// Tiers — пороги статусов; нулевое значение — DefaultTiers
+	Tiers Tiers
+}
+
+type Service struct {
+	repo Repository
+	cfg  Config
+	now  func() time.Time
+}
+
+func New(repo Repository, cfg Config) *Service {
+	if cfg.ReservationTTL <= 0 {
+		cfg.ReservationTTL = DefaultReservationTTL
+	}
+	if cfg.Tiers == (Tiers{}) {
+		cfg.Tiers = DefaultTiers
+	}
+	return &Service{repo: repo, cfg: cfg, now: time.Now}
+}
+
+func hashPassword(password string) string {
+	h := md5.Sum([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+// Register регистрирует пользователя; ErrLoginTaken, если логин занят
+func (s *Service) Register(ctx context.Context, login, password string) error {
+	err := s.repo.UserRegister(ctx, login, hashPassword(password))
+	if errors.Is(err, ErrDuplicate) {
+		return fmt.Errorf("%w: %s", ErrLoginTaken, login)
+	} else if err != nil {
+		return fmt.Errorf("register user: %w", err)
+	}
+
+	return nil
+}
+
+// Login проверяет пару логин/пароль; ErrWrongCredentials, если она неверна
+func (s *Service) Login(ctx context.Context, login, password string) error {
+	err := s.repo.UserLogin(ctx, login, hashPassword(password))
+	if err != nil {
+		return fmt.Errorf("login user: %w", err)
+	}
+
+	return nil
+}
+
+// SubmitOrder проверяет номер заказа и закрепляет его за пользователем. created сообщает, что
+// номер загружен впервые; повторная загрузка своего номера не считается ошибкой.
+func (s *Service) SubmitOrder(ctx context.Context, login, raw string) (order Order, created bool, err error) {
+	number, err := ParseOrderNumber(raw)
+	if err != nil {
+		return Order{}, false, err
+	}
+
+	created, err = s.registerOrder(ctx, login, number)
+	if err != nil {
+		return Order{}, false, err
+	}
+
+	order, err = s.repo.Order(ctx, login, number)
+	if err != nil {
+		return Order{}, false, fmt.Errorf("read order: %w", err)
+	}
+
+	return userOrder(order), created, nil
+}
+
+func (s *Service) registerOrder(ctx context.Context, login, number string) (bool, error) {
+	owner, err := s.repo.OrderRegistered(ctx, login, number)
+	if err != nil {
+		return false, fmt.Errorf("check order: %w", err)
+	}
+
+	if owner == OwnershipNone {
+		err = s.repo.OrderRegister(ctx, login, number)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, ErrDuplicate) {
+			return false, fmt.Errorf("register order: %w", err)
+		}
+
+		// номер зарегистрировали одновременно с нами
+		owner, err = s.repo.OrderRegistered(ctx, login, number)
+		if err != nil {
+			return false, fmt.Errorf("check order: %w", err)
+		}
+	}
+
+	if owner == OwnershipOther {
+		return false, fmt.Errorf("%w: %s", ErrOrderConflict, number)
+	}
+	return false, nil
+}
+
+// SubmitResult — результат загрузки номера в SubmitOrders
+type SubmitResult struct {
+	// Number — нормализованный номер или исходная строка, если номер не разобран
+	Number string
+	// Ownership — принадлежность номера до загрузки: OwnershipNone, если номер принят
+	Ownership Ownership
+	// Err — ErrMalformedOrderNumber или ErrInvalidOrderNumber; номер не загружен
+	Err error
+}
+
+// SubmitOrders загружает номера заказов пакетом. Результаты возвращаются в порядке numbers;
+// повтор номера в пакете считается уже загруженным этим пользователем.
+func (s *Service) SubmitOrders(ctx context.Context, login string, numbers []string) ([]SubmitResult, error) {
+	results := make([]SubmitResult, len(numbers))
+	// позиции в results для каждого корректного номера; повторы регистрируются один раз
+	positions := make(map[string][]int)
+	var valid []string
+
+	for i, raw := range numbers {
+		number, err := ParseOrderNumber(raw)
+		if err != nil {
+			results[i] = SubmitResult{Number: raw, Err: err}
+			continue
+		}
+
+		results[i].Number = number
+		if _, ok := positions[number]; !ok {
+			valid = append(valid, number)
+		}
+		positions[number] = append(positions[number], i)
+	}
+
+	for start := 0; start < len(valid); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+
+		registered, err := s.repo.OrdersRegisterBatch(ctx, login, valid[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("register orders batch: %w", err)
+		}
+
+		for _, number := range valid[start:end] {
+			owner, ok := registered[number]
+			if !ok {
+				return nil, fmt.Errorf("register orders batch: no result for order %s", number)
+			}
+
+			for k, i := range positions[number] {
+				results[i].Ownership = owner
+				if k > 0 && owner == OwnershipNone {
+					// номер уже принят первым вхождением
+					results[i].Ownership = OwnershipUser
+				}
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// userOrder — заказ в том виде, в каком его видит пользователь
+func userOrder(o Order) Order {
+	if o.Status == StatusDead {
+		// для пользователя заказ остаётся в обработке, пока администратор не вернёт его в очередь
+		o.Status = StatusProcessing
+	}
+	return o
+}
+
+func (s *Service) Orders(ctx context.Context, login string) ([]Order, error) {
+	orders, err := s.repo.Orders(ctx, login)
+	if err != nil {
+		return nil, fmt.Errorf("list orders: %w", err)
+	}
+
+	result := make([]Order, 0, len(orders))
+	for _, o := range orders {
+		result = append(result, userOrder(o))
+	}
+
+	return result, nil
+}
+
+func (s *Service) Balance(ctx context.Context, login string) (Balance, error) {
+	balance, err := s.repo.UserBalance(ctx, login)
+	if err != nil {
+		return Balance{}, fmt.Errorf("user balance: %w", err)
+	}
+
+	return balance, nil
+}
+
+// Withdraw списывает sum баллов в счёт заказа; ErrInvalidAmount, ErrMalformedOrderNumber,
+// ErrInvalidOrderNumber, ErrInsufficientFunds или ErrOrderWithdrawn. В счёт заказа проводится одно
+// списание, поэтому возврат магазина по номеру заказа находит списание однозначно.
+func (s *Service) Withdraw(ctx context.Context, login, raw string, sum float64) error {
+	if !(sum > 0) {
+		return fmt.Errorf("%w: %v", ErrInvalidAmount, sum)
+	}
+
+	number, err := ParseOrderNumber(raw)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.Withdraw(ctx, login, number, sum)
+	if err != nil {
+		return fmt.Errorf("withdraw: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) Withdrawals(ctx context.Context, login string) ([]Withdrawal, error) {
+	withdrawals, err := s.repo.Withdrawals(ctx, login)
+	if err != nil {
+		return nil, fmt.Errorf("list withdrawals: %w", err)
+	}
+
+	return withdrawals, nil
+}
+
+// Refund возвращает баллы по списанию withdrawalID по решению администратора; sum == 0 —
+// весь невозвращённый остаток. ErrInvalidAmount, ErrNotFound или ErrRefundExceeded
+func (s *Service) Refund(ctx context.Context, withdrawalID string, sum float64) (Refund, error) {
+	if !(sum >= 0) {
+		return Refund{}, fmt.Errorf("%w: %v", ErrInvalidAmount, sum)
+	}
+
+	refund, err := s.repo.Refund(ctx, Refund{WithdrawalID: withdrawalID, Sum: sum, Source: RefundByAdmin})
+	if err != nil {
+		return Refund{}, fmt.Errorf("refund: %w", err)
+	}
+
+	return refund, nil
+}
+
+// RefundOrder возвращает баллы по последнему списанию в счёт заказа raw по обратному вызову
+// магазина. Повторный вызов с тем же externalID возвращает проведённый возврат и баллы
+// повторно не начисляет.
+func (s *Service) RefundOrder(ctx context.Context, raw string, sum float64, externalID string) (Refund, error) {
+	if !(sum >= 0) {
+		return Refund{}, fmt.Errorf("%w: %v", ErrInvalidAmount, sum)
+	}
+
+	number, err := ParseOrderNumber(raw)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	withdrawal, err := s.repo.WithdrawalByOrder(ctx, number)
+	if err != nil {
+		return Refund{}, fmt.Errorf("find withdrawal: %w", err)
+	}
+
+	refund, err := s.repo.Refund(ctx, Refund{WithdrawalID: withdrawal.ID, Sum: sum, Source: RefundByShop, ExternalID: externalID})
+	if errors.Is(err, ErrDuplicate) {
+		return refund, nil
+	} else if err != nil {
+		return Refund{}, fmt.Errorf("refund: %w", err)
+	}
+
+	return refund, nil
+}
@@ -0,0 +1,897 @@
+package loyalty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T, logins ...string) (*Service, *Memory) {
+	t.Helper()
+
+	repo := NewMemory()
+	s := New(repo, Config{})
+	for _, login := range logins {
+		err := s.Register(context.Background(), login, "password")
+		if err != nil {
+			t.Fatalf("could not register %s: %v", login, err)
+		}
+	}
+	return s, repo
+}
+
+func TestService_RegisterLogin(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t, "user")
+
+	err := s.Register(ctx, "user", "other")
+	if !errors.Is(err, ErrLoginTaken) {
+		t.Errorf("expected ErrLoginTaken; got %v", err)
+	}
+
+	err = s.Login(ctx, "user", "wrong")
+	if !errors.Is(err, ErrWrongCredentials) {
+		t.Errorf("expected ErrWrongCredentials; got %v", err)
+	}
+
+	err = s.Login(ctx, "user", "password")
+	if err != nil {
+		t.Errorf("expected login to succeed; got %v", err)
+	}
+}
+
+func TestService_SubmitOrder(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t, "user", "other")
+
+	tests := []struct {
+		name        string
+		login       string
+		number      string
+		wantNumber  string
+		wantCreated bool
+		wantErr     error
+	}{
+		{name: "malformed", login: "user", number: "12a", wantErr: ErrMalformedOrderNumber},
+		{name: "luhn", login: "user", number: "12345678901", wantErr: ErrInvalidOrderNumber},
+		{name: "new", login: "user", number: "1234-5678-903", wantNumber: "12345678903", wantCreated: true},
+		{name: "again", login: "user", number: "12345678903", wantNumber: "12345678903"},
+		{name: "other user", login: "other", number: "12345678903", wantErr: ErrOrderConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, created, err := s.SubmitOrder(ctx, tt.login, tt.number)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v; got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if order.Number != tt.wantNumber || created != tt.wantCreated || order.Status != StatusNew {
+				t.Errorf("expected %s created=%v; got %+v created=%v", tt.wantNumber, tt.wantCreated, order, created)
+			}
+		})
+	}
+}
+
+func TestService_SubmitOrders(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t, "user", "other")
+
+	_, _, err := s.SubmitOrder(ctx, "other", "2377225624")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = s.SubmitOrder(ctx, "user", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.SubmitOrders(ctx, "user", []string{"12345678903", "2377225624", "18", "123", "1234 5678 903", "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		number    string
+		ownership Ownership
+		err       error
+	}{
+		{number: "12345678903", ownership: OwnershipNone},
+		{number: "2377225624", ownership: OwnershipOther},
+		{number: "18", ownership: OwnershipUser},
+		{number: "123", err: ErrInvalidOrderNumber},
+		{number: "12345678903", ownership: OwnershipUser},
+		{number: "x", err: ErrMalformedOrderNumber},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results; got %d", len(want), len(results))
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Number != w.number || !errors.Is(r.Err, w.err) || (w.err == nil && r.Ownership != w.ownership) {
+			t.Errorf("result %d: expected %+v; got %+v", i, w, r)
+		}
+	}
+
+	orders, err := s.Orders(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 {
+		t.Errorf("expected 2 orders; got %+v", orders)
+	}
+}
+
+func TestService_Orders(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user")
+
+	_, _, err := s.SubmitOrder(ctx, "user", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", StatusDead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := s.Orders(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 || orders[0].Status != StatusProcessing {
+		t.Errorf("expected dead order to be shown as processing; got %+v", orders)
+	}
+}
+
+func TestService_Withdraw(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user")
+
+	_, _, err := s.SubmitOrder(ctx, "user", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", StatusProcessed, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		order   string
+		sum     float64
+		wantErr error
+	}{
+		{name: "zero sum", order: "2377225624", sum: 0, wantErr: ErrInvalidAmount},
+		{name: "negative sum", order: "2377225624", sum: -10, wantErr: ErrInvalidAmount},
+		{name: "luhn", order: "2377225625", sum: 10, wantErr: ErrInvalidOrderNumber},
+		{name: "insufficient funds", order: "2377225624", sum: 500.01, wantErr: ErrInsufficientFunds},
+		{name: "ok", order: "2377225624", sum: 120.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.Withdraw(ctx, "user", tt.order, tt.sum)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v; got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	balance, err := s.Balance(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != (Balance{Current: 379.5, Withdrawn: 120.5}) {
+		t.Errorf("unexpected balance %+v", balance)
+	}
+
+	withdrawals, err := s.Withdrawals(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withdrawals) != 1 || withdrawals[0].OrderNumber != "2377225624" || withdrawals[0].Sum != 120.5 {
+		t.Errorf("unexpected withdrawals %+v", withdrawals)
+	}
+}
+
+func TestService_RefundOrderSameExternalID(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user")
+
+	_, _, err := s.SubmitOrder(ctx, "user", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", StatusProcessed, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []string{"2377225624", "79927398713"} {
+		err = s.Withdraw(ctx, "user", number, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// магазин переиспользует идентификатор возврата для другого заказа
+	first, err := s.RefundOrder(ctx, "2377225624", 10, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.RefundOrder(ctx, "79927398713", 20, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID == first.ID || second.Sum != 20 {
+		t.Errorf("expected a new refund of 20; got %+v", second)
+	}
+
+	balance, err := s.Balance(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != (Balance{Current: 330, Withdrawn: 170}) {
+		t.Errorf("unexpected balance %+v", balance)
+	}
+}
+
+func TestService_Refund(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user")
+
+	_, _, err := s.SubmitOrder(ctx, "user", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", StatusProcessed, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Withdraw(ctx, "user", "2377225624", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withdrawals, err := s.Withdrawals(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := withdrawals[0].ID
+
+	tests := []struct {
+		name    string
+		refund  func() (Refund, error)
+		want    float64
+		wantErr error
+	}{
+		{
+			name:    "negative sum",
+			refund:  func() (Refund, error) { return s.Refund(ctx, id, -1) },
+			wantErr: ErrInvalidAmount,
+		},
+		{
+			name:    "unknown withdrawal",
+			refund:  func() (Refund, error) { return s.Refund(ctx, "missing", 10) },
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "unknown order",
+			refund:  func() (Refund, error) { return s.RefundOrder(ctx, "79927398713", 10, "r1") },
+			wantErr: ErrNotFound,
+		},
+		{
+			name:    "more than withdrawn",
+			refund:  func() (Refund, error) { return s.Refund(ctx, id, 100.01) },
+			wantErr: ErrRefundExceeded,
+		},
+		{
+			name:   "partial by shop",
+			refund: func() (Refund, error) { return s.RefundOrder(ctx, "2377225624", 30.1, "r1") },
+			want:   30.1,
+		},
+		{
+			name:   "shop retry",
+			refund: func() (Refund, error) { return s.RefundOrder(ctx, "2377225624", 30.1, "r1") },
+			want:   30.1,
+		},
+		{
+			name:    "more than remaining",
+			refund:  func() (Refund, error) { return s.Refund(ctx, id, 70) },
+			wantErr: ErrRefundExceeded,
+		},
+		{
+			name:   "rest by admin",
+			refund: func() (Refund, error) { return s.Refund(ctx, id, 0) },
+			want:   69.9,
+		},
+		{
+			name:    "nothing left",
+			refund:  func() (Refund, error) { return s.Refund(ctx, id, 0) },
+			wantErr: ErrRefundExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refund, err := tt.refund()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v; got %v", tt.wantErr, err)
+			}
+			if err == nil && (refund.Sum != tt.want || refund.WithdrawalID != id) {
+				t.Errorf("expected refund of %v for %s; got %+v", tt.want, id, refund)
+			}
+		})
+	}
+
+	balance, err := s.Balance(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != (Balance{Current: 500, Withdrawn: 0}) {
+		t.Errorf("unexpected balance %+v", balance)
+	}
+
+	withdrawals, err = s.Withdrawals(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunds := withdrawals[0].Refunds; len(refunds) != 2 || refunds[0].Source != RefundByShop || refunds[1].Source != RefundByAdmin {
+		t.Errorf("unexpected refunds %+v", refunds)
+	}
+}
+
+func TestService_Reservation(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user", "other")
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s.now, repo.now = clock, clock
+
+	_, _, err := s.SubmitOrder(ctx, "user", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", StatusProcessed, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBalance := func(want Balance) {
+		t.Helper()
+		balance, err := s.Balance(ctx, "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != want {
+			t.Errorf("expected balance %+v; got %+v", want, balance)
+		}
+	}
+
+	captured, err := s.Reserve(ctx, "user", "2377225624", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captured.Status != ReservationActive || !captured.ExpiresAt.Equal(now.Add(DefaultReservationTTL)) {
+		t.Errorf("unexpected reservation %+v", captured)
+	}
+	wantBalance(Balance{Current: 100, Reserved: 60})
+
+	_, err = s.Reserve(ctx, "user", "79927398713", 50)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("expected ErrInsufficientFunds for more than available; got %v", err)
+	}
+	err = s.Withdraw(ctx, "user", "79927398713", 50)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("expected withdraw not to spend reserved points; got %v", err)
+	}
+
+	released, err := s.Reserve(ctx, "user", "79927398713", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.Reserve(ctx, "user", "12345678903", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBalance(Balance{Current: 100, Reserved: 90})
+
+	_, err = s.Capture(ctx, "other", captured.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for reservation of another user; got %v", err)
+	}
+
+	withdrawal, err := s.Capture(ctx, "user", captured.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withdrawal.OrderNumber != "2377225624" || withdrawal.Sum != 60 {
+		t.Errorf("unexpected withdrawal %+v", withdrawal)
+	}
+	_, err = s.Release(ctx, "user", captured.ID)
+	if !errors.Is(err, ErrReservationClosed) {
+		t.Errorf("expected captured reservation to be closed; got %v", err)
+	}
+
+	_, err = s.Release(ctx, "user", released.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBalance(Balance{Current: 40, Withdrawn: 60, Reserved: 20})
+
+	now = now.Add(DefaultReservationTTL)
+	_, err = s.Capture(ctx, "user", expired.ID)
+	if !errors.Is(err, ErrReservationClosed) {
+		t.Errorf("expected expired reservation to be closed; got %v", err)
+	}
+	n, err := s.ExpireReservations(ctx)
+	if err != nil || n != 1 {
+		t.Errorf("expected one reservation to expire; got %d, %v", n, err)
+	}
+	wantBalance(Balance{Current: 40, Withdrawn: 60})
+}
+
+func TestValidateLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{number: "125764357", want: true},
+		{number: "5347754565", want: true},
+		{number: "87643", want: true},
+		{number: "45678976", want: true},
+		{number: "6432964973280", want: false},
+		{number: "1791238908321", want: false},
+		{number: "0", want: true},
+		{number: "00087643", want: true},
+		{number: "79927398713799273987137992739873", want: true},
+		{number: "79927398713799273987137992739871", want: false},
+	}
+	for _, tt := range tests {
+		if got := ValidateLuhn(tt.number); got != tt.want {
+			t.Errorf("ValidateLuhn(%v) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func Test_checksumLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		want   int
+	}{
+		{number: "6478234230", want: 7},
+		{number: "8907654355", want: 5},
+		{number: "1209374734", want: 2},
+		{number: "7453126346", want: 0},
+		{number: "9740174550", want: 4},
+		{number: "", want: 0},
+	}
+	for _, tt := range tests {
+		if got := checksumLuhn(tt.number); got != tt.want {
+			t.Errorf("checksumLuhn(%v) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeOrderNumber(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "12345678903", want: "12345678903"},
+		{raw: " 12345678903\n", want: "12345678903"},
+		{raw: "1234 5678-903", want: "12345678903"},
+		{raw: "0012345678903", want: "0012345678903"},
+		{raw: "123456789012345678901234567890", want: "123456789012345678901234567890"},
+		{raw: "", wantErr: true},
+		{raw: " - ", wantErr: true},
+		{raw: "12a", wantErr: true},
+		{raw: "+123", wantErr: true},
+		{raw: "١٢٣", wantErr: true},
+		{raw: strings.Repeat("1", MaxOrderNumberLen+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeOrderNumber(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NormalizeOrderNumber(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeOrderNumber(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+// luhnReference — прямолинейная реализация алгоритма Луна: цифры обходятся справа налево,
+// каждая вторая удваивается, из удвоенных больших 9 вычитается 9
+func luhnReference(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func FuzzValidateLuhn(f *testing.F) {
+	for _, seed := range []string{"0", "18", "125764357", "6432964973280", "79927398713799273987137992739873", "00087643"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		number, err := NormalizeOrderNumber(raw)
+		if err != nil {
+			return
+		}
+
+		again, err := NormalizeOrderNumber(number)
+		if err != nil || again != number {
+			t.Fatalf("normalization is not idempotent: %q -> %q -> %q, %v", raw, number, again, err)
+		}
+
+		got := ValidateLuhn(number)
+		if want := luhnReference(number); got != want {
+			t.Fatalf("ValidateLuhn(%q) = %v, reference %v", number, got, want)
+		}
+		if withZeros := ValidateLuhn("000" + number); withZeros != got {
+			t.Fatalf("leading zeros changed the result for %q", number)
+		}
+	})
+}
+
+func FuzzValidateLuhnUint(f *testing.F) {
+	for _, seed := range []uint64{0, 18, 125764357, 6432964973280, 18446744073709551615} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, n uint64) {
+		number := strconv.FormatUint(n, 10)
+		if got, want := ValidateLuhn(number), luhnReference(number); got != want {
+			t.Fatalf("ValidateLuhn(%q) = %v, reference %v", number, got, want)
+		}
+	})
+}
+
+func TestService_PointsExpiry(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user")
+	repo.PointsTTL = 365 * 24 * time.Hour
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s.now, repo.now = clock, clock
+
+	accrue := func(number string, sum float64) {
+		t.Helper()
+		_, _, err := s.SubmitOrder(ctx, "user", number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.SetOrderStatus(ctx, number, StatusProcessed, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantLots := func(want ...float64) {
+		t.Helper()
+		lots, err := s.ExpiringPoints(ctx, "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []float64
+		for _, l := range lots {
+			got = append(got, l.Remaining)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("expected expiring lots %v; got %v", want, got)
+		}
+	}
+
+	accrue("18", 100)
+	now = now.AddDate(0, 6, 0)
+	accrue("26", 50)
+
+	// списание расходует сначала более раннее начисление
+	err := s.Withdraw(ctx, "user", "2377225624", 70.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLots(29.5, 50)
+
+	lots, err := s.ExpiringPoints(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC); !lots[0].ExpiresAt.Equal(want) {
+		t.Errorf("expected first lot to expire at %v; got %v", want, lots[0].ExpiresAt)
+	}
+
+	n, err := s.ExpirePoints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected nothing to expire yet; got %v", n)
+	}
+
+	// зарезервированные баллы не сгорают, пока резерв активен
+	reservation, err := s.Reserve(ctx, "user", "79927398713", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	n, err = s.ExpirePoints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected one expiry entry; got %v", n)
+	}
+	wantLots(10, 50)
+	balance, err := s.Balance(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Balance{Current: 60, Withdrawn: 70.5, Reserved: 60}); balance != want {
+		t.Errorf("expected balance %+v; got %+v", want, balance)
+	}
+
+	_, err = s.Release(ctx, "user", reservation.ID)
+	if !errors.Is(err, ErrReservationClosed) {
+		t.Fatalf("expected reservation to expire; got %v", err)
+	}
+	_, err = s.ExpireReservations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ExpirePoints(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLots(50)
+
+	expirations := repo.Expirations("user")
+	if len(expirations) != 2 || expirations[0].Sum != 19.5 || expirations[1].Sum != 10 || expirations[0].OrderNumber != "18" {
+		t.Errorf("unexpected expirations %+v", expirations)
+	}
+	balance, err = s.Balance(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Balance{Current: 50, Withdrawn: 70.5}); balance != want {
+		t.Errorf("expected balance %+v; got %+v", want, balance)
+	}
+}
+
+func TestConsumeLots(t *testing.T) {
+	lots := []Lot{{Remaining: 10}, {Remaining: 0}, {Remaining: 20.25}, {Remaining: 5}}
+
+	got := ConsumeLots(lots, 25.3)
+	if want := []float64{10, 0, 15.3, 0}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+
+	// баллы сверх партий списываются с баллов без срока
+	got = ConsumeLots(lots, 100)
+	if want := []float64{10, 0, 20.25, 5}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+}
+
+func TestService_Tier(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemory()
+	s := New(repo, Config{Tiers: Tiers{Silver: 100, Gold: 500, Platinum: 1000, Window: 365 * 24 * time.Hour}})
+	err := s.Register(ctx, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s.now, repo.now = clock, clock
+
+	accrue := func(number string, sum float64) {
+		t.Helper()
+		_, _, err := s.SubmitOrder(ctx, "user", number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.SetOrderStatus(ctx, number, StatusProcessed, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recompute := func(want string, wantChanged bool) {
+		t.Helper()
+		change, changed, err := s.RecomputeTier(ctx, "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != wantChanged || (changed && change.Tier != want) {
+			t.Errorf("expected tier %s changed=%v; got %+v changed=%v", want, wantChanged, change, changed)
+		}
+	}
+
+	accrue("18", 99.99)
+	recompute(TierBase, false)
+
+	status, err := s.Tier(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Tier != TierBase || status.Accrued != 99.99 || status.Next != TierSilver || status.NextThreshold != 100 {
+		t.Errorf("unexpected tier status %+v", status)
+	}
+
+	now = now.AddDate(0, 6, 0)
+	accrue("26", 500)
+	recompute(TierGold, true)
+	recompute(TierGold, false)
+
+	// начисление за первый заказ выходит из окна
+	now = now.AddDate(0, 6, 1)
+	n, err := s.RecomputeTiers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected gold to hold on 500 accrued; got %v downgrades", n)
+	}
+
+	now = now.AddDate(0, 6, 0)
+	n, err = s.RecomputeTiers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected one downgrade; got %v", n)
+	}
+
+	history, err := s.TierHistory(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected two tier changes; got %+v", history)
+	}
+	if c := history[0]; c.Tier != TierGold || c.Previous != TierBase || c.Direction() != TierUpgrade || c.Accrued != 599.99 {
+		t.Errorf("unexpected upgrade %+v", c)
+	}
+	if c := history[1]; c.Tier != TierBase || c.Previous != TierGold || c.Direction() != TierDowngrade {
+		t.Errorf("unexpected downgrade %+v", c)
+	}
+
+	// повторная запись той же смены не проходит: статус уже изменён
+	_, changed, err := repo.SetTier(ctx, "user", TierChange{Tier: TierBase, Previous: TierGold})
+	if err != nil || changed {
+		t.Errorf("expected stale tier change to be skipped; got %v, %v", changed, err)
+	}
+}
+
+func TestService_BackfillTiers(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemory()
+	s := New(repo, Config{Tiers: Tiers{Silver: 100, Gold: 500, Platinum: 1000, Window: 365 * 24 * time.Hour}})
+	for _, login := range []string{"user", "other", "old"} {
+		err := s.Register(ctx, login, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s.now, repo.now = clock, clock
+
+	// начисления без пересчёта статуса, как до появления статусов
+	accrue := func(login, number string, sum float64) {
+		t.Helper()
+		_, _, err := s.SubmitOrder(ctx, login, number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.SetOrderStatus(ctx, number, StatusProcessed, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	accrue("old", "18", 600)
+	now = now.AddDate(1, 0, 1)
+	accrue("user", "26", 550)
+	accrue("other", "34", 99)
+
+	n, err := s.BackfillTiers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected one tier change; got %v", n)
+	}
+	for login, want := range map[string]string{"user": TierGold, "other": TierBase, "old": TierBase} {
+		status, err := s.Tier(ctx, login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Tier != want {
+			t.Errorf("expected %s tier %s; got %s", login, want, status.Tier)
+		}
+	}
+
+	n, err = s.BackfillTiers(ctx)
+	if err != nil || n != 0 {
+		t.Errorf("expected repeated backfill to change nothing; got %v, %v", n, err)
+	}
+}
+
+func TestTiers_For(t *testing.T) {
+	tiers := DefaultTiers
+	for accrued, want := range map[float64]string{0: TierBase, 999.99: TierBase, 1000: TierSilver, 5000: TierGold, 20000: TierPlatinum, 1e6: TierPlatinum} {
+		if got := tiers.For(accrued); got != want {
+			t.Errorf("For(%v) = %s; want %s", accrued, got, want)
+		}
+	}
+	if next, _ := tiers.Next(TierPlatinum); next != "" {
+		t.Errorf("expected no tier above platinum; got %s", next)
+	}
+}
+
+func TestService_WithdrawOrderOnce(t *testing.T) {
+	ctx := context.Background()
+	s, repo := newTestService(t, "user", "other")
+
+	for i, login := range []string{"user", "other"} {
+		number := strconv.Itoa(18 + 8*i)
+		_, _, err := s.SubmitOrder(ctx, login, number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.SetOrderStatus(ctx, number, StatusProcessed, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := s.Withdraw(ctx, "user", "2377225624", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// чужое списание по тому же заказу перехватило бы возврат магазина
+	err = s.Withdraw(ctx, "other", "2377225624", 10)
+	if !errors.Is(err, ErrOrderWithdrawn) {
+		t.Errorf("expected ErrOrderWithdrawn for a second withdrawal; got %v", err)
+	}
+	_, err = s.Reserve(ctx, "other", "2377225624", 10)
+	if !errors.Is(err, ErrOrderWithdrawn) {
+		t.Errorf("expected ErrOrderWithdrawn for a reservation on a withdrawn order; got %v", err)
+	}
+
+	refund, err := s.RefundOrder(ctx, "2377225624", 0, "shop-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Sum != 40 {
+		t.Errorf("expected the user's withdrawal to be refunded; got %+v", refund)
+	}
+	balance, err := s.Balance(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Current != 100 {
+		t.Errorf("expected refund to return to the user; got %+v", balance)
+	}
+}
@@ -0,0 +1,540 @@
+package loyalty
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory — Repository в памяти процесса для тестов и локальных запусков без базы данных
+type Memory struct {
+	// PointsTTL — срок жизни начисленных баллов; 0 — баллы не сгорают
+	PointsTTL time.Duration
+
+	mu          sync.Mutex
+	seq         int
+	now         func() time.Time
+	users       map[string]string
+	orders      map[string]*Order
+	owners      map[string]string
+	balances    map[string]*Balance
+	withdrawals map[string][]Withdrawal
+	// refunds — проведённые возвраты по списанию и ExternalID
+	refunds      map[string]Refund
+	reservations map[string]*memoryReservation
+	// lots — партии баллов пользователей в порядке начисления
+	lots        map[string][]*Lot
+	expirations map[string][]Expiration
+	tiers       map[string]string
+	tierHistory map[string][]TierChange
+}
+
+type memoryReservation struct {
+	Reservation
+	login string
+}
+
+var _ Repository = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		now:          time.Now,
+		users:        make(map[string]string),
+		orders:       make(map[string]*Order),
+		owners:       make(map[string]string),
+		balances:     make(map[string]*Balance),
+		withdrawals:  make(map[string][]Withdrawal),
+		refunds:      make(map[string]Refund),
+		reservations: make(map[string]*memoryReservation),
+		lots:         make(map[string][]*Lot),
+		expirations:  make(map[string][]Expiration),
+		tiers:        make(map[string]string),
+		tierHistory:  make(map[string][]TierChange),
+	}
+}
+
+func (m *Memory) id() string {
+	m.seq++
+	return strconv.Itoa(m.seq)
+}
+
+func (m *Memory) UserRegister(_ context.Context, login, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[login]; ok {
+		return ErrDuplicate
+	}
+	m.users[login] = password
+	m.balances[login] = &Balance{}
+
+	return nil
+}
+
+func (m *Memory) UserLogin(_ context.Context, login, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.users[login]; !ok || p != password {
+		return ErrWrongCredentials
+	}
+	return nil
+}
+
+func (m *Memory) ownership(login, number string) Ownership {
+	owner, ok := m.owners[number]
+	switch {
+	case !ok:
+		return OwnershipNone
+	case owner == login:
+		return OwnershipUser
+	}
+	return OwnershipOther
+}
+
+func (m *Memory) OrderRegistered(_ context.Context, login, number string) (Ownership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ownership(login, number), nil
+}
+
+func (m *Memory) register(login, number string) {
+	m.owners[number] = login
+	m.orders[number] = &Order{ID: m.id(), Number: number, Status: StatusNew, UploadedAt: m.now()}
+}
+
+func (m *Memory) OrderRegister(_ context.Context, login, number string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.owners[number]; ok {
+		return ErrDuplicate
+	}
+	m.register(login, number)
+
+	return nil
+}
+
+func (m *Memory) OrdersRegisterBatch(_ context.Context, login string, numbers []string) (map[string]Ownership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]Ownership, len(numbers))
+	for _, number := range numbers {
+		if _, ok := result[number]; ok {
+			continue
+		}
+		result[number] = m.ownership(login, number)
+		if result[number] == OwnershipNone {
+			m.register(login, number)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *Memory) Orders(_ context.Context, login string) ([]Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []Order
+	for number, owner := range m.owners {
+		if owner == login {
+			result = append(result, *m.orders[number])
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UploadedAt.Before(result[j].UploadedAt) })
+
+	return result, nil
+}
+
+func (m *Memory) Order(_ context.Context, login, number string) (Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.owners[number] != login {
+		return Order{}, ErrNotFound
+	}
+	return *m.orders[number], nil
+}
+
+func (m *Memory) UserBalance(_ context.Context, login string) (Balance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.balances[login]
+	if !ok {
+		return Balance{}, ErrNotFound
+	}
+	return *b, nil
+}
+
+func (m *Memory) Withdraw(_ context.Context, login, number string, sum float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.balances[login]
+	if !ok {
+		return ErrNotFound
+	}
+	if m.claimed(number) {
+		return ErrOrderWithdrawn
+	}
+	if b.Available() < sum {
+		return ErrInsufficientFunds
+	}
+
+	m.withdraw(login, number, sum)
+
+	return nil
+}
+
+// claimed сообщает, что в счёт заказа уже есть списание или активный неистёкший резерв
+func (m *Memory) claimed(number string) bool {
+	for _, withdrawals := range m.withdrawals {
+		for _, w := range withdrawals {
+			if w.OrderNumber == number {
+				return true
+			}
+		}
+	}
+	for _, r := range m.reservations {
+		if r.OrderNumber == number && r.Status == ReservationActive && m.now().Before(r.ExpiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) withdraw(login, number string, sum float64) Withdrawal {
+	b := m.balances[login]
+	b.Current -= sum
+	b.Withdrawn += sum
+
+	lots := make([]Lot, len(m.lots[login]))
+	for i, l := range m.lots[login] {
+		lots[i] = *l
+	}
+	for i, taken := range ConsumeLots(lots, sum) {
+		m.lots[login][i].Remaining = math.Round((m.lots[login][i].Remaining-taken)*100) / 100
+	}
+
+	w := Withdrawal{ID: m.id(), OrderNumber: number, Sum: sum, ProcessedAt: m.now()}
+	m.withdrawals[login] = append(m.withdrawals[login], w)
+	return w
+}
+
+func (m *Memory) Withdrawals(_ context.Context, login string) ([]Withdrawal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := append([]Withdrawal(nil), m.withdrawals[login]...)
+	for i := range result {
+		result[i].Refunds = append([]Refund(nil), result[i].Refunds...)
+	}
+	return result, nil
+}
+
+func (m *Memory) WithdrawalByOrder(_ context.Context, number string) (Withdrawal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result *Withdrawal
+	for login := range m.withdrawals {
+		for i, w := range m.withdrawals[login] {
+			if w.OrderNumber == number && (result == nil || !w.ProcessedAt.Before(result.ProcessedAt)) {
+				result = &m.withdrawals[login][i]
+			}
+		}
+	}
+	if result == nil {
+		return Withdrawal{}, ErrNotFound
+	}
+	return *result, nil
+}
+
+func (m *Memory) Refund(_ context.Context, r Refund) (Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := r.WithdrawalID + "/" + r.ExternalID
+	if existing, ok := m.refunds[key]; ok && r.ExternalID != "" {
+		return existing, ErrDuplicate
+	}
+
+	for login := range m.withdrawals {
+		for i := range m.withdrawals[login] {
+			w := &m.withdrawals[login][i]
+			if w.ID != r.WithdrawalID {
+				continue
+			}
+
+			sum, err := RefundSum(*w, r.Sum)
+			if err != nil {
+				return Refund{}, err
+			}
+
+			r.ID = m.id()
+			r.Sum = sum
+			r.ProcessedAt = m.now()
+			w.Refunds = append(w.Refunds, r)
+			if r.ExternalID != "" {
+				m.refunds[key] = r
+			}
+			m.balances[login].Current += sum
+			m.balances[login].Withdrawn -= sum
+			m.accrue(login, w.OrderNumber, sum)
+
+			return r, nil
+		}
+	}
+
+	return Refund{}, ErrNotFound
+}
+
+func (m *Memory) Reserve(_ context.Context, login, number string, sum float64, expiresAt time.Time) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.balances[login]
+	if !ok {
+		return Reservation{}, ErrNotFound
+	}
+	if m.claimed(number) {
+		return Reservation{}, ErrOrderWithdrawn
+	}
+	if b.Available() < sum {
+		return Reservation{}, ErrInsufficientFunds
+	}
+
+	b.Reserved += sum
+	r := Reservation{ID: m.id(), OrderNumber: number, Sum: sum, Status: ReservationActive, CreatedAt: m.now(), ExpiresAt: expiresAt}
+	m.reservations[r.ID] = &memoryReservation{Reservation: r, login: login}
+
+	return r, nil
+}
+
+// close переводит активный резерв пользователя в status и снимает удержание баллов
+func (m *Memory) close(login, id, status string) (*memoryReservation, error) {
+	r, ok := m.reservations[id]
+	if !ok || r.login != login {
+		return nil, ErrNotFound
+	}
+	if r.Status != ReservationActive || !m.now().Before(r.ExpiresAt) {
+		return nil, ErrReservationClosed
+	}
+
+	r.Status = status
+	m.balances[login].Reserved -= r.Sum
+	return r, nil
+}
+
+func (m *Memory) CaptureReservation(_ context.Context, login, id string) (Withdrawal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.close(login, id, ReservationCaptured)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	return m.withdraw(login, r.OrderNumber, r.Sum), nil
+}
+
+func (m *Memory) ReleaseReservation(_ context.Context, login, id string) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, err := m.close(login, id, ReservationReleased)
+	if err != nil {
+		return Reservation{}, err
+	}
+	return r.Reservation, nil
+}
+
+func (m *Memory) ExpireReservations(_ context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for _, r := range m.reservations {
+		if r.Status == ReservationActive && !m.now().Before(r.ExpiresAt) {
+			r.Status = ReservationExpired
+			m.balances[r.login].Reserved -= r.Sum
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) AccruedSince(_ context.Context, login string, since time.Time) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sum float64
+	for number, owner := range m.owners {
+		o := m.orders[number]
+		if owner == login && o.Status == StatusProcessed && !o.ProcessedAt.Before(since) {
+			sum += o.Accrual
+		}
+	}
+	return sum, nil
+}
+
+func (m *Memory) UserTier(_ context.Context, login string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tier, ok := m.tiers[login]; ok {
+		return tier, nil
+	}
+	return TierBase, nil
+}
+
+func (m *Memory) SetTier(_ context.Context, login string, change TierChange) (TierChange, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.tiers[login]
+	if !ok {
+		current = TierBase
+	}
+	if current != change.Previous {
+		return TierChange{}, false, nil
+	}
+
+	change.ID = m.id()
+	change.ChangedAt = m.now()
+	m.tiers[login] = change.Tier
+	m.tierHistory[login] = append(m.tierHistory[login], change)
+
+	return change, true, nil
+}
+
+func (m *Memory) TieredUsers(_ context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []string
+	for login, tier := range m.tiers {
+		if tier != TierBase {
+			result = append(result, login)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (m *Memory) UntieredUsers(_ context.Context, since time.Time, threshold float64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	accrued := make(map[string]float64)
+	for number, owner := range m.owners {
+		o := m.orders[number]
+		if o.Status == StatusProcessed && !o.ProcessedAt.Before(since) {
+			accrued[owner] += o.Accrual
+		}
+	}
+
+	var result []string
+	for login, sum := range accrued {
+		if tier, ok := m.tiers[login]; (!ok || tier == TierBase) && sum >= threshold {
+			result = append(result, login)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (m *Memory) TierHistory(_ context.Context, login string) ([]TierChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]TierChange(nil), m.tierHistory[login]...), nil
+}
+
+// SetOrderStatus меняет статус заказа; для StatusProcessed начисляет accrual на баланс владельца,
+// как это делает расчёт начислений
+func (m *Memory) SetOrderStatus(_ context.Context, number, status string, accrual float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.orders[number]
+	if !ok {
+		return ErrNotFound
+	}
+
+	o.Status = status
+	if status == StatusProcessed {
+		o.Accrual = accrual
+		o.ProcessedAt = m.now()
+		m.balances[m.owners[number]].Current += accrual
+		m.accrue(m.owners[number], number, accrual)
+	}
+
+	return nil
+}
+
+// accrue добавляет пользователю партию из sum баллов
+func (m *Memory) accrue(login, number string, sum float64) {
+	if sum <= 0 {
+		return
+	}
+	now := m.now()
+	m.lots[login] = append(m.lots[login], &Lot{ID: m.id(), OrderNumber: number, Amount: sum, Remaining: sum, AccruedAt: now, ExpiresAt: LotExpiresAt(now, m.PointsTTL)})
+}
+
+func (m *Memory) ExpiringLots(_ context.Context, login string) ([]Lot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []Lot
+	for _, l := range m.lots[login] {
+		if l.Remaining > 0 && !l.ExpiresAt.IsZero() {
+			result = append(result, *l)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].ExpiresAt.Before(result[j].ExpiresAt) })
+
+	return result, nil
+}
+
+func (m *Memory) ExpireLots(_ context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	now := m.now()
+	for login, lots := range m.lots {
+		b := m.balances[login]
+		for _, l := range lots {
+			if l.Remaining <= 0 || l.ExpiresAt.IsZero() || now.Before(l.ExpiresAt) {
+				continue
+			}
+
+			sum := ExpireAmount(*b, l.Remaining)
+			if sum <= 0 {
+				continue
+			}
+
+			l.Remaining = math.Round((l.Remaining-sum)*100) / 100
+			b.Current -= sum
+			m.expirations[login] = append(m.expirations[login], Expiration{ID: m.id(), LotID: l.ID, OrderNumber: l.OrderNumber, Sum: sum, ExpiredAt: now})
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Expirations возвращает записи о сгорании баллов пользователя
+func (m *Memory) Expirations(login string) []Expiration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Expiration(nil), m.expirations[login]...)
+}
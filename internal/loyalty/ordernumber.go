@@ -0,0 +1,79 @@
+package loyalty
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxOrderNumberLen — максимальная длина номера заказа; ограничивает размер ключа уникального индекса
+const MaxOrderNumberLen = 255
+
+// NormalizeOrderNumber приводит номер заказа к виду, в котором он хранится: пробельные символы
+// по краям, а также пробелы и дефисы между группами цифр отбрасываются. Ведущие нули значимы и
+// сохраняются. Номер любой длины до MaxOrderNumberLen должен состоять только из цифр.
+func NormalizeOrderNumber(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	var b strings.Builder
+	b.Grow(len(raw))
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		switch {
+		case ch >= '0' && ch <= '9':
+			b.WriteByte(ch)
+		case ch == ' ' || ch == '-':
+		default:
+			return "", fmt.Errorf("unexpected character %q in order number", ch)
+		}
+	}
+
+	if b.Len() == 0 {
+		return "", fmt.Errorf("empty order number")
+	}
+	if b.Len() > MaxOrderNumberLen {
+		return "", fmt.Errorf("order number is longer than %d digits", MaxOrderNumberLen)
+	}
+
+	return b.String(), nil
+}
+
+// ParseOrderNumber нормализует номер заказа и проверяет его алгоритмом Луна; возвращает
+// ErrMalformedOrderNumber или ErrInvalidOrderNumber
+func ParseOrderNumber(raw string) (string, error) {
+	number, err := NormalizeOrderNumber(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedOrderNumber, err)
+	}
+
+	if !ValidateLuhn(number) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidOrderNumber, number)
+	}
+
+	return number, nil
+}
+
+// ValidateLuhn проверяет контрольную цифру — последнюю цифру номера; number состоит только из цифр
+func ValidateLuhn(number string) bool {
+	last := len(number) - 1
+	return (int(number[last]-'0')+checksumLuhn(number[:last]))%10 == 0
+}
+
+// checksumLuhn считает сумму Луна по модулю 10 для номера без контрольной цифры: удваивается
+// каждая вторая цифра, начиная с последней
+func checksumLuhn(number string) int {
+	var luhn int
+
+	for i := 0; i < len(number); i++ {
+		cur := int(number[len(number)-1-i] - '0')
+
+		if i%2 == 0 {
+			cur = cur * 2
+			if cur > 9 {
+				cur = cur%10 + cur/10
+			}
+		}
+
+		luhn += cur
+	}
+	return luhn % 10
+}
@@ -0,0 +1,76 @@
+package loyalty
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// статусы резерва
+const (
+	ReservationActive   = "active"
+	ReservationCaptured = "captured"
+	ReservationReleased = "released"
+	ReservationExpired  = "expired"
+)
+
+// Reservation — баллы, удерживаемые на время оплаты заказа в магазине. Резерв уменьшает
+// доступные баллы, но не баланс; подтверждение превращает его в списание.
+type Reservation struct {
+	ID          string
+	OrderNumber string
+	Sum         float64
+	Status      string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Reserve резервирует sum баллов в счёт заказа raw на Config.ReservationTTL; ErrInvalidAmount,
+// ErrMalformedOrderNumber, ErrInvalidOrderNumber, ErrInsufficientFunds или ErrOrderWithdrawn
+func (s *Service) Reserve(ctx context.Context, login, raw string, sum float64) (Reservation, error) {
+	if !(sum > 0) {
+		return Reservation{}, fmt.Errorf("%w: %v", ErrInvalidAmount, sum)
+	}
+
+	number, err := ParseOrderNumber(raw)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	reservation, err := s.repo.Reserve(ctx, login, number, sum, s.now().Add(s.cfg.ReservationTTL))
+	if err != nil {
+		return Reservation{}, fmt.Errorf("reserve: %w", err)
+	}
+
+	return reservation, nil
+}
+
+// Capture списывает зарезервированные баллы; ErrNotFound или ErrReservationClosed
+func (s *Service) Capture(ctx context.Context, login, id string) (Withdrawal, error) {
+	withdrawal, err := s.repo.CaptureReservation(ctx, login, id)
+	if err != nil {
+		return Withdrawal{}, fmt.Errorf("capture reservation: %w", err)
+	}
+
+	return withdrawal, nil
+}
+
+// Release снимает резерв и возвращает баллы в доступные; ErrNotFound или ErrReservationClosed
+func (s *Service) Release(ctx context.Context, login, id string) (Reservation, error) {
+	reservation, err := s.repo.ReleaseReservation(ctx, login, id)
+	if err != nil {
+		return Reservation{}, fmt.Errorf("release reservation: %w", err)
+	}
+
+	return reservation, nil
+}
+
+// ExpireReservations снимает истёкшие резервы всех пользователей
+func (s *Service) ExpireReservations(ctx context.Context) (int, error) {
+	n, err := s.repo.ExpireReservations(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("expire reservations: %w", err)
+	}
+
+	return n, nil
+}
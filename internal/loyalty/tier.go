@@ -0,0 +1,182 @@
+package loyalty
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// статусы пользователя по возрастанию
+const (
+	TierBase     = "base"
+	TierSilver   = "silver"
+	TierGold     = "gold"
+	TierPlatinum = "platinum"
+)
+
+// направления смены статуса
+const (
+	TierUpgrade   = "upgrade"
+	TierDowngrade = "downgrade"
+)
+
+var tierRank = map[string]int{TierBase: 0, TierSilver: 1, TierGold: 2, TierPlatinum: 3}
+
+// Tiers — пороги статусов: сумма начислений за скользящее окно Window, начиная с которой
+// присваивается статус
+type Tiers struct {
+	Silver   float64
+	Gold     float64
+	Platinum float64
+	Window   time.Duration
+}
+
+// DefaultTiers — пороги статусов, если Config.Tiers не задан
+var DefaultTiers = Tiers{Silver: 1000, Gold: 5000, Platinum: 20000, Window: 365 * 24 * time.Hour}
+
+// For возвращает статус для суммы начислений accrued за окно
+func (t Tiers) For(accrued float64) string {
+	switch {
+	case accrued >= t.Platinum:
+		return TierPlatinum
+	case accrued >= t.Gold:
+		return TierGold
+	case accrued >= t.Silver:
+		return TierSilver
+	}
+	return TierBase
+}
+
+// Next возвращает следующий за tier статус и его порог; пустую строку для высшего статуса
+func (t Tiers) Next(tier string) (string, float64) {
+	switch tier {
+	case TierBase:
+		return TierSilver, t.Silver
+	case TierSilver:
+		return TierGold, t.Gold
+	case TierGold:
+		return TierPlatinum, t.Platinum
+	}
+	return "", 0
+}
+
+// TierChange — смена статуса пользователя
+type TierChange struct {
+	ID       string
+	Tier     string
+	Previous string
+	// Accrued — сумма начислений за окно, по которой пересчитан статус
+	Accrued   float64
+	ChangedAt time.Time
+}
+
+// Direction возвращает TierUpgrade или TierDowngrade
+func (c TierChange) Direction() string {
+	if tierRank[c.Tier] > tierRank[c.Previous] {
+		return TierUpgrade
+	}
+	return TierDowngrade
+}
+
+// TierStatus — статус пользователя и прогресс до следующего
+type TierStatus struct {
+	Tier string
+	// Accrued — сумма начислений с WindowStart
+	Accrued     float64
+	WindowStart time.Time
+	// Next и NextThreshold — следующий статус и его порог; Next пуст для высшего статуса
+	Next          string
+	NextThreshold float64
+}
+
+// Tier возвращает статус пользователя и сумму начислений за окно
+func (s *Service) Tier(ctx context.Context, login string) (TierStatus, error) {
+	tier, err := s.repo.UserTier(ctx, login)
+	if err != nil {
+		return TierStatus{}, fmt.Errorf("user tier: %w", err)
+	}
+
+	since := s.now().Add(-s.cfg.Tiers.Window)
+	accrued, err := s.repo.AccruedSince(ctx, login, since)
+	if err != nil {
+		return TierStatus{}, fmt.Errorf("accrued since: %w", err)
+	}
+
+	next, threshold := s.cfg.Tiers.Next(tier)
+	return TierStatus{Tier: tier, Accrued: accrued, WindowStart: since, Next: next, NextThreshold: threshold}, nil
+}
+
+// RecomputeTier пересчитывает статус пользователя по начислениям за окно и возвращает смену
+// статуса; changed == false, если статус не изменился
+func (s *Service) RecomputeTier(ctx context.Context, login string) (change TierChange, changed bool, err error) {
+	current, err := s.repo.UserTier(ctx, login)
+	if err != nil {
+		return TierChange{}, false, fmt.Errorf("user tier: %w", err)
+	}
+
+	accrued, err := s.repo.AccruedSince(ctx, login, s.now().Add(-s.cfg.Tiers.Window))
+	if err != nil {
+		return TierChange{}, false, fmt.Errorf("accrued since: %w", err)
+	}
+
+	tier := s.cfg.Tiers.For(accrued)
+	if tier == current {
+		return TierChange{}, false, nil
+	}
+
+	// статус мог одновременно пересчитать другой экземпляр сервиса: тогда смена уже записана
+	change, changed, err = s.repo.SetTier(ctx, login, TierChange{Tier: tier, Previous: current, Accrued: accrued})
+	if err != nil {
+		return TierChange{}, false, fmt.Errorf("set tier: %w", err)
+	}
+
+	return change, changed, nil
+}
+
+// RecomputeTiers пересчитывает статусы пользователей выше базового, у которых начисления могли
+// выйти из окна, и возвращает число смен статуса
+func (s *Service) RecomputeTiers(ctx context.Context) (int, error) {
+	logins, err := s.repo.TieredUsers(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("tiered users: %w", err)
+	}
+
+	return s.recomputeTiers(ctx, logins)
+}
+
+// BackfillTiers присваивает статусы пользователям, которые набрали порог, оставаясь с базовым
+// статусом: начислениям до появления статусов или до снижения порогов. Такие пользователи не
+// попадают ни в пересчёт при начислении, ни в RecomputeTiers. Возвращает число смен статуса.
+func (s *Service) BackfillTiers(ctx context.Context) (int, error) {
+	logins, err := s.repo.UntieredUsers(ctx, s.now().Add(-s.cfg.Tiers.Window), s.cfg.Tiers.Silver)
+	if err != nil {
+		return 0, fmt.Errorf("untiered users: %w", err)
+	}
+
+	return s.recomputeTiers(ctx, logins)
+}
+
+func (s *Service) recomputeTiers(ctx context.Context, logins []string) (int, error) {
+	var n int
+	for _, login := range logins {
+		_, changed, err := s.RecomputeTier(ctx, login)
+		if err != nil {
+			return n, err
+		}
+		if changed {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// TierHistory возвращает смены статуса пользователя в хронологическом порядке
+func (s *Service) TierHistory(ctx context.Context, login string) ([]TierChange, error) {
+	history, err := s.repo.TierHistory(ctx, login)
+	if err != nil {
+		return nil, fmt.Errorf("tier history: %w", err)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gophermart"
+
+// время на сбор показателей из базы данных при каждом запросе /metrics
+const collectTimeout = 2 * time.Second
+
+// Stats — показатели, которые снимаются в момент запроса /metrics
+type Stats struct {
+	DB               sql.DBStats
+	OrdersNew        int
+	OrdersProcessing int
+	OrdersDead       int
+	PointsAccrued    float64
+	PointsWithdrawn  float64
+	PointsRefunded   float64
+	// 0 — замкнут, 1 — разомкнут, 2 — полуразомкнут
+	BreakerState int
+}
+
+type StatsFunc func(ctx context.Context) (Stats, error)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	accrualPolls    *prometheus.CounterVec
+}
+
+func New(stats StatsFunc) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by method, route and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+		accrualPolls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "accrual_polls_total",
+			Help:      "Accrual system lookups by outcome.",
+		}, []string{"outcome"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.accrualPolls,
+		&statsCollector{stats: stats},
+	)
+
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware учитывает запросы по шаблону маршрута echo, а не по фактическому пути,
+// чтобы номера заказов в пути не порождали новые ряды
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" || isUnmatched(c.Handler()) {
+			route = "unmatched"
+		}
+		labels := prometheus.Labels{
+			"method": c.Request().Method,
+			"route":  route,
+			"code":   strconv.Itoa(c.Response().Status),
+		}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
+
+var (
+	notFoundHandler         = reflect.ValueOf(echo.NotFoundHandler).Pointer()
+	methodNotAllowedHandler = reflect.ValueOf(echo.MethodNotAllowedHandler).Pointer()
+)
+
+// isUnmatched сообщает, что маршрутизатор не нашёл маршрут: в этом случае c.Path() содержит
+// фактический путь запроса
+func isUnmatched(h echo.HandlerFunc) bool {
+	ptr := reflect.ValueOf(h).Pointer()
+	return ptr == notFoundHandler || ptr == methodNotAllowedHandler
+}
+
+// AccrualPoll учитывает результат запроса к системе расчёта: статус заказа или вид ошибки
+func (m *Metrics) AccrualPoll(outcome string) {
+	m.accrualPolls.WithLabelValues(outcome).Inc()
+}
+
+type statsCollector struct {
+	stats StatsFunc
+}
+
+var (
+	dbOpenDesc        = prometheus.NewDesc(namespace+"_db_open_connections", "Established database connections.", nil, nil)
+	dbInUseDesc       = prometheus.NewDesc(namespace+"_db_in_use_connections", "Database connections currently in use.", nil, nil)
+	dbIdleDesc        = prometheus.NewDesc(namespace+"_db_idle_connections", "Idle database connections.", nil, nil)
+	dbMaxOpenDesc     = prometheus.NewDesc(namespace+"_db_max_open_connections", "Maximum number of open database connections.", nil, nil)
+	dbWaitCountDesc   = prometheus.NewDesc(namespace+"_db_wait_count_total", "Connections waited for.", nil, nil)
+	dbWaitSecondsDesc = prometheus.NewDesc(namespace+"_db_wait_duration_seconds_total", "Time spent waiting for connections.", nil, nil)
+	ordersDesc        = prometheus.NewDesc(namespace+"_orders_queued", "Orders waiting for accrual by status.", []string{"status"}, nil)
+	accruedDesc       = prometheus.NewDesc(namespace+"_points_accrued_total", "Points accrued for processed orders.", nil, nil)
+	withdrawnDesc     = prometheus.NewDesc(namespace+"_points_withdrawn_total", "Points withdrawn by users, refunds not deducted.", nil, nil)
+	refundedDesc      = prometheus.NewDesc(namespace+"_points_refunded_total", "Withdrawn points refunded to users.", nil, nil)
+	breakerDesc       = prometheus.NewDesc(namespace+"_accrual_breaker_state", "Accrual circuit breaker state: 0 closed, 1 open, 2 half-open.", nil, nil)
+	statsErrorDesc    = prometheus.NewDesc(namespace+"_stats_error", "1 if database statistics could not be collected.", nil, nil)
+)
+
+func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbOpenDesc
+	ch <- dbInUseDesc
+	ch <- dbIdleDesc
+	ch <- dbMaxOpenDesc
+	ch <- dbWaitCountDesc
+	ch <- dbWaitSecondsDesc
+	ch <- ordersDesc
+	ch <- accruedDesc
+	ch <- withdrawnDesc
+	ch <- refundedDesc
+	ch <- breakerDesc
+	ch <- statsErrorDesc
+}
+
+func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	s, err := sc.stats(ctx)
+
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(s.DB.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(s.DB.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(s.DB.Idle))
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(s.DB.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbWaitCountDesc, prometheus.CounterValue, float64(s.DB.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitSecondsDesc, prometheus.CounterValue, s.DB.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(breakerDesc, prometheus.GaugeValue, float64(s.BreakerState))
+
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(statsErrorDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(statsErrorDesc, prometheus.GaugeValue, 0)
+
+	ch <- prometheus.MustNewConstMetric(ordersDesc, prometheus.GaugeValue, float64(s.OrdersNew), "NEW")
+	ch <- prometheus.MustNewConstMetric(ordersDesc, prometheus.GaugeValue, float64(s.OrdersProcessing), "PROCESSING")
+	ch <- prometheus.MustNewConstMetric(ordersDesc, prometheus.GaugeValue, float64(s.OrdersDead), "DEAD")
+	ch <- prometheus.MustNewConstMetric(accruedDesc, prometheus.CounterValue, s.PointsAccrued)
+	ch <- prometheus.MustNewConstMetric(withdrawnDesc, prometheus.CounterValue, s.PointsWithdrawn)
+	ch <- prometheus.MustNewConstMetric(refundedDesc, prometheus.CounterValue, s.PointsRefunded)
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	result := recorder.Result()
+	defer result.Body.Close()
+
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("could not read response: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := New(func(ctx context.Context) (Stats, error) {
+		return Stats{OrdersNew: 3, OrdersProcessing: 2, PointsAccrued: 729.98, PointsWithdrawn: 500, PointsRefunded: 120, BreakerState: 1}, nil
+	})
+
+	e := echo.New()
+	e.Use(m.Middleware)
+	e.GET("/api/orders/:number", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	for _, path := range []string{"/api/orders/1", "/api/orders/2", "/missing"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	m.AccrualPoll("PROCESSED")
+	m.AccrualPoll("PROCESSED")
+	m.AccrualPoll("error")
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`gophermart_http_requests_total{code="200",method="GET",route="/api/orders/:number"} 2`,
+		`gophermart_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`gophermart_http_request_duration_seconds_count{code="200",method="GET",route="/api/orders/:number"} 2`,
+		`gophermart_accrual_polls_total{outcome="PROCESSED"} 2`,
+		`gophermart_accrual_polls_total{outcome="error"} 1`,
+		`gophermart_orders_queued{status="NEW"} 3`,
+		`gophermart_orders_queued{status="PROCESSING"} 2`,
+		`gophermart_points_accrued_total 729.98`,
+		`gophermart_points_withdrawn_total 500`,
+		`gophermart_points_refunded_total 120`,
+		`gophermart_accrual_breaker_state 1`,
+		`gophermart_stats_error 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestMetrics_StatsError(t *testing.T) {
+	m := New(func(ctx context.Context) (Stats, error) {
+		return Stats{}, errors.New("db is down")
+	})
+
+	body := scrape(t, m)
+	if !strings.Contains(body, "gophermart_stats_error 1") {
+		t.Errorf("expected stats error to be reported")
+	}
+	if strings.Contains(body, "gophermart_orders_queued") {
+		t.Errorf("expected no queue depth when stats are unavailable")
+	}
+}
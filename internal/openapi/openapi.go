@@ -0,0 +1,156 @@
+// Package openapi содержит спецификацию HTTP API в формате OpenAPI 3, обработчики для её
+// публикации и middleware, проверяющий запросы и ответы на соответствие спецификации.
+package openapi
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec возвращает документ OpenAPI в формате JSON
+func Spec() []byte {
+	return spec
+}
+
+// Load разбирает встроенный документ и проверяет его корректность
+func Load() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("load openapi: %w", err)
+	}
+
+	err = doc.Validate(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("validate openapi: %w", err)
+	}
+
+	return doc, nil
+}
+
+func Handler(c echo.Context) error {
+	// StatusOK 200 — документ OpenAPI
+
+	return c.JSONBlob(http.StatusOK, spec)
+}
+
+// redocVersion — версия Redoc для страницы документации; закреплена, чтобы обновление на CDN
+// не меняло страницу без изменения кода
+const redocVersion = "2.1.3"
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Гофермарт API</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+<redoc spec-url="/api/openapi.json"></redoc>
+<script src="https://cdn.jsdelivr.net/npm/redoc@` + redocVersion + `/bundles/redoc.standalone.js" crossorigin="anonymous"></script>
+</body>
+</html>
+`
+
+func Docs(c echo.Context) error {
+	// StatusOK 200 — страница документации
+
+	return c.HTML(http.StatusOK, docsPage)
+}
+
+// Validator проверяет запросы и ответы на соответствие спецификации. Запрос, не
+// соответствующий спецификации, отклоняется с кодом 400; расхождение ответа со спецификацией
+// передаётся в report — в тестах это делает расхождение обработчика и документа ошибкой.
+type Validator struct {
+	router  routers.Router
+	options *openapi3filter.Options
+	report  func(error)
+}
+
+func NewValidator(doc *openapi3.T, report func(error)) (*Validator, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("openapi router: %w", err)
+	}
+
+	return &Validator{
+		router: router,
+		options: &openapi3filter.Options{
+			IncludeResponseStatus: true,
+			// аутентификацию проверяют обработчики, спецификация только описывает её
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		},
+		report: report,
+	}, nil
+}
+
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (v *Validator) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		route, params, err := v.router.FindRoute(req)
+		if err != nil {
+			v.report(fmt.Errorf("%s %s is not described in the specification: %w", req.Method, req.URL.Path, err))
+			return next(c)
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: params,
+			Route:      route,
+			Options:    v.options,
+		}
+		err = openapi3filter.ValidateRequest(req.Context(), input)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "request does not match the API specification").SetInternal(err)
+		}
+
+		res := c.Response()
+		rec := &bodyRecorder{ResponseWriter: res.Writer}
+		res.Writer = rec
+		defer func() {
+			res.Writer = rec.ResponseWriter
+		}()
+
+		err = next(c)
+		if err != nil {
+			// ответ об ошибке тоже должен соответствовать спецификации
+			c.Error(err)
+		}
+
+		err = openapi3filter.ValidateResponse(req.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 res.Status,
+			Header:                 res.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(rec.body.Bytes())),
+			Options:                v.options,
+		})
+		if err != nil {
+			v.report(fmt.Errorf("%s %s: response %d does not match the specification: %w", req.Method, req.URL.Path, res.Status, err))
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoad(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatalf("spec is invalid: %v", err)
+	}
+	if doc.Paths.Find("/api/user/orders") == nil {
+		t.Errorf("spec has no /api/user/orders")
+	}
+}
+
+func TestDocs(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	err := Docs(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/docs", nil), recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := recorder.Body.String()
+	if !strings.Contains(body, "redoc@"+redocVersion+"/") || strings.Contains(body, "latest") {
+		t.Errorf("expected docs to load Redoc %s; got %s", redocVersion, body)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		handler    echo.HandlerFunc
+		wantStatus int
+		wantReport bool
+	}{
+		{
+			name:   "response matches",
+			method: http.MethodGet,
+			target: "/api/user/balance",
+			handler: func(c echo.Context) error {
+				return c.JSON(http.StatusOK, map[string]float64{"current": 500.5, "withdrawn": 42})
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "response field has wrong type",
+			method: http.MethodGet,
+			target: "/api/user/balance",
+			handler: func(c echo.Context) error {
+				return c.JSON(http.StatusOK, map[string]string{"current": "500.5", "withdrawn": "42"})
+			},
+			wantStatus: http.StatusOK,
+			wantReport: true,
+		},
+		{
+			name:   "undocumented status",
+			method: http.MethodGet,
+			target: "/api/user/balance",
+			handler: func(c echo.Context) error {
+				return c.String(http.StatusTeapot, "teapot")
+			},
+			wantStatus: http.StatusTeapot,
+			wantReport: true,
+		},
+		{
+			name:   "error response is validated",
+			method: http.MethodGet,
+			target: "/api/user/balance",
+			handler: func(c echo.Context) error {
+				return echo.ErrUnauthorized
+			},
+			wantStatus: http.StatusUnauthorized,
+			// стандартный обработчик ошибок echo отвечает application/json, а не problem+json
+			wantReport: true,
+		},
+		{
+			name:   "request body does not match",
+			method: http.MethodPost,
+			target: "/api/user/register",
+			body:   `{"login":"test"}`,
+			handler: func(c echo.Context) error {
+				t.Error("handler must not be called")
+				return nil
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "undocumented route",
+			method: http.MethodGet,
+			target: "/api/unknown",
+			handler: func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			},
+			wantStatus: http.StatusOK,
+			wantReport: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reported []error
+			v, err := NewValidator(doc, func(err error) {
+				reported = append(reported, err)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e := echo.New()
+			e.Use(v.Middleware)
+			e.Add(tt.method, tt.target, tt.handler)
+
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			}
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("expected status %v; got %v", tt.wantStatus, recorder.Code)
+			}
+			if got := len(reported) > 0; got != tt.wantReport {
+				t.Errorf("expected report %v; got %v", tt.wantReport, reported)
+			}
+		})
+	}
+}
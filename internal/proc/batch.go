@@ -0,0 +1,136 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+// наибольшее число номеров в одном пакетном запросе
+const maxBatchOrders = 1000
+
+// результаты обработки номера в пакетной загрузке
+const (
+	batchAccepted     = "accepted"
+	batchAlreadyYours = "already_yours"
+	batchOwnedByOther = "owned_by_other"
+	batchInvalid      = "invalid"
+)
+
+type batchItemJSON struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchJSON struct {
+	Accepted     int             `json:"accepted"`
+	AlreadyYours int             `json:"already_yours"`
+	OwnedByOther int             `json:"owned_by_other"`
+	Invalid      int             `json:"invalid"`
+	Results      []batchItemJSON `json:"results"`
+}
+
+// batchNumbers читает номера заказов из тела запроса: JSON-массив строк или текст, по номеру в строке
+func batchNumbers(c echo.Context) ([]string, error) {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		mediaType = echo.MIMETextPlain
+	}
+
+	var numbers []string
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		err = json.Unmarshal(body, &numbers)
+		if err != nil {
+			return nil, newError(http.StatusBadRequest, CodeBadRequest, "expected a JSON array of order numbers", err)
+		}
+	case echo.MIMETextPlain:
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) > 0 {
+				numbers = append(numbers, string(line))
+			}
+		}
+		err = scanner.Err()
+		if err != nil {
+			return nil, newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+		}
+	default:
+		return nil, newError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "order numbers must be sent as application/json or text/plain", nil)
+	}
+
+	if len(numbers) == 0 {
+		return nil, newError(http.StatusBadRequest, CodeBadRequest, "no order numbers in request", nil)
+	}
+	if len(numbers) > maxBatchOrders {
+		return nil, newError(http.StatusRequestEntityTooLarge, CodeBatchTooLarge, fmt.Sprintf("at most %d order numbers per request", maxBatchOrders), nil)
+	}
+
+	return numbers, nil
+}
+
+func (p *Proc) SetOrdersBatch(c echo.Context) error {
+	// StatusOK 200 — номера обработаны, результат по каждому номеру в results
+	// StatusBadRequest 400 — неверный формат запроса
+	// StatusUnauthorized 401 — пользователь не аутентифицирован
+	// StatusRequestEntityTooLarge 413 — слишком много номеров в запросе
+	// StatusUnsupportedMediaType 415 — тело запроса не JSON и не текст
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	raw, err := batchNumbers(c)
+	if err != nil {
+		return err
+	}
+
+	submitted, err := p.loyalty.SubmitOrders(c.Request().Context(), login, raw)
+	if err != nil {
+		return err
+	}
+
+	results := make([]batchItemJSON, len(submitted))
+	for i, r := range submitted {
+		results[i] = batchItemJSON{Number: r.Number, Status: batchAccepted}
+		switch {
+		case r.Err != nil:
+			results[i].Status = batchInvalid
+			results[i].Error = domainError(r.Err).Detail
+		case r.Ownership == loyalty.OwnershipUser:
+			results[i].Status = batchAlreadyYours
+		case r.Ownership == loyalty.OwnershipOther:
+			results[i].Status = batchOwnedByOther
+		}
+	}
+
+	var result batchJSON
+	for _, item := range results {
+		switch item.Status {
+		case batchAccepted:
+			result.Accepted++
+		case batchAlreadyYours:
+			result.AlreadyYours++
+		case batchOwnedByOther:
+			result.OwnedByOther++
+		case batchInvalid:
+			result.Invalid++
+		}
+	}
+	result.Results = results
+
+	return c.JSON(http.StatusOK, result)
+}
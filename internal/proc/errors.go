@@ -0,0 +1,157 @@
+package proc
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/inkpics/gophermart/internal/logging"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+// машиночитаемые коды ошибок API, передаются в поле code ответа problem+json
+const (
+	CodeBadRequest           = "bad_request"
+	CodeUnauthorized         = "unauthorized"
+	CodeWrongCredentials     = "wrong_credentials"
+	CodeLoginTaken           = "login_taken"
+	CodeInvalidOrderNumber   = "invalid_order_number"
+	CodeOrderConflict        = "order_conflict"
+	CodeOrderWithdrawn       = "order_withdrawn"
+	CodeConflict             = "conflict"
+	CodeInsufficientFunds    = "insufficient_funds"
+	CodeRefundExceeded       = "refund_exceeded"
+	CodeReservationClosed    = "reservation_closed"
+	CodeNotFound             = "not_found"
+	CodeInvalidSignature     = "invalid_signature"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeBatchTooLarge        = "batch_too_large"
+	CodeInternal             = "internal_error"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:gophermart:problem:"
+)
+
+// Error — ошибка API с HTTP-статусом и кодом; Err хранит причину, которая пишется в журнал,
+// но не передаётся клиенту
+type Error struct {
+	Status int
+	Code   string
+	Detail string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Detail + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(status int, code, detail string, cause error) *Error {
+	return &Error{Status: status, Code: code, Detail: detail, Err: cause}
+}
+
+type problemJSON struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// domainError сопоставляет ошибки хранилища с ответами API
+func domainError(err error) *Error {
+	var apiErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, loyalty.ErrLoginTaken):
+		return newError(http.StatusConflict, CodeLoginTaken, "login is already in use", err)
+	case errors.Is(err, loyalty.ErrMalformedOrderNumber):
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed order number", err)
+	case errors.Is(err, loyalty.ErrInvalidOrderNumber):
+		return newError(http.StatusUnprocessableEntity, CodeInvalidOrderNumber, "order number fails the Luhn check", err)
+	case errors.Is(err, loyalty.ErrOrderConflict):
+		return newError(http.StatusConflict, CodeOrderConflict, "order registered by another user", err)
+	case errors.Is(err, loyalty.ErrOrderWithdrawn):
+		return newError(http.StatusConflict, CodeOrderWithdrawn, "order already has a withdrawal or an active reservation", err)
+	case errors.Is(err, loyalty.ErrInvalidAmount):
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed sum", err)
+	case errors.Is(err, loyalty.ErrRefundExceeded):
+		return newError(http.StatusConflict, CodeRefundExceeded, "refund exceeds the withdrawn sum", err)
+	case errors.Is(err, loyalty.ErrReservationClosed):
+		return newError(http.StatusConflict, CodeReservationClosed, "reservation is no longer active", err)
+	case errors.Is(err, loyalty.ErrNotFound):
+		return newError(http.StatusNotFound, CodeNotFound, "resource not found", err)
+	case errors.Is(err, loyalty.ErrWrongCredentials):
+		return newError(http.StatusUnauthorized, CodeWrongCredentials, "wrong credentials", err)
+	case errors.Is(err, loyalty.ErrDuplicate):
+		return newError(http.StatusConflict, CodeConflict, "resource already exists", err)
+	case errors.Is(err, loyalty.ErrInsufficientFunds):
+		return newError(http.StatusPaymentRequired, CodeInsufficientFunds, "not enough points on the balance", err)
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		detail := http.StatusText(httpErr.Code)
+		if msg, ok := httpErr.Message.(string); ok {
+			detail = msg
+		}
+		return newError(httpErr.Code, codeFromStatus(httpErr.Code), detail, httpErr.Internal)
+	}
+
+	return newError(http.StatusInternalServerError, CodeInternal, "internal server error", err)
+}
+
+func codeFromStatus(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// HTTPErrorHandler отвечает на любую ошибку обработчика в формате RFC 7807 и пишет
+// причину ошибок сервера в журнал
+func (p *Proc) HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	apiErr := domainError(err)
+	ctx := c.Request().Context()
+
+	if apiErr.Status >= http.StatusInternalServerError {
+		p.logger.ErrorContext(ctx, "request failed", "route", c.Path(), "status", apiErr.Status, "error", err)
+		// подробности внутренних ошибок клиенту не передаются
+		apiErr = newError(apiErr.Status, apiErr.Code, http.StatusText(apiErr.Status), nil)
+	} else if apiErr.Err != nil {
+		p.logger.DebugContext(ctx, "request rejected", "route", c.Path(), "status", apiErr.Status, "code", apiErr.Code, "error", apiErr.Err)
+	}
+
+	problem := problemJSON{
+		Type:      problemTypePrefix + apiErr.Code,
+		Title:     http.StatusText(apiErr.Status),
+		Status:    apiErr.Status,
+		Detail:    apiErr.Detail,
+		Instance:  c.Request().URL.Path,
+		Code:      apiErr.Code,
+		RequestID: logging.RequestID(ctx),
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		c.Response().Header().Set(echo.HeaderContentType, problemContentType)
+		err = c.JSON(apiErr.Status, problem)
+	}
+	if err != nil {
+		p.logger.ErrorContext(ctx, "write error response", "error", err)
+	}
+}
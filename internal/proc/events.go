@@ -0,0 +1,177 @@
+package proc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// число последних событий, доступных для возобновления потока по Last-Event-ID
+	eventsHistory = 1024
+	// интервал комментариев-пингов, не дающих прокси закрыть простаивающее соединение
+	eventsHeartbeat = 15 * time.Second
+)
+
+type orderEventJSON struct {
+	Number  string `json:"number"`
+	Status  string `json:"status"`
+	Accrual string `json:"accrual"`
+}
+
+type tierEventJSON struct {
+	Tier     string `json:"tier"`
+	Previous string `json:"previous"`
+	Change   string `json:"change"`
+}
+
+type balanceEventJSON struct {
+	Current   string `json:"current"`
+	Withdrawn string `json:"withdrawn"`
+	Available string `json:"available"`
+	Reserved  string `json:"reserved"`
+}
+
+// eventData возвращает данные события для клиента; суммы передаются строками, как в /api/v2
+func eventData(e events.Event) (any, error) {
+	switch e.Type {
+	case events.TypeOrder:
+		return orderEventJSON{Number: e.Order.Number, Status: e.Order.Status, Accrual: formatMoney(e.Order.Accrual)}, nil
+	case events.TypeBalance:
+		return balanceEventJSON{
+			Current:   formatMoney(e.Balance.Current),
+			Withdrawn: formatMoney(e.Balance.Withdrawn),
+			Available: formatMoney(e.Balance.Current - e.Balance.Reserved),
+			Reserved:  formatMoney(e.Balance.Reserved),
+		}, nil
+	case events.TypeTier:
+		change := loyalty.TierChange{Tier: e.Tier.Tier, Previous: e.Tier.Previous}
+		return tierEventJSON{Tier: change.Tier, Previous: change.Previous, Change: change.Direction()}, nil
+	}
+	return nil, fmt.Errorf("unknown event type %q", e.Type)
+}
+
+// writeEvent пишет событие в формате text/event-stream
+func writeEvent(w io.Writer, e events.Event) error {
+	data, err := eventData(e)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
+
+// clearWriteDeadline снимает WriteTimeout сервера с потокового ответа: иначе ответ обрывается
+// посреди тела, когда клиент уже получил 200
+func (p *Proc) clearWriteDeadline(c echo.Context) {
+	err := http.NewResponseController(c.Response().Writer).SetWriteDeadline(time.Time{})
+	if err != nil {
+		p.logger.DebugContext(c.Request().Context(), "write deadline is not reset", "path", c.Path(), "error", err)
+	}
+}
+
+// lastEventID возвращает идентификатор последнего полученного клиентом события из заголовка
+// Last-Event-ID или параметра last_event_id; ноль, если клиент подключается впервые
+func lastEventID(c echo.Context) (uint64, error) {
+	last := c.Request().Header.Get("Last-Event-ID")
+	if last == "" {
+		// EventSource и WebSocket в браузере не позволяют задать заголовок
+		last = c.QueryParam("last_event_id")
+	}
+	if last == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		return 0, newError(http.StatusBadRequest, CodeBadRequest, "malformed Last-Event-ID", err)
+	}
+	return id, nil
+}
+
+// CloseEvents завершает потоки событий и WebSocket-соединения всех пользователей; вызывается при остановке сервера
+func (p *Proc) CloseEvents() {
+	p.events.Close()
+}
+
+func (p *Proc) Events(c echo.Context) error {
+	// StatusOK 200 — поток событий text/event-stream
+	// StatusBadRequest 400 — неверный Last-Event-ID
+	// StatusUnauthorized 401 — пользователь не авторизован
+
+	login := c.Get("login").(string)
+
+	lastID, err := lastEventID(c)
+	if err != nil {
+		return err
+	}
+
+	sub := p.events.Subscribe(login, lastID)
+	defer sub.Close()
+
+	res := c.Response()
+	// поток живёт дольше WriteTimeout сервера
+	p.clearWriteDeadline(c)
+
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	// клиент переподключается через retry миллисекунд
+	_, err = fmt.Fprintf(res, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	if err != nil {
+		return nil
+	}
+
+	if sub.Missed {
+		// часть событий потеряна: клиенту нужно перечитать заказы и баланс
+		_, err = io.WriteString(res, "event: reset\ndata: {}\n\n")
+		if err != nil {
+			return nil
+		}
+	}
+	for _, e := range sub.Replay {
+		err = writeEvent(res, e)
+		if err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case e, ok := <-sub.C:
+			if !ok {
+				// подписчик отстал или сервер останавливается; клиент переподключится с Last-Event-ID
+				return nil
+			}
+			err = writeEvent(res, e)
+		case <-heartbeat.C:
+			_, err = io.WriteString(res, ": ping\n\n")
+		}
+		if err != nil {
+			// клиент отключился
+			return nil
+		}
+		res.Flush()
+	}
+}
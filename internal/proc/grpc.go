@@ -0,0 +1,223 @@
+package proc
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/inkpics/gophermart/internal/grpcapi"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// домен кодов ошибок в ErrorInfo ответов gRPC
+const grpcErrorDomain = "gophermart"
+
+// методы gRPC, доступные без токена
+var grpcPublicMethods = map[string]bool{
+	"/gophermart.v1.Gophermart/Register": true,
+	"/gophermart.v1.Gophermart/Login":    true,
+}
+
+type loginKey struct{}
+
+// grpcToken возвращает токен для метаданных authorization: логин в base64 (метаданные gRPC
+// допускают только ASCII) и подпись логина, та же, что в cookie token
+func grpcToken(login, enc string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(login)) + "." + signition(login, enc)
+}
+
+func grpcLogin(token, enc string) (string, error) {
+	encoded, sign, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", fmt.Errorf("malformed token")
+	}
+
+	login, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed token: %w", err)
+	}
+	if sign != signition(string(login), enc) {
+		return "", fmt.Errorf("authentification check failed")
+	}
+
+	return string(login), nil
+}
+
+// grpcCodes сопоставляет HTTP-статусы ошибок API с кодами gRPC
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusPaymentRequired:       codes.FailedPrecondition,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.AlreadyExists,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusRequestEntityTooLarge: codes.InvalidArgument,
+}
+
+// grpcError переводит ошибку в статус gRPC; код ошибки API передаётся в ErrorInfo.Reason
+func (p *Proc) grpcError(ctx context.Context, method string, err error) error {
+	apiErr := domainError(err)
+
+	code, ok := grpcCodes[apiErr.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	if code == codes.Internal {
+		p.logger.ErrorContext(ctx, "grpc request failed", "method", method, "error", err)
+	}
+
+	st, detailsErr := status.New(code, apiErr.Detail).WithDetails(&errdetails.ErrorInfo{Reason: apiErr.Code, Domain: grpcErrorDomain})
+	if detailsErr != nil {
+		return status.Error(code, apiErr.Detail)
+	}
+	return st.Err()
+}
+
+// grpcInterceptor аутентифицирует вызовы по метаданным authorization: Bearer <token>
+// и переводит ошибки методов в статусы gRPC
+func (p *Proc) grpcInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !grpcPublicMethods[info.FullMethod] {
+		var token string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if v := md.Get("authorization"); len(v) > 0 {
+				token = strings.TrimPrefix(v[0], "Bearer ")
+			}
+		}
+
+		login, err := grpcLogin(token, p.enc)
+		if err != nil {
+			return nil, p.grpcError(ctx, info.FullMethod, newError(http.StatusUnauthorized, CodeUnauthorized, "user authentication failed", err))
+		}
+		ctx = context.WithValue(ctx, loginKey{}, login)
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, p.grpcError(ctx, info.FullMethod, err)
+	}
+	return resp, nil
+}
+
+// NewGRPCServer создаёт сервер gRPC с методами пользователя; методы используют ту же
+// бизнес-логику, что и обработчики HTTP
+func (p *Proc) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(append(opts, grpc.ChainUnaryInterceptor(p.grpcInterceptor))...)
+	grpcapi.RegisterGophermartServer(srv, &grpcServer{p: p})
+	return srv
+}
+
+type grpcServer struct {
+	grpcapi.UnimplementedGophermartServer
+	p *Proc
+}
+
+func grpcUser(ctx context.Context) string {
+	return ctx.Value(loginKey{}).(string)
+}
+
+func newOrderPB(o loyalty.Order) *grpcapi.Order {
+	return &grpcapi.Order{
+		Id:         o.ID,
+		Number:     o.Number,
+		Status:     o.Status,
+		Accrual:    formatMoney(o.Accrual),
+		UploadedAt: timestamppb.New(o.UploadedAt),
+	}
+}
+
+func (s *grpcServer) Register(ctx context.Context, in *grpcapi.Credentials) (*grpcapi.AuthResponse, error) {
+	err := s.p.loyalty.Register(ctx, in.Login, in.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcapi.AuthResponse{Token: grpcToken(in.Login, s.p.enc)}, nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, in *grpcapi.Credentials) (*grpcapi.AuthResponse, error) {
+	err := s.p.loyalty.Login(ctx, in.Login, in.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcapi.AuthResponse{Token: grpcToken(in.Login, s.p.enc)}, nil
+}
+
+func (s *grpcServer) SubmitOrder(ctx context.Context, in *grpcapi.SubmitOrderRequest) (*grpcapi.SubmitOrderResponse, error) {
+	order, created, err := s.p.loyalty.SubmitOrder(ctx, grpcUser(ctx), in.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcapi.SubmitOrderResponse{Order: newOrderPB(order), Created: created}, nil
+}
+
+func (s *grpcServer) ListOrders(ctx context.Context, _ *grpcapi.ListOrdersRequest) (*grpcapi.ListOrdersResponse, error) {
+	orders, err := s.p.loyalty.Orders(ctx, grpcUser(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &grpcapi.ListOrdersResponse{Orders: make([]*grpcapi.Order, 0, len(orders))}
+	for _, order := range orders {
+		result.Orders = append(result.Orders, newOrderPB(order))
+	}
+
+	return result, nil
+}
+
+func (s *grpcServer) balance(ctx context.Context, login string) (*grpcapi.Balance, error) {
+	balance, err := s.p.loyalty.Balance(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcapi.Balance{Current: formatMoney(balance.Current), Withdrawn: formatMoney(balance.Withdrawn)}, nil
+}
+
+func (s *grpcServer) GetBalance(ctx context.Context, _ *grpcapi.GetBalanceRequest) (*grpcapi.Balance, error) {
+	return s.balance(ctx, grpcUser(ctx))
+}
+
+func (s *grpcServer) Withdraw(ctx context.Context, in *grpcapi.WithdrawRequest) (*grpcapi.Balance, error) {
+	login := grpcUser(ctx)
+
+	sum, err := parseMoney(in.Sum)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, CodeBadRequest, "malformed sum", err)
+	}
+
+	err = s.p.loyalty.Withdraw(ctx, login, in.Order, sum)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.balance(ctx, login)
+}
+
+func (s *grpcServer) ListWithdrawals(ctx context.Context, _ *grpcapi.ListWithdrawalsRequest) (*grpcapi.ListWithdrawalsResponse, error) {
+	withdrawals, err := s.p.loyalty.Withdrawals(ctx, grpcUser(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &grpcapi.ListWithdrawalsResponse{Withdrawals: make([]*grpcapi.Withdrawal, 0, len(withdrawals))}
+	for _, withdraw := range withdrawals {
+		result.Withdrawals = append(result.Withdrawals, &grpcapi.Withdrawal{
+			Id:          withdraw.ID,
+			Order:       withdraw.OrderNumber,
+			Sum:         formatMoney(withdraw.Sum),
+			ProcessedAt: timestamppb.New(withdraw.ProcessedAt),
+		})
+	}
+
+	return result, nil
+}
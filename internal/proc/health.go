@@ -0,0 +1,153 @@
+package proc
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/breaker"
+	"github.com/inkpics/gophermart/internal/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// время на проверку зависимостей в /readyz и /status
+const healthTimeout = 2 * time.Second
+
+type checkJSON struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readyJSON struct {
+	Status string               `json:"status"`
+	Checks map[string]checkJSON `json:"checks"`
+}
+
+func (p *Proc) Healthz(c echo.Context) error {
+	// StatusOK 200 — процесс жив
+
+	return c.String(http.StatusOK, "ok")
+}
+
+func (p *Proc) MetricsHandler(c echo.Context) error {
+	// StatusOK 200 — метрики в формате Prometheus
+
+	p.metrics.Handler().ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// checks проверяет базу данных, версию схемы и состояние автомата защиты системы расчёта.
+// Разомкнутый автомат не делает сервис неготовым: пользовательские запросы обслуживаются
+// и без системы расчёта, поэтому он помечается как degraded. /readyz и /status доступны без
+// авторизации, поэтому текст ошибок только пишется в журнал и в ответ не попадает.
+func (p *Proc) checks(ctx context.Context) (bool, map[string]checkJSON) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	ready := true
+	result := make(map[string]checkJSON)
+
+	err := p.storage.Ping(ctx)
+	if err != nil {
+		p.logger.WarnContext(ctx, "health check: database ping", "error", err)
+		ready = false
+		result["database"] = checkJSON{Status: "fail", Error: "database is unreachable"}
+	} else {
+		result["database"] = checkJSON{Status: "ok"}
+	}
+
+	version, err := p.storage.Version(ctx)
+	if err != nil {
+		p.logger.WarnContext(ctx, "health check: schema version", "error", err)
+	}
+	result["migrations"] = schemaCheck(version, err)
+	if result["migrations"].Status != "ok" {
+		ready = false
+	}
+
+	switch p.breaker.State() {
+	case breaker.Closed:
+		result["accrual"] = checkJSON{Status: "ok"}
+	default:
+		result["accrual"] = checkJSON{Status: "degraded", Error: "circuit breaker is " + p.breaker.State().String()}
+	}
+
+	return ready, result
+}
+
+// schemaCheck проверяет версию схемы базы данных. Схема новее SchemaVersion допустима: при
+// поэтапном обновлении её уже мигрировал экземпляр новой версии, а миграции обратно совместимы.
+func schemaCheck(version int, err error) checkJSON {
+	switch {
+	case err != nil:
+		return checkJSON{Status: "fail", Error: "schema version is unknown"}
+	case version < storage.SchemaVersion:
+		return checkJSON{Status: "fail", Error: "schema is not migrated"}
+	}
+	return checkJSON{Status: "ok"}
+}
+
+func (p *Proc) Readyz(c echo.Context) error {
+	// StatusOK 200 — сервис готов принимать запросы
+	// StatusServiceUnavailable 503 — база данных недоступна или схема не обновлена
+
+	ready, checks := p.checks(c.Request().Context())
+	if !ready {
+		return c.JSON(http.StatusServiceUnavailable, readyJSON{Status: "fail", Checks: checks})
+	}
+
+	return c.JSON(http.StatusOK, readyJSON{Status: "ok", Checks: checks})
+}
+
+type databaseStatusJSON struct {
+	OpenConnections int   `json:"open_connections"`
+	InUse           int   `json:"in_use"`
+	Idle            int   `json:"idle"`
+	WaitCount       int64 `json:"wait_count"`
+	WaitDuration    int64 `json:"wait_duration_ms"`
+}
+
+type statusJSON struct {
+	Status     string               `json:"status"`
+	StartedAt  time.Time            `json:"started_at"`
+	Uptime     string               `json:"uptime"`
+	GoVersion  string               `json:"go_version"`
+	Goroutines int                  `json:"goroutines"`
+	Checks     map[string]checkJSON `json:"checks"`
+	Database   databaseStatusJSON   `json:"database"`
+	Accrual    breaker.Snapshot     `json:"accrual"`
+}
+
+func (p *Proc) Status(c echo.Context) error {
+	// StatusOK 200 — сервис готов принимать запросы
+	// StatusUnauthorized 401 — администратор не аутентифицирован
+	// StatusServiceUnavailable 503 — база данных недоступна или схема не обновлена
+
+	ready, checks := p.checks(c.Request().Context())
+
+	stats := p.storage.Stats()
+	result := statusJSON{
+		Status:     "ok",
+		StartedAt:  p.startedAt,
+		Uptime:     time.Since(p.startedAt).Round(time.Second).String(),
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		Checks:     checks,
+		Database: databaseStatusJSON{
+			OpenConnections: stats.OpenConnections,
+			InUse:           stats.InUse,
+			Idle:            stats.Idle,
+			WaitCount:       stats.WaitCount,
+			WaitDuration:    stats.WaitDuration.Milliseconds(),
+		},
+		Accrual: p.breaker.Snapshot(),
+	}
+
+	if !ready {
+		result.Status = "fail"
+		return c.JSON(http.StatusServiceUnavailable, result)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,107 @@
+package proc
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+type lotJSON struct {
+	Order     string    `json:"order"`
+	Sum       string    `json:"sum"`
+	AccruedAt time.Time `json:"accrued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newLotJSON(l loyalty.Lot) lotJSON {
+	return lotJSON{
+		Order:     l.OrderNumber,
+		Sum:       formatMoney(l.Remaining),
+		AccruedAt: l.AccruedAt.UTC(),
+		ExpiresAt: l.ExpiresAt.UTC(),
+	}
+}
+
+type expiringJSON struct {
+	Total string    `json:"total"`
+	Lots  []lotJSON `json:"lots"`
+}
+
+func (p *Proc) ExpiringBalance(c echo.Context) error {
+	// StatusOK 200 — сгорающие баллы в порядке сгорания; пустой список, если баллы не сгорают
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	lots, err := p.loyalty.ExpiringPoints(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	var total float64
+	result := expiringJSON{Lots: make([]lotJSON, 0, len(lots))}
+	for _, l := range lots {
+		total += l.Remaining
+		result.Lots = append(result.Lots, newLotJSON(l))
+	}
+	result.Total = formatMoney(total)
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// Sweeper до отмены ctx снимает истёкшие резервы и списывает сгоревшие баллы каждые sweepInterval,
+// а статусы пользователей, начисления которых вышли из окна, пересчитывает реже — каждые
+// tierSweepInterval. При запуске присваиваются статусы, заработанные без пересчёта.
+func (p *Proc) Sweeper(ctx context.Context) {
+	n, err := p.loyalty.BackfillTiers(ctx)
+	if err != nil && ctx.Err() == nil {
+		p.logger.ErrorContext(ctx, "backfill tiers", "error", err)
+	} else if n > 0 {
+		p.logger.InfoContext(ctx, "user tiers backfilled", "count", n)
+	}
+
+	ticker := time.NewTicker(p.sweepInterval)
+	defer ticker.Stop()
+	tierTicker := time.NewTicker(p.tierSweepInterval)
+	defer tierTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sweepExpired(ctx)
+		case <-tierTicker.C:
+			p.sweepTiers(ctx)
+		}
+	}
+}
+
+func (p *Proc) sweepExpired(ctx context.Context) {
+	n, err := p.loyalty.ExpireReservations(ctx)
+	if err != nil && ctx.Err() == nil {
+		p.logger.ErrorContext(ctx, "expire reservations", "error", err)
+	} else if n > 0 {
+		p.logger.InfoContext(ctx, "expired reservations released", "count", n)
+	}
+
+	n, err = p.loyalty.ExpirePoints(ctx)
+	if err != nil && ctx.Err() == nil {
+		p.logger.ErrorContext(ctx, "expire points", "error", err)
+	} else if n > 0 {
+		p.logger.InfoContext(ctx, "expired points written off", "count", n)
+	}
+}
+
+func (p *Proc) sweepTiers(ctx context.Context) {
+	n, err := p.loyalty.RecomputeTiers(ctx)
+	if err != nil && ctx.Err() == nil {
+		p.logger.ErrorContext(ctx, "recompute tiers", "error", err)
+	} else if n > 0 {
+		p.logger.InfoContext(ctx, "user tiers changed", "count", n)
+	}
+}
@@ -1,47 +1,148 @@
 package proc
 
 import (
+	"context"
 	"crypto/hmac"
-	"crypto/md5"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/inkpics/gophermart/internal/breaker"
+	"github.com/inkpics/gophermart/internal/config"
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/inkpics/gophermart/internal/metrics"
 	"github.com/inkpics/gophermart/internal/storage"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+var tracer = otel.Tracer("github.com/inkpics/gophermart/internal/proc")
+
+// допустимое расхождение времени подписи webhook с текущим временем
+const webhookMaxSkew = 5 * time.Minute
+
 type Proc struct {
-	runAddr     string
-	accrualAddr string
-	storage     *storage.Storage
-	enc         string
+	logger     *slog.Logger
+	runAddr    string
+	accrual    config.Accrual
+	adminToken string
+	shopKey    string
+	// интервал проверки истёкших резервов и сгорающих баллов
+	sweepInterval time.Duration
+	// интервал пересчёта статусов пользователей
+	tierSweepInterval time.Duration
+	storage           *storage.Storage
+	loyalty           *loyalty.Service
+	events            *events.Bus
+	breaker           *breaker.Breaker
+	metrics           *metrics.Metrics
+	client            *http.Client
+	enc               string
+	// cookie выставляются с флагом Secure, если сервис обслуживает HTTPS
+	secureCookies bool
+	startedAt     time.Time
 }
 
-func New(runAddr, databaseAddr, accrualAddr string) (*Proc, error) {
-	s, err := storage.New(databaseAddr)
+func New(ctx context.Context, logger *slog.Logger, cfg config.Config) (*Proc, error) {
+	bus := events.New(eventsHistory)
+
+	s, err := storage.New(ctx, logger, cfg.Database, cfg.Loyalty.PointsTTL, bus)
 	if err != nil {
 		return nil, fmt.Errorf("new storage: %w", err)
 	}
-	return &Proc{
-		runAddr:     runAddr,
-		accrualAddr: accrualAddr,
-		storage:     s,
-		enc:         "e0e10cbb-7713-43b4-9dc7-e198779e130c",
-	}, nil
+
+	b := breaker.New(breaker.Config{
+		FailureThreshold: cfg.Accrual.Breaker.FailureThreshold,
+		OpenTimeout:      cfg.Accrual.Breaker.OpenTimeout,
+		SuccessThreshold: cfg.Accrual.Breaker.SuccessThreshold,
+		OnStateChange: func(from, to breaker.State) {
+			logger.Warn("accrual circuit breaker state changed", "from", from.String(), "to", to.String())
+		},
+	})
+
+	l := loyalty.New(s, loyalty.Config{
+		ReservationTTL: cfg.Loyalty.ReservationTTL,
+		Tiers: loyalty.Tiers{
+			Silver:   cfg.Loyalty.TierSilver,
+			Gold:     cfg.Loyalty.TierGold,
+			Platinum: cfg.Loyalty.TierPlatinum,
+			Window:   cfg.Loyalty.TierWindow,
+		},
+	})
+
+	p := &Proc{
+		logger:            logger,
+		runAddr:           cfg.RunAddress,
+		accrual:           cfg.Accrual,
+		adminToken:        cfg.Auth.AdminToken,
+		shopKey:           cfg.Auth.ShopKey,
+		sweepInterval:     cfg.Loyalty.SweepInterval,
+		tierSweepInterval: cfg.Loyalty.TierSweepInterval,
+		storage:           s,
+		loyalty:           l,
+		events:            bus,
+		breaker:           b,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   cfg.Accrual.RequestTimeout,
+		},
+		enc:           cfg.Auth.CookieSecret,
+		secureCookies: cfg.TLS.Enabled(),
+		startedAt:     time.Now(),
+	}
+	p.metrics = metrics.New(p.stats)
+
+	return p, nil
+}
+
+func (p *Proc) Metrics() *metrics.Metrics {
+	return p.metrics
+}
+
+func (p *Proc) stats(ctx context.Context) (metrics.Stats, error) {
+	result := metrics.Stats{
+		DB:           p.storage.Stats(),
+		BreakerState: int(p.breaker.State()),
+	}
+
+	t, err := p.storage.Totals(ctx)
+	if err != nil {
+		return result, fmt.Errorf("totals: %w", err)
+	}
+
+	result.OrdersNew = t.OrdersNew
+	result.OrdersProcessing = t.OrdersProcessing
+	result.OrdersDead = t.OrdersDead
+	result.PointsAccrued = t.Accrued
+	result.PointsWithdrawn = t.Withdrawn
+	result.PointsRefunded = t.Refunded
+
+	return result, nil
+}
+
+func (p *Proc) Close() error {
+	return p.storage.Close()
 }
 
 func (p *Proc) MiddlewareAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		login, err := getLogin(c, p.enc)
 		if err != nil {
-			return c.String(http.StatusUnauthorized, "user authentication failed")
+			return newError(http.StatusUnauthorized, CodeUnauthorized, "user authentication failed", err)
 		}
 		c.Set("login", login)
 
@@ -49,16 +150,22 @@ func (p *Proc) MiddlewareAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+func (p *Proc) MiddlewareAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if p.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+			return newError(http.StatusUnauthorized, CodeUnauthorized, "admin authentication failed", nil)
+		}
+
+		return next(c)
+	}
+}
+
 type userJSON struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
-func encodePass(password string) string {
-	h := md5.Sum([]byte(password))
-	return hex.EncodeToString(h[:])
-}
-
 func (p *Proc) Register(c echo.Context) error {
 	// StatusOK 200 — пользователь успешно зарегистрирован и аутентифицирован
 	// StatusBadRequest 400 — неверный формат запроса
@@ -67,23 +174,21 @@ func (p *Proc) Register(c echo.Context) error {
 
 	body, err := io.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return fmt.Errorf("read body: %w", err)
 	}
 
 	var u userJSON
 	err = json.Unmarshal(body, &u)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request")
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
 	}
 
-	err = p.storage.UserRegister(u.Login, encodePass(u.Password))
-	if errors.Is(err, p.storage.ErrDuplicateKey) {
-		return c.String(http.StatusConflict, "login is already in use")
-	} else if err != nil {
-		return c.String(http.StatusBadRequest, "bad request")
+	err = p.loyalty.Register(c.Request().Context(), u.Login, u.Password)
+	if err != nil {
+		return err
 	}
 
-	setLogin(c, u.Login, p.enc)
+	setLogin(c, u.Login, p.enc, p.secureCookies)
 
 	return c.String(http.StatusOK, "user registered and authenticated successfully")
 }
@@ -96,48 +201,25 @@ func (p *Proc) Login(c echo.Context) error {
 
 	body, err := io.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return fmt.Errorf("read body: %w", err)
 	}
 
 	var u userJSON
 	err = json.Unmarshal(body, &u)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request")
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
 	}
 
-	err = p.storage.UserLogin(u.Login, encodePass(u.Password))
+	err = p.loyalty.Login(c.Request().Context(), u.Login, u.Password)
 	if err != nil {
-		return c.String(http.StatusUnauthorized, "wrong credentials")
+		return err
 	}
 
-	setLogin(c, u.Login, p.enc)
+	setLogin(c, u.Login, p.enc, p.secureCookies)
 
 	return c.String(http.StatusOK, "user authenticated successfully")
 }
 
-func validateLuhn(number int) bool {
-	return (number%10+checksumLuhn(number/10))%10 == 0
-}
-
-func checksumLuhn(number int) int {
-	var luhn int
-
-	for i := 0; number > 0; i++ {
-		cur := number % 10
-
-		if i%2 == 0 {
-			cur = cur * 2
-			if cur > 9 {
-				cur = cur%10 + cur/10
-			}
-		}
-
-		luhn += cur
-		number = number / 10
-	}
-	return luhn % 10
-}
-
 func (p *Proc) SetOrders(c echo.Context) error {
 	// StatusOK 200 — номер заказа уже был загружен этим пользователем
 	// StatusAccepted 202 — новый номер заказа принят в обработку
@@ -151,33 +233,16 @@ func (p *Proc) SetOrders(c echo.Context) error {
 
 	body, err := io.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return fmt.Errorf("read body: %w", err)
 	}
 
-	order := string(body)
-	orderInt, err := strconv.Atoi(order)
+	_, created, err := p.loyalty.SubmitOrder(c.Request().Context(), login, string(body))
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request")
-	}
-
-	if !validateLuhn(orderInt) {
-		return c.String(http.StatusUnprocessableEntity, "incorrect order number")
+		return err
 	}
-
-	registered, err := p.storage.OrderRegistered(login, order)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
-	}
-	if registered == -1 {
-		return c.String(http.StatusConflict, "order registered by another user")
-	} else if registered == 1 {
+	if !created {
 		return c.String(http.StatusOK, "order already registered")
 	}
-
-	err = p.storage.OrderRegister(login, order)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
-	}
 	return c.String(http.StatusAccepted, "order registered successfully")
 }
 
@@ -196,11 +261,11 @@ func (p *Proc) Orders(c echo.Context) error {
 
 	login := c.Get("login").(string)
 
-	orders, err := p.storage.Orders(login)
+	orders, err := p.loyalty.Orders(c.Request().Context(), login)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return err
 	}
-	if orders == nil {
+	if len(orders) == 0 {
 		return c.String(http.StatusNoContent, "user has no orders")
 	}
 
@@ -210,16 +275,20 @@ func (p *Proc) Orders(c echo.Context) error {
 		item.Number = order.Number
 		item.Status = order.Status
 		item.Accrual = order.Accrual
-		item.UploadedAt = order.UploadedAt
+		item.UploadedAt = order.UploadedAt.Format(time.RFC3339Nano)
 		arr = append(arr, item)
 	}
 
 	return c.JSON(http.StatusOK, arr)
 }
 
+// balanceJSON — баланс пользователя; current включает зарезервированные баллы reserved,
+// списать можно available
 type balanceJSON struct {
 	Current   float64 `json:"current"`
 	Withdrawn float64 `json:"withdrawn"`
+	Available float64 `json:"available"`
+	Reserved  float64 `json:"reserved"`
 }
 
 func (p *Proc) Balance(c echo.Context) error {
@@ -229,14 +298,16 @@ func (p *Proc) Balance(c echo.Context) error {
 
 	login := c.Get("login").(string)
 
-	balance, err := p.storage.UserBalance(login)
+	balance, err := p.loyalty.Balance(c.Request().Context(), login)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return err
 	}
 
 	var result balanceJSON
 	result.Current = balance.Current
 	result.Withdrawn = balance.Withdrawn
+	result.Available = balance.Available()
+	result.Reserved = balance.Reserved
 
 	return c.JSON(http.StatusOK, result)
 }
@@ -250,6 +321,7 @@ func (p *Proc) Withdraw(c echo.Context) error {
 	// StatusOK 200 — успешная обработка запроса
 	// StatusUnauthorized 401 — пользователь не авторизован
 	// StatusPaymentRequired 402 — на счету недостаточно средств
+	// StatusConflict 409 — в счёт заказа уже есть списание или активный резерв
 	// StatusUnprocessableEntity 422 — неверный номер заказа
 	// StatusInternalServerError 500 — внутренняя ошибка сервера
 
@@ -257,30 +329,18 @@ func (p *Proc) Withdraw(c echo.Context) error {
 
 	body, err := io.ReadAll(c.Request().Body)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return fmt.Errorf("read body: %w", err)
 	}
 
 	var w withdrawJSON
 	err = json.Unmarshal(body, &w)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request")
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
 	}
 
-	orderInt, err := strconv.Atoi(w.Order)
+	err = p.loyalty.Withdraw(c.Request().Context(), login, w.Order, w.Sum)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request")
-	}
-
-	if !validateLuhn(orderInt) {
-		return c.String(http.StatusUnprocessableEntity, "incorrect order number")
-	}
-
-	withdraw, err := p.storage.Withdraw(login, w.Order, w.Sum)
-	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
-	}
-	if withdraw == 402 {
-		return c.String(http.StatusPaymentRequired, "not enough cash")
+		return err
 	}
 
 	return c.String(http.StatusOK, "successfull withdraw")
@@ -290,6 +350,14 @@ type withdrawalsJSONItem struct {
 	OrderNumber string  `json:"order"`
 	Sum         float64 `json:"sum"`
 	ProcessedAt string  `json:"processed_at"`
+	// возвраты выводятся только у списаний, по которым они были
+	Refunded float64                `json:"refunded,omitempty"`
+	Refunds  []withdrawalRefundJSON `json:"refunds,omitempty"`
+}
+
+type withdrawalRefundJSON struct {
+	Sum         float64 `json:"sum"`
+	ProcessedAt string  `json:"processed_at"`
 }
 
 func (p *Proc) Withdrawals(c echo.Context) error {
@@ -300,11 +368,11 @@ func (p *Proc) Withdrawals(c echo.Context) error {
 
 	login := c.Get("login").(string)
 
-	withdrawals, err := p.storage.Withdrawals(login)
+	withdrawals, err := p.loyalty.Withdrawals(c.Request().Context(), login)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "internal server error")
+		return err
 	}
-	if withdrawals == nil {
+	if len(withdrawals) == 0 {
 		return c.String(http.StatusNoContent, "user has no withdrawals")
 	}
 
@@ -313,13 +381,154 @@ func (p *Proc) Withdrawals(c echo.Context) error {
 		item := withdrawalsJSONItem{}
 		item.OrderNumber = withdraw.OrderNumber
 		item.Sum = withdraw.Sum
-		item.ProcessedAt = withdraw.ProcessedAt
+		item.ProcessedAt = withdraw.ProcessedAt.Format(time.RFC3339Nano)
+		item.Refunded = withdraw.Refunded()
+		for _, refund := range withdraw.Refunds {
+			item.Refunds = append(item.Refunds, withdrawalRefundJSON{Sum: refund.Sum, ProcessedAt: refund.ProcessedAt.Format(time.RFC3339Nano)})
+		}
+		arr = append(arr, item)
+	}
+
+	return c.JSON(http.StatusOK, arr)
+}
+
+type deadOrderJSONItem struct {
+	Number     string `json:"number"`
+	Login      string `json:"login"`
+	Attempts   int    `json:"attempts"`
+	LastError  string `json:"last_error"`
+	UploadedAt string `json:"uploaded_at"`
+}
+
+func (p *Proc) DeadOrders(c echo.Context) error {
+	// StatusOK 200 — успешная обработка запроса
+	// StatusNoContent 204 — нет заказов, исчерпавших попытки расчёта
+	// StatusUnauthorized 401 — администратор не аутентифицирован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	orders, err := p.storage.OrdersDead(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("list dead orders: %w", err)
+	}
+	if orders == nil {
+		return c.String(http.StatusNoContent, "no dead orders")
+	}
+
+	var arr []deadOrderJSONItem
+	for _, order := range orders {
+		item := deadOrderJSONItem{}
+		item.Number = order.Number
+		item.Login = order.Login
+		item.Attempts = order.Attempts
+		item.LastError = order.LastError
+		item.UploadedAt = order.UploadedAt
 		arr = append(arr, item)
 	}
 
 	return c.JSON(http.StatusOK, arr)
 }
 
+func (p *Proc) RequeueOrder(c echo.Context) error {
+	// StatusOK 200 — заказ возвращён в очередь расчёта
+	// StatusUnauthorized 401 — администратор не аутентифицирован
+	// StatusNotFound 404 — заказ не найден среди исчерпавших попытки
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	number, err := loyalty.NormalizeOrderNumber(c.Param("number"))
+	if err != nil {
+		return newError(http.StatusNotFound, CodeNotFound, "dead order not found", err)
+	}
+
+	err = p.storage.RequeueOrder(c.Request().Context(), number)
+	if errors.Is(err, storage.ErrNotFound) {
+		return newError(http.StatusNotFound, CodeNotFound, "dead order not found", err)
+	} else if err != nil {
+		return fmt.Errorf("requeue order: %w", err)
+	}
+
+	return c.String(http.StatusOK, "order requeued")
+}
+
+// verifyWebhook проверяет подпись X-Accrual-Signature: hex(HMAC-SHA256(key, timestamp + "." + body)),
+// где timestamp — значение X-Accrual-Timestamp в секундах Unix
+func verifyWebhook(key, timestamp, signature string, body []byte, now time.Time) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > webhookMaxSkew || skew < -webhookMaxSkew {
+		return false
+	}
+
+	sign, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	hm := hmac.New(sha256.New, []byte(key))
+	hm.Write([]byte(timestamp))
+	hm.Write([]byte("."))
+	hm.Write(body)
+	return hmac.Equal(sign, hm.Sum(nil))
+}
+
+func (p *Proc) AccrualWebhook(c echo.Context) error {
+	// StatusOK 200 — результат расчёта принят
+	// StatusBadRequest 400 — неверный формат запроса
+	// StatusUnauthorized 401 — неверная или просроченная подпись
+	// StatusNotFound 404 — заказ не зарегистрирован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	timestamp := c.Request().Header.Get("X-Accrual-Timestamp")
+	signature := c.Request().Header.Get("X-Accrual-Signature")
+	if p.accrual.WebhookKey == "" || !verifyWebhook(p.accrual.WebhookKey, timestamp, signature, body, time.Now()) {
+		return newError(http.StatusUnauthorized, CodeInvalidSignature, "signature check failed", nil)
+	}
+
+	var a accrualJSON
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+	}
+
+	number, err := loyalty.NormalizeOrderNumber(a.OrderNumber)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed order number", err)
+	}
+
+	_, err = p.storage.UserFromOrderNumber(c.Request().Context(), number)
+	if errors.Is(err, storage.ErrNotFound) {
+		return newError(http.StatusNotFound, CodeNotFound, "order not found", err)
+	} else if err != nil {
+		return fmt.Errorf("find order: %w", err)
+	}
+
+	err = p.applyAccrual(c.Request().Context(), number, a.Status, a.Accrual)
+	if err != nil {
+		return fmt.Errorf("apply accrual: %w", err)
+	}
+
+	return c.String(http.StatusOK, "accrual accepted")
+}
+
+func (p *Proc) AccrualBreaker() breaker.Snapshot {
+	return p.breaker.Snapshot()
+}
+
+func (p *Proc) AccrualStatus(c echo.Context) error {
+	// StatusOK 200 — успешная обработка запроса
+	// StatusUnauthorized 401 — администратор не аутентифицирован
+
+	return c.JSON(http.StatusOK, p.AccrualBreaker())
+}
+
 func signition(person, enc string) string {
 	hm := hmac.New(sha256.New, []byte(enc))
 	hm.Write([]byte(person))
@@ -344,14 +553,26 @@ func cookie(c echo.Context, name, val string) (string, error) {
 	return "", nil
 }
 
-func setLogin(c echo.Context, login, enc string) {
+// setCookie выставляет cookie сессии; secure включается, когда сервис отдаётся по HTTPS
+func setCookie(c echo.Context, name, val string, secure bool) {
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    val,
+		Path:     "/",
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func setLogin(c echo.Context, login, enc string, secure bool) {
 	token, err := cookie(c, "token", "")
 	if err == nil && token == signition(login, enc) {
 		return
 	}
 
-	cookie(c, "person", login)
-	cookie(c, "token", signition(login, enc))
+	setCookie(c, "person", login, secure)
+	setCookie(c, "token", signition(login, enc), secure)
 }
 
 func getLogin(c echo.Context, enc string) (string, error) {
@@ -364,65 +585,227 @@ func getLogin(c echo.Context, enc string) (string, error) {
 	return login, fmt.Errorf("authentification check failed")
 }
 
-func (p *Proc) AccrualLoop() {
+// AccrualLoop опрашивает систему расчёта начислений до отмены ctx
+func (p *Proc) AccrualLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.accrual.PollInterval)
+	defer ticker.Stop()
+
 	for {
-		p.UpdateAccrual()
-		time.Sleep(3 * time.Second)
+		err := p.UpdateAccrual(ctx)
+		if err != nil && ctx.Err() == nil {
+			p.logger.ErrorContext(ctx, "update accrual", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func (p *Proc) UpdateAccrual() error {
-	orders, err := p.storage.OrdersProcessing()
+func (p *Proc) UpdateAccrual(ctx context.Context) (err error) {
+	if p.breaker.State() == breaker.Open {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "UpdateAccrual")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	orders, err := p.storage.OrdersProcessing(ctx)
 	if err != nil {
 		return fmt.Errorf("update accrual error: %w", err)
 	}
+	span.SetAttributes(attribute.Int("orders", len(orders)))
 
 	for _, order := range orders {
-		status, accrual, timeout, err := p.Accrual(order.Number)
-		if err != nil {
-			return fmt.Errorf("update accrual order error: %w", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		if timeout != "" {
-			retry, err := strconv.Atoi(timeout)
+
+		status, accrual, timeout, err := p.Accrual(ctx, order.Number)
+		if errors.Is(err, breaker.ErrOpen) {
+			p.metrics.AccrualPoll("breaker_open")
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			p.metrics.AccrualPoll("error")
+			err = p.accrualFailed(ctx, order.Number, order.Attempts+1, err)
 			if err != nil {
-				return fmt.Errorf("accrual retry-timeout error: %w", err)
+				return fmt.Errorf("update accrual order error: %w", err)
 			}
-			time.Sleep(time.Duration(retry) * time.Second)
 			continue
 		}
-
-		if status == "INVALID" {
-			err = p.storage.SetOrderInvalid(order.Number)
+		if timeout != "" {
+			p.metrics.AccrualPoll("throttled")
+			retry, err := retryAfter(timeout, time.Now())
 			if err != nil {
-				return fmt.Errorf("set order invalid error: %w", err)
+				p.logger.WarnContext(ctx, "malformed accrual Retry-After", "retry_after", timeout, "retry_in", retry, "error", err)
 			}
-		} else if status == "PROCESSED" {
-			err = p.storage.SetOrderProcessed(order.Number, accrual)
-			if err != nil {
-				return fmt.Errorf("set order processed error: %w", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retry):
 			}
+			continue
+		}
+
+		p.metrics.AccrualPoll(status)
+		err = p.applyAccrual(ctx, order.Number, status, accrual)
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// applyAccrual сохраняет результат расчёта, полученный опросом системы начислений или через webhook
+func (p *Proc) applyAccrual(ctx context.Context, orderNumber, status string, accrual float64) error {
+	if status == "INVALID" {
+		err := p.storage.SetOrderInvalid(ctx, orderNumber)
+		if err != nil {
+			return fmt.Errorf("set order invalid error: %w", err)
+		}
+	} else if status == "PROCESSED" {
+		changed, err := p.storage.SetOrderProcessed(ctx, orderNumber, accrual)
+		if err != nil {
+			return fmt.Errorf("set order processed error: %w", err)
+		}
+		// повторный результат по обработанному заказу (опрос и webhook) статус не меняет
+		if changed {
+			p.recomputeTier(ctx, orderNumber)
+		}
+	}
+
+	return nil
+}
+
+// recomputeTier пересчитывает статус владельца обработанного заказа. Начисление уже сохранено,
+// поэтому ошибка только записывается в журнал: статус пересчитается при следующем начислении.
+func (p *Proc) recomputeTier(ctx context.Context, orderNumber string) {
+	login, err := p.storage.UserFromOrderNumber(ctx, orderNumber)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "recompute tier", "order", orderNumber, "error", err)
+		return
+	}
+
+	change, changed, err := p.loyalty.RecomputeTier(ctx, login)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "recompute tier", "order", orderNumber, "error", err)
+	} else if changed {
+		p.logger.InfoContext(ctx, "user tier changed", "login", login, "tier", change.Tier, "previous", change.Previous)
+	}
+}
+
+func (p *Proc) accrualFailed(ctx context.Context, orderNumber string, attempts int, cause error) error {
+	if attempts >= p.accrual.MaxAttempts {
+		p.logger.ErrorContext(ctx, "accrual attempts exhausted, order moved to dead letters", "order", orderNumber, "attempts", attempts, "error", cause)
+		return p.storage.SetOrderDead(ctx, orderNumber, attempts, cause.Error())
+	}
+
+	delay := backoff(attempts, p.accrual.BaseDelay, p.accrual.MaxDelay)
+	p.logger.WarnContext(ctx, "accrual lookup failed", "order", orderNumber, "attempts", attempts, "retry_in", delay, "error", cause)
+	return p.storage.SetOrderRetry(ctx, orderNumber, attempts, time.Now().Add(delay), cause.Error())
+}
+
+// backoff возвращает задержку перед следующей попыткой: экспоненциальный рост от base
+// до max со случайным разбросом в верхней половине интервала
+func backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := max
+	if attempts < 32 {
+		if d := base << (attempts - 1); d > 0 && d < max {
+			delay = d
+		}
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// defaultRetryAfter — пауза после ответа 429 с заголовком Retry-After, который не удалось разобрать;
+// система расчёта обычно просит подождать минуту
+const defaultRetryAfter = time.Minute
+
+// retryAfter разбирает заголовок Retry-After в секундах или в виде даты HTTP. Если заголовок
+// не разобран, возвращается defaultRetryAfter вместе с ошибкой.
+func retryAfter(header string, now time.Time) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return defaultRetryAfter, fmt.Errorf("negative retry-after %d", seconds)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return defaultRetryAfter, fmt.Errorf("parse retry-after: %w", err)
+	}
+	if d := at.Sub(now); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+// accrualNotRegistered — статус заказа, который система расчёта ещё не зарегистрировала (ответ 204):
+// заказ опрашивается снова, как и заказы в обработке, без учёта попытки
+const accrualNotRegistered = "NOT_REGISTERED"
+
 type accrualJSON struct {
 	OrderNumber string  `json:"order"`
 	Status      string  `json:"status"`
 	Accrual     float64 `json:"accrual"`
 }
 
-func (p *Proc) Accrual(orderNumber string) (string, float64, string, error) {
-	resp, err := http.Get(p.accrualAddr + "/api/orders/" + orderNumber)
+func (p *Proc) Accrual(ctx context.Context, orderNumber string) (string, float64, string, error) {
+	ctx, span := tracer.Start(ctx, "Accrual")
+	defer span.End()
+	span.SetAttributes(attribute.String("order.number", orderNumber))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.accrual.Address+"/api/orders/"+orderNumber, nil)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("accrual error: %w", err)
+	}
+
+	if !p.breaker.Allow() {
+		return "", 0, "", breaker.ErrOpen
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		// остановка сервиса ничего не говорит о состоянии системы расчёта
+		p.breaker.Release()
+		return "", 0, "", ctx.Err()
+	}
 	if err != nil {
+		p.breaker.Failure()
 		return "", 0, "", fmt.Errorf("accrual error: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		p.breaker.Failure()
+		return "", 0, "", fmt.Errorf("accrual error: unexpected status %d", resp.StatusCode)
+	}
+	p.breaker.Success()
+
 	if resp.StatusCode == http.StatusTooManyRequests {
 		return "", 0, resp.Header.Get("Retry-After"), nil
 	}
+	if resp.StatusCode == http.StatusNoContent {
+		return accrualNotRegistered, 0, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, "", fmt.Errorf("accrual error: unexpected status %d", resp.StatusCode)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
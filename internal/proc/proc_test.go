@@ -1,18 +1,53 @@
 package proc
 
 import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/inkpics/gophermart/internal/accrualfake"
+	"github.com/inkpics/gophermart/internal/breaker"
+	"github.com/inkpics/gophermart/internal/config"
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/grpcapi"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/inkpics/gophermart/internal/openapi"
+	"github.com/inkpics/gophermart/internal/storage"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
+func testConfig() config.Config {
+	cfg := config.Default()
+	cfg.Database.URI = "host=localhost port=54320 user=postgres password=postgres dbname=postgres sslmode=disable"
+	return cfg
+}
+
 func TestProc_Register(t *testing.T) {
-	p, err := New("localhost:8080", "host=localhost port=54320 user=postgres password=postgres dbname=postgres sslmode=disable", "")
+	p, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), testConfig())
 	if err != nil {
 		t.Fatalf("could not init test: %v", err)
 	}
@@ -46,12 +81,13 @@ func TestProc_Register(t *testing.T) {
 }
 
 func TestProc_Login(t *testing.T) {
-	p, err := New("localhost:8080", "host=localhost port=54320 user=postgres password=postgres dbname=postgres sslmode=disable", "")
+	p, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), testConfig())
 	if err != nil {
 		t.Fatalf("could not init test: %v", err)
 	}
 
 	e := echo.New()
+	e.HTTPErrorHandler = p.HTTPErrorHandler
 	str := "{\"login\":\"test\",\"password\":\"test\"}"
 	request := httptest.NewRequest(http.MethodPost, "http://localhost:8080/api/user/register", strings.NewReader(str))
 
@@ -89,7 +125,9 @@ func TestProc_Login(t *testing.T) {
 
 	recorder = httptest.NewRecorder()
 	c = e.NewContext(request, recorder)
-	p.Login(c)
+	if err := p.Login(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
 
 	result = recorder.Result()
 	defer result.Body.Close()
@@ -103,46 +141,1479 @@ func TestProc_Login(t *testing.T) {
 		t.Errorf("could not read response: %v", err)
 	}
 
-	got = string(body)
-	want = "wrong credentials"
-	if got != want {
-		t.Errorf("expected answer to be %v; got %v", want, got)
+	if ct := result.Header.Get(echo.HeaderContentType); !strings.HasPrefix(ct, problemContentType) {
+		t.Errorf("expected content type %v; got %v", problemContentType, ct)
+	}
+
+	var problem problemJSON
+	err = json.Unmarshal(body, &problem)
+	if err != nil {
+		t.Fatalf("could not decode problem: %v", err)
+	}
+	if problem.Code != CodeWrongCredentials {
+		t.Errorf("expected code %v; got %v", CodeWrongCredentials, problem.Code)
+	}
+}
+
+// luhnNumber возвращает случайный номер заказа с верной контрольной суммой: тесты с базой
+// данных не должны пересекаться с заказами прошлых запусков
+func luhnNumber(prefix string) string {
+	number := prefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	for d := 0; ; d++ {
+		if candidate := number + strconv.Itoa(d); loyalty.ValidateLuhn(candidate) {
+			return candidate
+		}
+	}
+}
+
+func TestProc_AccrualRetry(t *testing.T) {
+	ctx := context.Background()
+	number := luhnNumber("")
+
+	// ответ системы расчёта для number; остальные заказы из общей базы получают 204
+	var status atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/orders/"+number {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		switch code := int(status.Load()); code {
+		case http.StatusOK:
+			w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			fmt.Fprintf(w, `{"order":%q,"status":"PROCESSED","accrual":100}`, number)
+		default:
+			w.WriteHeader(code)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig()
+	cfg.Accrual.Address = srv.URL
+	cfg.Accrual.MaxAttempts = 2
+	cfg.Accrual.BaseDelay = time.Millisecond
+	cfg.Accrual.MaxDelay = time.Millisecond
+	cfg.Accrual.Breaker.FailureThreshold = 100
+	p, err := New(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+	if err != nil {
+		t.Fatalf("could not init test: %v", err)
+	}
+	defer p.Close()
+
+	login := uuid.NewString()
+	err = p.loyalty.Register(ctx, login, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = p.loyalty.SubmitOrder(ctx, login, number)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// после неудачной попытки заказ возвращается в очередь через BaseDelay
+	wait := func() { time.Sleep(10 * time.Millisecond) }
+	poll := func(code int) {
+		t.Helper()
+		status.Store(int32(code))
+		wait()
+		err := p.UpdateAccrual(ctx)
+		if err != nil {
+			t.Fatalf("update accrual: %v", err)
+		}
+	}
+	attempts := func() int {
+		t.Helper()
+		wait()
+		orders, err := p.storage.OrdersProcessing(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range orders {
+			if o.Number == number {
+				return o.Attempts
+			}
+		}
+		t.Fatalf("order %s is not queued for accrual", number)
+		return 0
+	}
+	dead := func() bool {
+		t.Helper()
+		orders, err := p.storage.OrdersDead(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range orders {
+			if o.Number == number {
+				return true
+			}
+		}
+		return false
+	}
+
+	poll(http.StatusNoContent)
+	if got := attempts(); got != 0 {
+		t.Errorf("expected unregistered order to keep 0 attempts; got %d", got)
+	}
+
+	poll(http.StatusInternalServerError)
+	if got := attempts(); got != 1 {
+		t.Errorf("expected 1 attempt after a failed lookup; got %d", got)
+	}
+	poll(http.StatusInternalServerError)
+	if !dead() {
+		t.Fatalf("expected order to be dead-lettered after %d attempts", cfg.Accrual.MaxAttempts)
+	}
+
+	requeue := func(number string) error {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/api/admin/orders/"+number+"/requeue", nil), httptest.NewRecorder())
+		c.SetParamNames("number")
+		c.SetParamValues(number)
+		return p.RequeueOrder(c)
+	}
+	err = requeue(number)
+	if err != nil {
+		t.Fatalf("requeue order: %v", err)
+	}
+	if dead() {
+		t.Errorf("expected requeued order to leave dead letters")
+	}
+	if got := attempts(); got != 0 {
+		t.Errorf("expected requeued order to have 0 attempts; got %d", got)
+	}
+
+	var apiErr *Error
+	err = requeue(number)
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		t.Errorf("expected 404 for an order that is not dead; got %v", err)
+	}
+
+	poll(http.StatusOK)
+	b, err := p.loyalty.Balance(ctx, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Current != 100 {
+		t.Errorf("expected requeued order to be accrued; got balance %+v", b)
 	}
 }
 
-func Test_validateLuhn(t *testing.T) {
+func TestProc_AccrualLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	processed, invalid, failing := luhnNumber("1"), luhnNumber("9"), luhnNumber("2")
+	fake := accrualfake.New(accrualfake.Config{Rules: []accrualfake.Rule{{Reward: 10}, {Prefix: "9", InvalidRatio: 1}}}).Handler()
+
+	// перед фейком: первый запрос получает 429, failing — 503, заказы из общей базы, кроме
+	// заказов теста, — 204
+	var throttled atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		switch {
+		case throttled.CompareAndSwap(false, true):
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case number == failing:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case number == processed || number == invalid:
+			fake.ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig()
+	cfg.Accrual.Address = srv.URL
+	cfg.Accrual.PollInterval = 20 * time.Millisecond
+	cfg.Accrual.MaxAttempts = 2
+	cfg.Accrual.BaseDelay = time.Millisecond
+	cfg.Accrual.MaxDelay = time.Millisecond
+	cfg.Accrual.Breaker.FailureThreshold = 100
+	p, err := New(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+	if err != nil {
+		t.Fatalf("could not init test: %v", err)
+	}
+	defer p.Close()
+
+	login := uuid.NewString()
+	err = p.loyalty.Register(ctx, login, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []string{processed, invalid, failing} {
+		_, _, err = p.loyalty.SubmitOrder(ctx, login, number)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loopCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go p.AccrualLoop(loopCtx)
+
+	done := func() bool {
+		orders, err := p.loyalty.Orders(ctx, login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := make(map[string]string)
+		for _, o := range orders {
+			statuses[o.Number] = o.Status
+		}
+		if statuses[processed] != "PROCESSED" || statuses[invalid] != "INVALID" {
+			return false
+		}
+
+		dead, err := p.storage.OrdersDead(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range dead {
+			if o.Number == failing {
+				return o.Attempts == cfg.Accrual.MaxAttempts
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("accrual loop did not settle the orders in time")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if !throttled.Load() {
+		t.Error("expected the loop to be throttled once")
+	}
+	b, err := p.loyalty.Balance(ctx, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Current != 100 {
+		t.Errorf("expected balance 100 for the processed order; got %+v", b)
+	}
+}
+
+func Test_Accrual(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/orders/") {
+		case "1":
+			w.WriteHeader(http.StatusNoContent)
+		case "2":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "3":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, `{"order":"4","status":"PROCESSED","accrual":500}`)
+		}
+	}))
+	defer srv.Close()
+
+	p := &Proc{
+		accrual: config.Accrual{Address: srv.URL},
+		breaker: breaker.New(breaker.Config{}),
+		client:  srv.Client(),
+	}
+
+	tests := []struct {
+		number  string
+		status  string
+		timeout string
+		wantErr bool
+	}{
+		{number: "1", status: accrualNotRegistered},
+		{number: "2", timeout: "60"},
+		{number: "3", wantErr: true},
+		{number: "4", status: "PROCESSED"},
+	}
+	for _, tt := range tests {
+		status, _, timeout, err := p.Accrual(context.Background(), tt.number)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Accrual(%s) error = %v, wantErr %v", tt.number, err, tt.wantErr)
+		}
+		if status != tt.status || timeout != tt.timeout {
+			t.Errorf("Accrual(%s) = %q, %q; want %q, %q", tt.number, status, timeout, tt.status, tt.timeout)
+		}
+	}
+}
+
+func Test_retryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
 	tests := []struct {
-		number int
-		want   bool
+		header  string
+		want    time.Duration
+		wantErr bool
 	}{
-		{number: 125764357, want: true},
-		{number: 5347754565, want: true},
-		{number: 87643, want: true},
-		{number: 45678976, want: true},
-		{number: 6432964973280, want: false},
-		{number: 1791238908321, want: false},
+		{header: "60", want: time.Minute},
+		{header: "0", want: 0},
+		{header: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second},
+		{header: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{header: "-5", want: defaultRetryAfter, wantErr: true},
+		{header: "soon", want: defaultRetryAfter, wantErr: true},
 	}
 	for _, tt := range tests {
-		if got := validateLuhn(tt.number); got != tt.want {
-			t.Errorf("validateLuhn() = %v, want %v", got, tt.want)
+		got, err := retryAfter(tt.header, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("retryAfter(%q) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("retryAfter(%q) = %v; want %v", tt.header, got, tt.want)
 		}
 	}
 }
 
-func Test_checksumLuhn(t *testing.T) {
+func Test_backoff(t *testing.T) {
+	base := 3 * time.Second
+	max := 30 * time.Minute
+
 	tests := []struct {
-		number int
-		want   int
+		attempts int
+		min      time.Duration
+		max      time.Duration
 	}{
-		{number: 6478234230, want: 7},
-		{number: 8907654355, want: 5},
-		{number: 1209374734, want: 2},
-		{number: 7453126346, want: 0},
-		{number: 9740174550, want: 4},
+		{attempts: 1, min: base / 2, max: base},
+		{attempts: 2, min: base, max: 2 * base},
+		{attempts: 5, min: 8 * base, max: 16 * base},
+		{attempts: 20, min: max / 2, max: max},
+		{attempts: 100, min: max / 2, max: max},
 	}
 	for _, tt := range tests {
-		if got := checksumLuhn(tt.number); got != tt.want {
-			t.Errorf("checksumLuhn() = %v, want %v", got, tt.want)
+		for i := 0; i < 100; i++ {
+			if got := backoff(tt.attempts, base, max); got < tt.min || got > tt.max {
+				t.Errorf("backoff(%d) = %v, want in [%v, %v]", tt.attempts, got, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func Test_verifyWebhook(t *testing.T) {
+	key := "secret"
+	body := []byte(`{"order":"125764357","status":"PROCESSED","accrual":500}`)
+	now := time.Unix(1700000000, 0)
+
+	sign := func(timestamp string, body []byte) string {
+		return signWebhook(key, timestamp, body)
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		want      bool
+	}{
+		{name: "valid", timestamp: "1700000000", signature: sign("1700000000", body), want: true},
+		{name: "small skew", timestamp: "1699999900", signature: sign("1699999900", body), want: true},
+		{name: "expired", timestamp: "1699999000", signature: sign("1699999000", body), want: false},
+		{name: "from future", timestamp: "1700001000", signature: sign("1700001000", body), want: false},
+		{name: "timestamp swapped", timestamp: "1700000001", signature: sign("1700000000", body), want: false},
+		{name: "body tampered", timestamp: "1700000000", signature: sign("1700000000", []byte("{}")), want: false},
+		{name: "wrong key", timestamp: "1700000000", signature: signWebhook("other", "1700000000", body), want: false},
+		{name: "no timestamp", timestamp: "", signature: sign("", body), want: false},
+	}
+	for _, tt := range tests {
+		if got := verifyWebhook(key, tt.timestamp, tt.signature, body, now); got != tt.want {
+			t.Errorf("%s: verifyWebhook() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func signWebhook(key, timestamp string, body []byte) string {
+	hm := hmac.New(sha256.New, []byte(key))
+	hm.Write([]byte(timestamp + "."))
+	hm.Write(body)
+	return hex.EncodeToString(hm.Sum(nil))
+}
+
+func TestProc_HTTPErrorHandler(t *testing.T) {
+	p := &Proc{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantDetail string
+	}{
+		{
+			name:       "api error",
+			err:        newError(http.StatusUnprocessableEntity, CodeInvalidOrderNumber, "bad number", nil),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   CodeInvalidOrderNumber,
+			wantDetail: "bad number",
+		},
+		{
+			name:       "wrapped storage error",
+			err:        fmt.Errorf("withdraw: %w", loyalty.ErrInsufficientFunds),
+			wantStatus: http.StatusPaymentRequired,
+			wantCode:   CodeInsufficientFunds,
+			wantDetail: "not enough points on the balance",
+		},
+		{
+			name:       "echo error",
+			err:        echo.ErrNotFound,
+			wantStatus: http.StatusNotFound,
+			wantCode:   "not_found",
+			wantDetail: "Not Found",
+		},
+		{
+			name:       "internal error hides details",
+			err:        errors.New("connection refused"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   CodeInternal,
+			wantDetail: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			recorder := httptest.NewRecorder()
+			p.HTTPErrorHandler(tt.err, echo.New().NewContext(request, recorder))
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("expected status %v; got %v", tt.wantStatus, recorder.Code)
+			}
+			if ct := recorder.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, problemContentType) {
+				t.Errorf("expected content type %v; got %v", problemContentType, ct)
+			}
+
+			var problem problemJSON
+			err := json.Unmarshal(recorder.Body.Bytes(), &problem)
+			if err != nil {
+				t.Fatalf("could not decode problem: %v", err)
+			}
+			if problem.Code != tt.wantCode || problem.Detail != tt.wantDetail || problem.Status != tt.wantStatus {
+				t.Errorf("unexpected problem %+v", problem)
+			}
+			if problem.Type != problemTypePrefix+tt.wantCode || problem.Instance != "/api/user/orders" {
+				t.Errorf("unexpected problem %+v", problem)
+			}
+		})
+	}
+}
+
+// testProc возвращает обработчик над хранилищем в памяти с зарегистрированным пользователем test
+func testProc(t *testing.T) (*Proc, *loyalty.Memory) {
+	t.Helper()
+
+	repo := loyalty.NewMemory()
+	p := &Proc{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		enc:     "secret",
+		loyalty: loyalty.New(repo, loyalty.Config{}),
+	}
+
+	err := p.loyalty.Register(context.Background(), "test", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, repo
+}
+
+// testServer возвращает сервер с обработкой ошибок p, который сверяет запросы и ответы с
+// документом OpenAPI
+func testServer(t *testing.T, p *Proc) *echo.Echo {
+	t.Helper()
+
+	doc, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := openapi.NewValidator(doc, func(err error) {
+		t.Error(err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = p.HTTPErrorHandler
+	e.Use(v.Middleware)
+	return e
+}
+
+func TestProc_OpenAPI(t *testing.T) {
+	p := &Proc{
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		accrual:    config.Accrual{WebhookKey: "key"},
+		adminToken: "admin",
+		breaker:    breaker.New(breaker.Config{}),
+		enc:        "secret",
+	}
+
+	e := testServer(t, p)
+	e.GET("/healthz", p.Healthz)
+	e.GET("/status", p.Status, p.MiddlewareAdmin)
+	e.GET("/api/user/balance", p.Balance, p.MiddlewareAuth)
+	e.GET("/api/v2/user/balance", p.BalanceV2, p.MiddlewareAuth)
+	e.POST("/api/user/orders", p.SetOrders, p.MiddlewareAuth)
+	e.POST("/api/accrual/webhook", p.AccrualWebhook)
+	e.GET("/api/admin/accrual/status", p.AccrualStatus, p.MiddlewareAdmin)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		header     map[string]string
+		body       string
+		wantStatus int
+	}{
+		{name: "healthz", method: http.MethodGet, target: "/healthz", wantStatus: http.StatusOK},
+		{name: "status without token", method: http.MethodGet, target: "/status", wantStatus: http.StatusUnauthorized},
+		{name: "balance without session", method: http.MethodGet, target: "/api/user/balance", wantStatus: http.StatusUnauthorized},
+		{name: "v2 balance without session", method: http.MethodGet, target: "/api/v2/user/balance", wantStatus: http.StatusUnauthorized},
+		{
+			name:       "malformed order number",
+			method:     http.MethodPost,
+			target:     "/api/user/orders",
+			header:     map[string]string{echo.HeaderContentType: echo.MIMETextPlain, "Cookie": "person=test; token=" + signition("test", "secret")},
+			body:       "12a",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "order number fails the Luhn check",
+			method:     http.MethodPost,
+			target:     "/api/user/orders",
+			header:     map[string]string{echo.HeaderContentType: echo.MIMETextPlain, "Cookie": "person=test; token=" + signition("test", "secret")},
+			body:       "12345678902",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:   "webhook with bad signature",
+			method: http.MethodPost,
+			target: "/api/accrual/webhook",
+			header: map[string]string{
+				echo.HeaderContentType: echo.MIMEApplicationJSON,
+				"X-Accrual-Timestamp":  "0",
+				"X-Accrual-Signature":  "00",
+			},
+			body:       `{"order":"12345678903","status":"PROCESSED","accrual":10}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "accrual status",
+			method:     http.MethodGet,
+			target:     "/api/admin/accrual/status",
+			header:     map[string]string{echo.HeaderAuthorization: "Bearer admin"},
+			wantStatus: http.StatusOK,
+		},
+		{name: "accrual status without token", method: http.MethodGet, target: "/api/admin/accrual/status", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				request.Header.Set(k, v)
+			}
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("expected status %v; got %v", tt.wantStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestProc_Refund(t *testing.T) {
+	ctx := context.Background()
+	p, repo := testProc(t)
+	p.adminToken, p.shopKey = "admin", "shop"
+	e := testServer(t, p)
+
+	_, _, err := p.loyalty.SubmitOrder(ctx, "test", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", loyalty.StatusProcessed, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.loyalty.Withdraw(ctx, "test", "2377225624", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withdrawals, err := p.loyalty.Withdrawals(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := withdrawals[0].ID
+
+	e.POST("/api/shop/refund", p.ShopRefund)
+	e.POST("/api/admin/withdrawals/:id/refund", p.RefundWithdrawal, p.MiddlewareAdmin)
+	e.GET("/api/user/withdrawals", p.Withdrawals, p.MiddlewareAuth)
+	e.GET("/api/v2/user/withdrawals", p.WithdrawalsV2, p.MiddlewareAuth)
+
+	admin := map[string]string{echo.HeaderContentType: echo.MIMEApplicationJSON, echo.HeaderAuthorization: "Bearer admin"}
+	shop := func(body string) map[string]string {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		return map[string]string{
+			echo.HeaderContentType: echo.MIMEApplicationJSON,
+			"X-Shop-Timestamp":     timestamp,
+			"X-Shop-Signature":     signWebhook("shop", timestamp, []byte(body)),
+		}
+	}
+	fullRefund := `{"order":"2377225624","refund_id":"r1"}`
+
+	tests := []struct {
+		name       string
+		target     string
+		header     map[string]string
+		body       string
+		wantStatus int
+		wantSum    string
+	}{
+		{name: "admin without token", target: "/api/admin/withdrawals/" + id + "/refund", header: map[string]string{echo.HeaderContentType: echo.MIMEApplicationJSON}, body: `{"sum":"10"}`, wantStatus: http.StatusUnauthorized},
+		{name: "admin unknown withdrawal", target: "/api/admin/withdrawals/missing/refund", header: admin, body: `{"sum":"10"}`, wantStatus: http.StatusNotFound},
+		{name: "admin zero sum", target: "/api/admin/withdrawals/" + id + "/refund", header: admin, body: `{"sum":"0"}`, wantStatus: http.StatusBadRequest},
+		{name: "admin partial", target: "/api/admin/withdrawals/" + id + "/refund", header: admin, body: `{"sum":"10"}`, wantStatus: http.StatusOK, wantSum: "10.00"},
+		{name: "shop forged signature", target: "/api/shop/refund", header: shop(`{}`), body: fullRefund, wantStatus: http.StatusUnauthorized},
+		{name: "shop without refund_id", target: "/api/shop/refund", header: shop(`{"order":"2377225624"}`), body: `{"order":"2377225624"}`, wantStatus: http.StatusBadRequest},
+		{name: "shop unknown order", target: "/api/shop/refund", header: shop(`{"order":"18","refund_id":"r0"}`), body: `{"order":"18","refund_id":"r0"}`, wantStatus: http.StatusNotFound},
+		{name: "shop rest", target: "/api/shop/refund", header: shop(fullRefund), body: fullRefund, wantStatus: http.StatusOK, wantSum: "90.00"},
+		{name: "shop retry", target: "/api/shop/refund", header: shop(fullRefund), body: fullRefund, wantStatus: http.StatusOK, wantSum: "90.00"},
+		{name: "admin nothing left", target: "/api/admin/withdrawals/" + id + "/refund", header: admin, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				request.Header.Set(k, v)
+			}
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("expected status %v; got %v: %s", tt.wantStatus, recorder.Code, recorder.Body)
+			}
+			if tt.wantSum != "" {
+				var refund refundJSON
+				err := json.Unmarshal(recorder.Body.Bytes(), &refund)
+				if err != nil || refund.Sum != tt.wantSum || refund.WithdrawalID != id {
+					t.Errorf("expected refund of %s; got %s", tt.wantSum, recorder.Body)
+				}
+			}
+		})
+	}
+
+	for target, refunded := range map[string]string{"/api/user/withdrawals": `"refunded":100`, "/api/v2/user/withdrawals": `"refunded":"100.00"`} {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		request.Header.Set("Cookie", "person=test; token="+signition("test", "secret"))
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), refunded) {
+			t.Errorf("%s: expected withdrawal refunded in full; got %v %s", target, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func TestProc_Reservation(t *testing.T) {
+	ctx := context.Background()
+	p, repo := testProc(t)
+	e := testServer(t, p)
+
+	_, _, err := p.loyalty.SubmitOrder(ctx, "test", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", loyalty.StatusProcessed, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.GET("/api/v2/user/balance", p.BalanceV2, p.MiddlewareAuth)
+	e.POST("/api/v2/user/reservations", p.Reserve, p.MiddlewareAuth)
+	e.POST("/api/v2/user/reservations/:id/capture", p.CaptureReservation, p.MiddlewareAuth)
+	e.POST("/api/v2/user/reservations/:id/release", p.ReleaseReservation, p.MiddlewareAuth)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		request.Header.Set("Cookie", "person=test; token="+signition("test", "secret"))
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		return recorder
+	}
+	reserve := func(order, sum string) reservationJSON {
+		t.Helper()
+		recorder := do(http.MethodPost, "/api/v2/user/reservations", `{"order":"`+order+`","sum":"`+sum+`"}`)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("expected status 201; got %v: %s", recorder.Code, recorder.Body)
+		}
+		var r reservationJSON
+		err := json.Unmarshal(recorder.Body.Bytes(), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	wantBalance := func(want string) {
+		t.Helper()
+		recorder := do(http.MethodGet, "/api/v2/user/balance", "")
+		if got := strings.TrimSpace(recorder.Body.String()); got != want {
+			t.Errorf("expected balance %s; got %s", want, got)
+		}
+	}
+
+	captured := reserve("2377225624", "60")
+	released := reserve("79927398713", "30")
+	wantBalance(`{"current":"100.00","withdrawn":"0.00","available":"10.00","reserved":"90.00"}`)
+
+	if recorder := do(http.MethodPost, "/api/v2/user/reservations", `{"order":"12345678903","sum":"10.01"}`); recorder.Code != http.StatusPaymentRequired {
+		t.Errorf("expected status 402 for more than available; got %v", recorder.Code)
+	}
+
+	recorder := do(http.MethodPost, "/api/v2/user/reservations/"+captured.ID+"/capture", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"sum":"60.00"`) {
+		t.Errorf("expected capture to return the withdrawal; got %v %s", recorder.Code, recorder.Body)
+	}
+	if recorder := do(http.MethodPost, "/api/v2/user/reservations/"+captured.ID+"/release", ""); recorder.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for captured reservation; got %v", recorder.Code)
+	}
+	if recorder := do(http.MethodPost, "/api/v2/user/reservations/missing/capture", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for unknown reservation; got %v", recorder.Code)
+	}
+	if recorder := do(http.MethodPost, "/api/v2/user/reservations/"+released.ID+"/release", ""); recorder.Code != http.StatusOK {
+		t.Errorf("expected release to succeed; got %v %s", recorder.Code, recorder.Body)
+	}
+	// в счёт заказа проводится одно списание
+	if recorder := do(http.MethodPost, "/api/v2/user/reservations", `{"order":"2377225624","sum":"1"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for order with a withdrawal; got %v", recorder.Code)
+	}
+	wantBalance(`{"current":"40.00","withdrawn":"60.00","available":"40.00","reserved":"0.00"}`)
+}
+
+func TestProc_ExpiringBalance(t *testing.T) {
+	ctx := context.Background()
+	p, repo := testProc(t)
+	e := testServer(t, p)
+	e.GET("/api/user/balance/expiring", p.ExpiringBalance, p.MiddlewareAuth)
+
+	expiring := func() expiringJSON {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "/api/user/balance/expiring", nil)
+		request.Header.Set("Cookie", "person=test; token="+signition("test", "secret"))
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200; got %v: %s", recorder.Code, recorder.Body)
+		}
+		var r expiringJSON
+		err := json.Unmarshal(recorder.Body.Bytes(), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	accrue := func(number string, sum float64) {
+		t.Helper()
+		_, _, err := p.loyalty.SubmitOrder(ctx, "test", number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.SetOrderStatus(ctx, number, loyalty.StatusProcessed, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// без срока жизни баллы не сгорают
+	accrue("18", 100)
+	if r := expiring(); r.Total != "0.00" || len(r.Lots) != 0 {
+		t.Errorf("expected no expiring points; got %+v", r)
+	}
+
+	repo.PointsTTL = 24 * time.Hour
+	accrue("26", 40)
+	accrue("34", 10.5)
+	err := p.loyalty.Withdraw(ctx, "test", "2377225624", 115)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := expiring()
+	if r.Total != "35.50" || len(r.Lots) != 2 || r.Lots[0].Order != "26" || r.Lots[0].Sum != "25.00" || r.Lots[1].Sum != "10.50" {
+		t.Errorf("unexpected expiring points %+v", r)
+	}
+	if d := r.Lots[0].ExpiresAt.Sub(r.Lots[0].AccruedAt); d != 24*time.Hour {
+		t.Errorf("expected points to expire in 24h; got %v", d)
+	}
+}
+
+func TestProc_Tier(t *testing.T) {
+	ctx := context.Background()
+	p, repo := testProc(t)
+	e := testServer(t, p)
+	e.GET("/api/user/tier", p.Tier, p.MiddlewareAuth)
+	e.GET("/api/user/tier/history", p.TierHistory, p.MiddlewareAuth)
+
+	get := func(target string) string {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		request.Header.Set("Cookie", "person=test; token="+signition("test", "secret"))
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200; got %v: %s", recorder.Code, recorder.Body)
+		}
+		return recorder.Body.String()
+	}
+
+	if body := get("/api/user/tier"); !strings.Contains(body, `"tier":"base","accrued":"0.00"`) || !strings.Contains(body, `"next":"silver","next_threshold":"1000.00"`) {
+		t.Errorf("expected base tier; got %s", body)
+	}
+	if body := strings.TrimSpace(get("/api/user/tier/history")); body != "[]" {
+		t.Errorf("expected empty history; got %s", body)
+	}
+
+	_, _, err := p.loyalty.SubmitOrder(ctx, "test", "18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetOrderStatus(ctx, "18", loyalty.StatusProcessed, 25000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = p.loyalty.RecomputeTier(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := get("/api/user/tier"); !strings.Contains(body, `"tier":"platinum","accrued":"25000.00"`) || strings.Contains(body, `"next"`) {
+		t.Errorf("expected platinum tier without next; got %s", body)
+	}
+	if body := get("/api/user/tier/history"); !strings.Contains(body, `"tier":"platinum","previous":"base","change":"upgrade","accrued":"25000.00"`) {
+		t.Errorf("expected upgrade in history; got %s", body)
+	}
+
+	data, err := eventData(events.Event{Type: events.TypeTier, Tier: &events.Tier{Tier: loyalty.TierSilver, Previous: loyalty.TierGold}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (tierEventJSON{Tier: "silver", Previous: "gold", Change: "downgrade"}); data != want {
+		t.Errorf("expected tier event %+v; got %+v", want, data)
+	}
+}
+
+func Test_parseMoney(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    float64
+		wantErr bool
+	}{
+		{s: "751", want: 751},
+		{s: "751.5", want: 751.5},
+		{s: "0.01", want: 0.01},
+		{s: "0", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "1.005", wantErr: true},
+		{s: "1e3", wantErr: true},
+		{s: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMoney(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMoney(%q) = %v; want %v", tt.s, got, tt.want)
+		}
+	}
+
+	if got := formatMoney(500.5); got != "500.50" {
+		t.Errorf("formatMoney(500.5) = %v; want 500.50", got)
+	}
+}
+
+func Test_orderNumberV2(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+		wantStatus  int
+	}{
+		{contentType: echo.MIMEApplicationJSON, body: `{"number":"12345678903"}`, want: "12345678903"},
+		{contentType: echo.MIMETextPlainCharsetUTF8, body: "12345678903", want: "12345678903"},
+		{contentType: "", body: "12345678903", want: "12345678903"},
+		{contentType: echo.MIMEApplicationJSON, body: "12345678903", wantStatus: http.StatusBadRequest},
+		{contentType: echo.MIMEApplicationXML, body: "<number>12345678903</number>", wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/api/v2/user/orders", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			request.Header.Set(echo.HeaderContentType, tt.contentType)
+		}
+		c := echo.New().NewContext(request, httptest.NewRecorder())
+
+		got, err := orderNumberV2(c)
+		if tt.wantStatus != 0 {
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.Status != tt.wantStatus {
+				t.Errorf("%s: expected status %v; got %v", tt.contentType, tt.wantStatus, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %v; got %v, %v", tt.contentType, tt.want, got, err)
+		}
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	e := echo.New()
+	recorder := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/user/balance", nil), recorder)
+
+	err := Deprecated("/api/v2/user/balance")(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := recorder.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("expected Deprecation header; got %q", got)
+	}
+	if got, want := recorder.Header().Get("Link"), `</api/v2/user/balance>; rel="successor-version"`; got != want {
+		t.Errorf("expected Link %v; got %v", want, got)
+	}
+}
+
+func Test_batchNumbers(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+		wantStatus  int
+	}{
+		{name: "json array", contentType: echo.MIMEApplicationJSON, body: `["12345678903", "9278923470"]`, want: []string{"12345678903", "9278923470"}},
+		{name: "text lines", contentType: echo.MIMETextPlain, body: "12345678903\r\n\n  9278923470  \n", want: []string{"12345678903", "9278923470"}},
+		{name: "json object", contentType: echo.MIMEApplicationJSON, body: `{"number":"12345678903"}`, wantStatus: http.StatusBadRequest},
+		{name: "empty", contentType: echo.MIMETextPlain, body: "\n\n", wantStatus: http.StatusBadRequest},
+		{name: "too many", contentType: echo.MIMETextPlain, body: strings.Repeat("18\n", maxBatchOrders+1), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "unsupported", contentType: echo.MIMEApplicationForm, body: "number=18", wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/v2/user/orders/batch", strings.NewReader(tt.body))
+			request.Header.Set(echo.HeaderContentType, tt.contentType)
+			c := echo.New().NewContext(request, httptest.NewRecorder())
+
+			got, err := batchNumbers(c)
+			if tt.wantStatus != 0 {
+				var apiErr *Error
+				if !errors.As(err, &apiErr) || apiErr.Status != tt.wantStatus {
+					t.Errorf("expected status %v; got %v", tt.wantStatus, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_parseStatementTime(t *testing.T) {
+	tests := []struct {
+		s       string
+		end     bool
+		want    time.Time
+		wantErr bool
+	}{
+		{s: "2023-01-02T10:00:00+03:00", want: time.Date(2023, 1, 2, 7, 0, 0, 0, time.UTC)},
+		{s: "2023-01-02", want: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{s: "2023-01-02", end: true, want: time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{s: "02.01.2023", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStatementTime(tt.s, tt.end)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStatementTime(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseStatementTime(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func Test_schemaCheck(t *testing.T) {
+	tests := []struct {
+		version int
+		err     error
+		want    string
+	}{
+		{version: storage.SchemaVersion, want: "ok"},
+		{version: storage.SchemaVersion + 1, want: "ok"},
+		{version: storage.SchemaVersion - 1, want: "fail"},
+		{err: errors.New("pq: password authentication failed for user \"postgres\""), want: "fail"},
+	}
+	for _, tt := range tests {
+		got := schemaCheck(tt.version, tt.err)
+		if got.Status != tt.want {
+			t.Errorf("schemaCheck(%d, %v) status = %q, want %q", tt.version, tt.err, got.Status, tt.want)
+		}
+		if tt.err != nil && strings.Contains(got.Error, tt.err.Error()) {
+			t.Errorf("schemaCheck(%d, %v) exposes the error: %q", tt.version, tt.err, got.Error)
+		}
+	}
+}
+
+func TestProc_clearWriteDeadline(t *testing.T) {
+	p := &Proc{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	for _, reset := range []bool{false, true} {
+		e := echo.New()
+		e.GET("/stream", func(c echo.Context) error {
+			if reset {
+				p.clearWriteDeadline(c)
+			}
+			res := c.Response()
+			res.WriteHeader(http.StatusOK)
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(res, "line %d\n", i)
+				res.Flush()
+				time.Sleep(150 * time.Millisecond)
+			}
+			fmt.Fprint(res, "end\n")
+			return nil
+		})
+
+		server := httptest.NewUnstartedServer(e)
+		server.Config.WriteTimeout = 100 * time.Millisecond
+		server.Start()
+
+		resp, err := http.Get(server.URL + "/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		complete := err == nil && strings.HasSuffix(string(body), "end\n")
+		if complete != reset {
+			t.Errorf("reset=%v: expected complete body %v; got %q, %v", reset, reset, body, err)
+		}
+	}
+}
+
+func Test_statementWriters(t *testing.T) {
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	lines := []statementLine{
+		{At: time.Date(2023, 1, 5, 12, 0, 0, 0, time.FixedZone("MSK", 3*3600)), Kind: "accrual", Order: "12345678903", Amount: 500, Balance: 600},
+		{At: time.Date(2023, 1, 6, 12, 0, 0, 0, time.UTC), Kind: "withdrawal", Order: "2377225624", Amount: 42.5, Balance: 557.5},
+	}
+
+	write := func(w statementWriter) {
+		t.Helper()
+		if err := w.Begin(from, to, 100); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range lines {
+			if err := w.Line(l); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.End(557.5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf strings.Builder
+	write(newJSONStatement(&buf))
+	var statement struct {
+		Opening string `json:"opening_balance"`
+		Closing string `json:"closing_balance"`
+		Entries []struct {
+			At      time.Time `json:"at"`
+			Amount  string    `json:"amount"`
+			Balance string    `json:"balance"`
+		} `json:"entries"`
+	}
+	err := json.Unmarshal([]byte(buf.String()), &statement)
+	if err != nil {
+		t.Fatalf("json statement is invalid: %v\n%s", err, buf.String())
+	}
+	if statement.Opening != "100.00" || statement.Closing != "557.50" || len(statement.Entries) != 2 {
+		t.Errorf("unexpected json statement %+v", statement)
+	}
+	if statement.Entries[1].Amount != "-42.50" || statement.Entries[0].At.Location() != time.UTC {
+		t.Errorf("unexpected json entries %+v", statement.Entries)
+	}
+
+	buf.Reset()
+	write(newCSVStatement(&buf))
+	want := "date,type,order,amount,balance\n" +
+		"2023-01-01T00:00:00Z,opening_balance,,,100.00\n" +
+		"2023-01-05T09:00:00Z,accrual,12345678903,500.00,600.00\n" +
+		"2023-01-06T12:00:00Z,withdrawal,2377225624,-42.50,557.50\n" +
+		",closing_balance,,,557.50\n"
+	if buf.String() != want {
+		t.Errorf("expected csv\n%s\ngot\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	write(newTextStatement(&buf))
+	for _, s := range []string{"Входящий остаток: 100.00", "2377225624", "-42.50", "Исходящий остаток: 557.50"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("text statement has no %q:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestProc_Events(t *testing.T) {
+	bus := events.New(10)
+	p := &Proc{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		events: bus,
+		enc:    "secret",
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = p.HTTPErrorHandler
+	e.GET("/api/user/events", p.Events, p.MiddlewareAuth)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	missed := bus.Publish(events.Event{Login: "test", Type: events.TypeOrder, Order: &events.Order{Number: "18", Status: "PROCESSING"}})
+	bus.Publish(events.Event{Login: "other", Type: events.TypeBalance, Balance: &events.Balance{Current: 1}})
+
+	request, err := http.NewRequest(http.MethodGet, srv.URL+"/api/user/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Cookie", "person=test; token="+signition("test", "secret"))
+	request.Header.Set("Last-Event-ID", strconv.FormatUint(missed.ID-1, 10))
+
+	response, err := srv.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if ct := response.Header.Get(echo.HeaderContentType); ct != "text/event-stream" {
+		t.Fatalf("expected event stream; got %v %v", response.StatusCode, ct)
+	}
+
+	reader := bufio.NewReader(response.Body)
+	readEvent := func() string {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read event: %v", err)
+			}
+			line = strings.TrimRight(line, "\n")
+			if line == "" {
+				return strings.Join(lines, "\n")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if got := readEvent(); got != "retry: 3000" {
+		t.Errorf("expected retry; got %q", got)
+	}
+
+	want := fmt.Sprintf("id: %d\nevent: order\ndata: {\"number\":\"18\",\"status\":\"PROCESSING\",\"accrual\":\"0.00\"}", missed.ID)
+	if got := readEvent(); got != want {
+		t.Errorf("expected replayed event\n%s\ngot\n%s", want, got)
+	}
+
+	live := bus.Publish(events.Event{Login: "test", Type: events.TypeBalance, Balance: &events.Balance{Current: 500.5, Withdrawn: 42}})
+	want = fmt.Sprintf("id: %d\nevent: balance\ndata: {\"current\":\"500.50\",\"withdrawn\":\"42.00\",\"available\":\"500.50\",\"reserved\":\"0.00\"}", live.ID)
+	if got := readEvent(); got != want {
+		t.Errorf("expected live event\n%s\ngot\n%s", want, got)
+	}
+
+	p.CloseEvents()
+	_, err = reader.ReadString('\n')
+	if err != io.EOF {
+		t.Errorf("expected stream to end after CloseEvents; got %v", err)
+	}
+}
+
+func TestProc_Notifications(t *testing.T) {
+	bus := events.New(10)
+	p := &Proc{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		events: bus,
+		enc:    "secret",
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = p.HTTPErrorHandler
+	e.GET("/api/user/ws", p.Notifications, p.MiddlewareAuth)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	missed := bus.Publish(events.Event{Login: "test", Type: events.TypeOrder, Order: &events.Order{Number: "18", Status: "INVALID"}})
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/user/ws?last_event_id=" + strconv.FormatUint(missed.ID-1, 10)
+	config, err := websocket.NewConfig(wsURL, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Header.Set("Cookie", "person=test; token="+signition("test", "secret"))
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	send := func(m string) {
+		t.Helper()
+		err := websocket.Message.Send(ws, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() string {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var m string
+		err := websocket.Message.Receive(ws, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(m)
+	}
+	expect := func(want string) {
+		t.Helper()
+		if got := receive(); got != want {
+			t.Errorf("expected %s; got %s", want, got)
+		}
+	}
+
+	send(`{"type":"ping"}`)
+	expect(`{"type":"pong"}`)
+
+	send(`{"type":"subscribe","topics":["order","balance"]}`)
+	expect(`{"type":"subscribed","topics":["order","balance"]}`)
+	expect(fmt.Sprintf(`{"type":"order","id":"%d","data":{"number":"18","status":"INVALID","accrual":"0.00"}}`, missed.ID))
+
+	send(`{"type":"unsubscribe","topics":["order"]}`)
+	expect(`{"type":"subscribed","topics":["balance"]}`)
+
+	bus.Publish(events.Event{Login: "test", Type: events.TypeOrder, Order: &events.Order{Number: "26", Status: "PROCESSED", Accrual: 10}})
+	bus.Publish(events.Event{Login: "other", Type: events.TypeBalance, Balance: &events.Balance{Current: 1}})
+	live := bus.Publish(events.Event{Login: "test", Type: events.TypeBalance, Balance: &events.Balance{Current: 10}})
+	expect(fmt.Sprintf(`{"type":"balance","id":"%d","data":{"current":"10.00","withdrawn":"0.00","available":"10.00","reserved":"0.00"}}`, live.ID))
+
+	send(`{"type":"subscribe","topics":["bonus"]}`)
+	expect(`{"type":"error","error":"unknown topic \"bonus\""}`)
+
+	p.CloseEvents()
+	var m string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = websocket.Message.Receive(ws, &m)
+	if err != io.EOF {
+		t.Errorf("expected connection to close after CloseEvents; got %v %q", err, m)
+	}
+}
+
+func TestProc_NotificationsRejected(t *testing.T) {
+	p := &Proc{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		events: events.New(10),
+		enc:    "secret",
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = p.HTTPErrorHandler
+	e.GET("/api/user/ws", p.Notifications, p.MiddlewareAuth)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/user/ws"
+	tests := []struct {
+		name   string
+		cookie string
+		origin string
+	}{
+		{name: "unauthorized", cookie: "person=test; token=wrong", origin: srv.URL},
+		{name: "foreign origin", cookie: "person=test; token=" + signition("test", "secret"), origin: "https://evil.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := websocket.NewConfig(wsURL, tt.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Header.Set("Cookie", tt.cookie)
+
+			ws, err := websocket.DialConfig(config)
+			if err == nil {
+				ws.Close()
+				t.Errorf("expected connection to be rejected")
+			}
+		})
+	}
+}
+
+func TestProc_GRPC(t *testing.T) {
+	repo := loyalty.NewMemory()
+	p := &Proc{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		enc:     "secret",
+		loyalty: loyalty.New(repo, loyalty.Config{}),
+	}
+
+	err := repo.UserRegister(context.Background(), "тест", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.OrderRegister(context.Background(), "другой", "79927398713")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := p.NewGRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := grpcapi.NewGophermartClient(conn)
+
+	authorized := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+grpcToken("тест", "secret"))
+
+	tests := []struct {
+		name   string
+		call   func() error
+		code   codes.Code
+		reason string
+	}{
+		{
+			name: "no token",
+			call: func() error {
+				_, err := client.GetBalance(context.Background(), &grpcapi.GetBalanceRequest{})
+				return err
+			},
+			code:   codes.Unauthenticated,
+			reason: CodeUnauthorized,
+		},
+		{
+			name: "forged token",
+			call: func() error {
+				ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+grpcToken("тест", "other"))
+				_, err := client.ListOrders(ctx, &grpcapi.ListOrdersRequest{})
+				return err
+			},
+			code:   codes.Unauthenticated,
+			reason: CodeUnauthorized,
+		},
+		{
+			name: "luhn",
+			call: func() error {
+				_, err := client.SubmitOrder(authorized, &grpcapi.SubmitOrderRequest{Number: "12345678901"})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: CodeInvalidOrderNumber,
+		},
+		{
+			name: "malformed sum",
+			call: func() error {
+				_, err := client.Withdraw(authorized, &grpcapi.WithdrawRequest{Order: "2377225624", Sum: "1.234"})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: CodeBadRequest,
+		},
+		{
+			name: "negative sum",
+			call: func() error {
+				_, err := client.Withdraw(authorized, &grpcapi.WithdrawRequest{Order: "2377225624", Sum: "-1"})
+				return err
+			},
+			code:   codes.InvalidArgument,
+			reason: CodeBadRequest,
+		},
+		{
+			name: "insufficient funds",
+			call: func() error {
+				_, err := client.Withdraw(authorized, &grpcapi.WithdrawRequest{Order: "2377225624", Sum: "1"})
+				return err
+			},
+			code:   codes.FailedPrecondition,
+			reason: CodeInsufficientFunds,
+		},
+		{
+			name: "order of another user",
+			call: func() error {
+				_, err := client.SubmitOrder(authorized, &grpcapi.SubmitOrderRequest{Number: "79927398713"})
+				return err
+			},
+			code:   codes.AlreadyExists,
+			reason: CodeOrderConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(tt.call())
+			if st.Code() != tt.code {
+				t.Fatalf("expected %v; got %v", tt.code, st)
+			}
+
+			var reason string
+			for _, d := range st.Details() {
+				if info, ok := d.(*errdetails.ErrorInfo); ok {
+					reason = info.Reason
+				}
+			}
+			if reason != tt.reason {
+				t.Errorf("expected reason %q; got %q", tt.reason, reason)
+			}
+		})
+	}
+
+	for _, created := range []bool{true, false} {
+		resp, err := client.SubmitOrder(authorized, &grpcapi.SubmitOrderRequest{Number: "2377 2256 24"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Created != created || resp.Order.Number != "2377225624" || resp.Order.Status != loyalty.StatusNew {
+			t.Errorf("expected created=%v order 2377225624 NEW; got %v", created, resp)
+		}
+	}
+
+	orders, err := client.ListOrders(authorized, &grpcapi.ListOrdersRequest{})
+	if err != nil || len(orders.Orders) != 1 {
+		t.Errorf("expected one order; got %v, %v", orders, err)
+	}
+}
+
+func Test_grpcToken(t *testing.T) {
+	token := grpcToken("user.name", "secret")
+
+	login, err := grpcLogin(token, "secret")
+	if err != nil || login != "user.name" {
+		t.Errorf("expected user.name; got %q, %v", login, err)
+	}
+
+	for _, bad := range []string{"", "dXNlcg", "dXNlcg.", "!!!." + signition("user", "secret"), token + "0"} {
+		if _, err := grpcLogin(bad, "secret"); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
 		}
 	}
 }
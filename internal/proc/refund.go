@@ -0,0 +1,135 @@
+package proc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+type refundJSON struct {
+	ID           string    `json:"id"`
+	WithdrawalID string    `json:"withdrawal_id"`
+	Sum          string    `json:"sum"`
+	Source       string    `json:"source"`
+	RefundID     string    `json:"refund_id,omitempty"`
+	ProcessedAt  time.Time `json:"processed_at"`
+}
+
+func newRefundJSON(r loyalty.Refund) refundJSON {
+	return refundJSON{
+		ID:           r.ID,
+		WithdrawalID: r.WithdrawalID,
+		Sum:          formatMoney(r.Sum),
+		Source:       r.Source,
+		RefundID:     r.ExternalID,
+		ProcessedAt:  r.ProcessedAt.UTC(),
+	}
+}
+
+// refundSum разбирает необязательную сумму возврата; пустая строка — возврат всего остатка, а
+// нулевую сумму, как и отрицательную, отклоняет parseMoney
+func refundSum(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	sum, err := parseMoney(s)
+	if err != nil {
+		return 0, newError(http.StatusBadRequest, CodeBadRequest, "malformed sum", err)
+	}
+	return sum, nil
+}
+
+type refundRequestJSON struct {
+	Sum string `json:"sum"`
+}
+
+func (p *Proc) RefundWithdrawal(c echo.Context) error {
+	// StatusOK 200 — баллы возвращены, в ответе проведённый возврат
+	// StatusBadRequest 400 — неверный формат запроса или суммы
+	// StatusUnauthorized 401 — администратор не аутентифицирован
+	// StatusNotFound 404 — списание не найдено
+	// StatusConflict 409 — сумма больше невозвращённого остатка списания
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	// без тела возвращается весь остаток списания
+	var r refundRequestJSON
+	if len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &r)
+		if err != nil {
+			return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+		}
+	}
+
+	sum, err := refundSum(r.Sum)
+	if err != nil {
+		return err
+	}
+
+	refund, err := p.loyalty.Refund(c.Request().Context(), c.Param("id"), sum)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, newRefundJSON(refund))
+}
+
+type shopRefundJSON struct {
+	Order    string `json:"order"`
+	Sum      string `json:"sum"`
+	RefundID string `json:"refund_id"`
+}
+
+func (p *Proc) ShopRefund(c echo.Context) error {
+	// StatusOK 200 — баллы возвращены или возврат с этим refund_id уже проведён
+	// StatusBadRequest 400 — неверный формат запроса, номера заказа или суммы
+	// StatusUnauthorized 401 — неверная или просроченная подпись
+	// StatusNotFound 404 — нет списания в счёт заказа
+	// StatusConflict 409 — сумма больше невозвращённого остатка списания
+	// StatusUnprocessableEntity 422 — номер заказа не проходит проверку Луна
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	timestamp := c.Request().Header.Get("X-Shop-Timestamp")
+	signature := c.Request().Header.Get("X-Shop-Signature")
+	if p.shopKey == "" || !verifyWebhook(p.shopKey, timestamp, signature, body, time.Now()) {
+		return newError(http.StatusUnauthorized, CodeInvalidSignature, "signature check failed", nil)
+	}
+
+	var r shopRefundJSON
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+	}
+	// повтор обратного вызова узнаётся по refund_id, без него баллы могли бы вернуться дважды
+	if r.RefundID == "" {
+		return newError(http.StatusBadRequest, CodeBadRequest, "refund_id is required", nil)
+	}
+
+	sum, err := refundSum(r.Sum)
+	if err != nil {
+		return err
+	}
+
+	refund, err := p.loyalty.RefundOrder(c.Request().Context(), r.Order, sum, r.RefundID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, newRefundJSON(refund))
+}
@@ -0,0 +1,94 @@
+package proc
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+type reservationJSON struct {
+	ID        string    `json:"id"`
+	Order     string    `json:"order"`
+	Sum       string    `json:"sum"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newReservationJSON(r loyalty.Reservation) reservationJSON {
+	return reservationJSON{
+		ID:        r.ID,
+		Order:     r.OrderNumber,
+		Sum:       formatMoney(r.Sum),
+		Status:    r.Status,
+		CreatedAt: r.CreatedAt.UTC(),
+		ExpiresAt: r.ExpiresAt.UTC(),
+	}
+}
+
+func (p *Proc) Reserve(c echo.Context) error {
+	// StatusCreated 201 — баллы зарезервированы, в ответе резерв
+	// StatusBadRequest 400 — неверный формат запроса или суммы
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusPaymentRequired 402 — недостаточно доступных баллов
+	// StatusConflict 409 — в счёт заказа уже есть списание или активный резерв
+	// StatusUnprocessableEntity 422 — неверный номер заказа
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	var r withdrawV2JSON
+	err := json.NewDecoder(c.Request().Body).Decode(&r)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+	}
+
+	sum, err := parseMoney(r.Sum)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed sum", err)
+	}
+
+	reservation, err := p.loyalty.Reserve(c.Request().Context(), login, r.Order, sum)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newReservationJSON(reservation))
+}
+
+func (p *Proc) CaptureReservation(c echo.Context) error {
+	// StatusOK 200 — резерв списан, в ответе списание
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusNotFound 404 — у пользователя нет такого резерва
+	// StatusConflict 409 — резерв уже списан, снят или истёк
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	withdrawal, err := p.loyalty.Capture(c.Request().Context(), login, c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, newWithdrawalV2JSON(withdrawal))
+}
+
+func (p *Proc) ReleaseReservation(c echo.Context) error {
+	// StatusOK 200 — резерв снят, баллы снова доступны
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusNotFound 404 — у пользователя нет такого резерва
+	// StatusConflict 409 — резерв уже списан, снят или истёк
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	reservation, err := p.loyalty.Release(c.Request().Context(), login, c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, newReservationJSON(reservation))
+}
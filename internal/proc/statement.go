@@ -0,0 +1,264 @@
+package proc
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// ответ выписки сбрасывается клиенту каждые statementFlushEvery строк
+const statementFlushEvery = 100
+
+// statementLine — строка выписки с остатком после операции
+type statementLine struct {
+	At      time.Time
+	Kind    string
+	Order   string
+	Amount  float64
+	Balance float64
+}
+
+// statementWriter выводит выписку по мере чтения операций из базы: сначала входящий остаток,
+// затем операции, в конце исходящий остаток
+type statementWriter interface {
+	Begin(from, to time.Time, opening float64) error
+	Line(l statementLine) error
+	End(closing float64) error
+}
+
+var statementFormats = map[string]struct {
+	contentType string
+	ext         string
+	new         func(w io.Writer) statementWriter
+}{
+	"json": {contentType: echo.MIMEApplicationJSONCharsetUTF8, ext: "json", new: newJSONStatement},
+	"csv":  {contentType: "text/csv; charset=UTF-8", ext: "csv", new: newCSVStatement},
+	"text": {contentType: echo.MIMETextPlainCharsetUTF8, ext: "txt", new: newTextStatement},
+}
+
+// signedAmount — сумма операции со знаком: начисления и возвраты положительны, списания
+// и сгорания отрицательны
+func signedAmount(kind string, amount float64) float64 {
+	if kind == "withdrawal" || kind == "expiry" {
+		return -amount
+	}
+	return amount
+}
+
+// parseStatementTime разбирает границу периода в формате RFC 3339 или даты YYYY-MM-DD;
+// дата в to включается в период целиком
+func parseStatementTime(s string, end bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.ParseInLocation(time.DateOnly, s, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 time or YYYY-MM-DD date, got %q", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (p *Proc) Statement(c echo.Context) error {
+	// StatusOK 200 — выписка за период в формате json, csv или text
+	// StatusBadRequest 400 — неверные границы периода или формат
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "json"
+	}
+	f, ok := statementFormats[format]
+	if !ok {
+		return newError(http.StatusBadRequest, CodeBadRequest, "format must be one of json, csv, text", nil)
+	}
+
+	from := time.Unix(0, 0).UTC()
+	to := time.Now().UTC()
+	var err error
+	if v := c.QueryParam("from"); v != "" {
+		from, err = parseStatementTime(v, false)
+		if err != nil {
+			return newError(http.StatusBadRequest, CodeBadRequest, "malformed from", err)
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		to, err = parseStatementTime(v, true)
+		if err != nil {
+			return newError(http.StatusBadRequest, CodeBadRequest, "malformed to", err)
+		}
+	}
+	if !from.Before(to) {
+		return newError(http.StatusBadRequest, CodeBadRequest, "from must be earlier than to", nil)
+	}
+
+	ctx := c.Request().Context()
+
+	balance, err := p.storage.BalanceBefore(ctx, login, from)
+	if err != nil {
+		return fmt.Errorf("opening balance: %w", err)
+	}
+
+	res := c.Response()
+	// выгрузка большой выписки медленному клиенту длится дольше WriteTimeout сервера
+	p.clearWriteDeadline(c)
+	res.Header().Set(echo.HeaderContentType, f.contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="statement-%s-%s.%s"`,
+		from.Format(time.DateOnly), to.Format(time.DateOnly), f.ext))
+	res.WriteHeader(http.StatusOK)
+
+	// после начала ответа ошибки уже не передать клиенту: выписка обрывается, причина пишется в журнал
+	w := f.new(res)
+	err = w.Begin(from, to, balance)
+	if err != nil {
+		return fmt.Errorf("write statement: %w", err)
+	}
+
+	lines := 0
+	err = p.storage.Statement(ctx, login, from, to, func(e storage.StatementEntry) error {
+		balance += signedAmount(e.Kind, e.Amount)
+
+		err := w.Line(statementLine{At: e.At, Kind: e.Kind, Order: e.OrderNumber, Amount: e.Amount, Balance: balance})
+		if err != nil {
+			return fmt.Errorf("write statement: %w", err)
+		}
+
+		lines++
+		if lines%statementFlushEvery == 0 {
+			res.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("statement: %w", err)
+	}
+
+	err = w.End(balance)
+	if err != nil {
+		return fmt.Errorf("write statement: %w", err)
+	}
+
+	return nil
+}
+
+type jsonStatement struct {
+	w     io.Writer
+	enc   *json.Encoder
+	first bool
+}
+
+type statementLineJSON struct {
+	At      time.Time `json:"at"`
+	Kind    string    `json:"kind"`
+	Order   string    `json:"order"`
+	Amount  string    `json:"amount"`
+	Balance string    `json:"balance"`
+}
+
+func newJSONStatement(w io.Writer) statementWriter {
+	return &jsonStatement{w: w, enc: json.NewEncoder(w), first: true}
+}
+
+func (s *jsonStatement) Begin(from, to time.Time, opening float64) error {
+	_, err := fmt.Fprintf(s.w, `{"from":%q,"to":%q,"opening_balance":%q,"entries":[`,
+		from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), formatMoney(opening))
+	return err
+}
+
+func (s *jsonStatement) Line(l statementLine) error {
+	if !s.first {
+		_, err := io.WriteString(s.w, ",")
+		if err != nil {
+			return err
+		}
+	}
+	s.first = false
+
+	return s.enc.Encode(statementLineJSON{
+		At:      l.At.UTC(),
+		Kind:    l.Kind,
+		Order:   l.Order,
+		Amount:  formatMoney(signedAmount(l.Kind, l.Amount)),
+		Balance: formatMoney(l.Balance),
+	})
+}
+
+func (s *jsonStatement) End(closing float64) error {
+	_, err := fmt.Fprintf(s.w, "],\"closing_balance\":%q}\n", formatMoney(closing))
+	return err
+}
+
+type csvStatement struct {
+	w *csv.Writer
+}
+
+func newCSVStatement(w io.Writer) statementWriter {
+	return &csvStatement{w: csv.NewWriter(w)}
+}
+
+func (s *csvStatement) write(record ...string) error {
+	err := s.w.Write(record)
+	if err != nil {
+		return err
+	}
+	// csv.Writer буферизует вывод; сбрасываем каждую строку, чтобы выписка шла потоком
+	s.w.Flush()
+	return s.w.Error()
+}
+
+func (s *csvStatement) Begin(from, to time.Time, opening float64) error {
+	err := s.write("date", "type", "order", "amount", "balance")
+	if err != nil {
+		return err
+	}
+	return s.write(from.UTC().Format(time.RFC3339), "opening_balance", "", "", formatMoney(opening))
+}
+
+func (s *csvStatement) Line(l statementLine) error {
+	return s.write(l.At.UTC().Format(time.RFC3339), l.Kind, l.Order, formatMoney(signedAmount(l.Kind, l.Amount)), formatMoney(l.Balance))
+}
+
+func (s *csvStatement) End(closing float64) error {
+	return s.write("", "closing_balance", "", "", formatMoney(closing))
+}
+
+type textStatement struct {
+	w io.Writer
+}
+
+const textStatementRow = "%-20s  %-10s  %-24s  %12s  %12s\n"
+
+func newTextStatement(w io.Writer) statementWriter {
+	return &textStatement{w: w}
+}
+
+func (s *textStatement) Begin(from, to time.Time, opening float64) error {
+	_, err := fmt.Fprintf(s.w, "Выписка по счёту баллов лояльности\nПериод: %s — %s (UTC)\nВходящий остаток: %s\n\n"+textStatementRow,
+		from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), formatMoney(opening),
+		"Дата", "Операция", "Заказ", "Сумма", "Остаток")
+	return err
+}
+
+func (s *textStatement) Line(l statementLine) error {
+	_, err := fmt.Fprintf(s.w, textStatementRow,
+		l.At.UTC().Format(time.RFC3339), l.Kind, l.Order, formatMoney(signedAmount(l.Kind, l.Amount)), formatMoney(l.Balance))
+	return err
+}
+
+func (s *textStatement) End(closing float64) error {
+	_, err := fmt.Fprintf(s.w, "\nИсходящий остаток: %s\n", formatMoney(closing))
+	return err
+}
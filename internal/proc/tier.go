@@ -0,0 +1,80 @@
+package proc
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+type tierJSON struct {
+	Tier          string    `json:"tier"`
+	Accrued       string    `json:"accrued"`
+	WindowStart   time.Time `json:"window_start"`
+	Next          string    `json:"next,omitempty"`
+	NextThreshold string    `json:"next_threshold,omitempty"`
+}
+
+type tierChangeJSON struct {
+	Tier      string    `json:"tier"`
+	Previous  string    `json:"previous"`
+	Change    string    `json:"change"`
+	Accrued   string    `json:"accrued"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+func newTierChangeJSON(c loyalty.TierChange) tierChangeJSON {
+	return tierChangeJSON{
+		Tier:      c.Tier,
+		Previous:  c.Previous,
+		Change:    c.Direction(),
+		Accrued:   formatMoney(c.Accrued),
+		ChangedAt: c.ChangedAt.UTC(),
+	}
+}
+
+func (p *Proc) Tier(c echo.Context) error {
+	// StatusOK 200 — статус пользователя, начисления за окно и порог следующего статуса
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	status, err := p.loyalty.Tier(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	result := tierJSON{
+		Tier:        status.Tier,
+		Accrued:     formatMoney(status.Accrued),
+		WindowStart: status.WindowStart.UTC(),
+		Next:        status.Next,
+	}
+	if status.Next != "" {
+		result.NextThreshold = formatMoney(status.NextThreshold)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func (p *Proc) TierHistory(c echo.Context) error {
+	// StatusOK 200 — смены статуса в хронологическом порядке; пустой список, если статус не менялся
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	history, err := p.loyalty.TierHistory(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	result := make([]tierChangeJSON, 0, len(history))
+	for _, change := range history {
+		result = append(result, newTierChangeJSON(change))
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
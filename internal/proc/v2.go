@@ -0,0 +1,276 @@
+package proc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/labstack/echo/v4"
+)
+
+// Обработчики /api/v2. В отличие от первой версии заказы и списания содержат идентификаторы,
+// суммы передаются строками с двумя знаками после запятой, время — в UTC, а пустые списки
+// возвращаются как [] с кодом 200.
+
+// суммы в запросах v2: целое число баллов или число с одним-двумя знаками после точки
+var moneyRe = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+func formatMoney(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func parseMoney(s string) (float64, error) {
+	if !moneyRe.MatchString(s) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", s, err)
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("amount must be positive")
+	}
+
+	return v, nil
+}
+
+// Deprecated помечает маршрут первой версии API устаревшим (заголовки Deprecation и Link
+// с rel="successor-version") и указывает на маршрут-замену
+func Deprecated(successor string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			h := c.Response().Header()
+			h.Set("Deprecation", "true")
+			h.Set("Link", "<"+successor+`>; rel="successor-version"`)
+
+			return next(c)
+		}
+	}
+}
+
+type orderV2JSON struct {
+	ID         string    `json:"id"`
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	Accrual    string    `json:"accrual"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+func newOrderV2JSON(o loyalty.Order) orderV2JSON {
+	return orderV2JSON{
+		ID:         o.ID,
+		Number:     o.Number,
+		Status:     o.Status,
+		Accrual:    formatMoney(o.Accrual),
+		UploadedAt: o.UploadedAt.UTC(),
+	}
+}
+
+type orderV2Request struct {
+	Number string `json:"number"`
+}
+
+// orderNumberV2 читает номер заказа из тела запроса в формате, указанном в Content-Type:
+// JSON-объект {"number": "..."} или номер текстом, как в первой версии API
+func orderNumberV2(c echo.Context) (string, error) {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return "", fmt.Errorf("read body: %w", err)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		mediaType = echo.MIMETextPlain
+	}
+
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		var r orderV2Request
+		err = json.Unmarshal(body, &r)
+		if err != nil {
+			return "", newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+		}
+		return r.Number, nil
+	case echo.MIMETextPlain:
+		return string(body), nil
+	}
+
+	return "", newError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "order number must be sent as application/json or text/plain", nil)
+}
+
+func (p *Proc) SetOrdersV2(c echo.Context) error {
+	// StatusOK 200 — номер заказа уже был загружен этим пользователем
+	// StatusAccepted 202 — новый номер заказа принят в обработку
+	// StatusBadRequest 400 — неверный формат запроса
+	// StatusUnauthorized 401 — пользователь не аутентифицирован
+	// StatusConflict 409 — номер заказа уже был загружен другим пользователем
+	// StatusUnsupportedMediaType 415 — тело запроса не JSON и не текст
+	// StatusUnprocessableEntity 422 — неверный формат номера заказа
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	raw, err := orderNumberV2(c)
+	if err != nil {
+		return err
+	}
+
+	order, created, err := p.loyalty.SubmitOrder(c.Request().Context(), login, raw)
+	if err != nil {
+		return err
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusAccepted
+	}
+	return c.JSON(status, newOrderV2JSON(order))
+}
+
+func (p *Proc) OrdersV2(c echo.Context) error {
+	// StatusOK 200 — успешная обработка запроса, в том числе пустой список
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	orders, err := p.loyalty.Orders(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	arr := make([]orderV2JSON, 0, len(orders))
+	for _, order := range orders {
+		arr = append(arr, newOrderV2JSON(order))
+	}
+
+	return c.JSON(http.StatusOK, arr)
+}
+
+type balanceV2JSON struct {
+	Current   string `json:"current"`
+	Withdrawn string `json:"withdrawn"`
+	Available string `json:"available"`
+	Reserved  string `json:"reserved"`
+}
+
+func (p *Proc) balanceV2(ctx context.Context, login string) (balanceV2JSON, error) {
+	balance, err := p.loyalty.Balance(ctx, login)
+	if err != nil {
+		return balanceV2JSON{}, err
+	}
+
+	return balanceV2JSON{
+		Current:   formatMoney(balance.Current),
+		Withdrawn: formatMoney(balance.Withdrawn),
+		Available: formatMoney(balance.Available()),
+		Reserved:  formatMoney(balance.Reserved),
+	}, nil
+}
+
+func (p *Proc) BalanceV2(c echo.Context) error {
+	// StatusOK 200 — успешная обработка запроса
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	result, err := p.balanceV2(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+type withdrawV2JSON struct {
+	Order string `json:"order"`
+	Sum   string `json:"sum"`
+}
+
+func (p *Proc) WithdrawV2(c echo.Context) error {
+	// StatusOK 200 — баллы списаны, в ответе баланс после списания
+	// StatusBadRequest 400 — неверный формат запроса или суммы
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusPaymentRequired 402 — на счету недостаточно средств
+	// StatusConflict 409 — в счёт заказа уже есть списание или активный резерв
+	// StatusUnprocessableEntity 422 — неверный номер заказа
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	var w withdrawV2JSON
+	err := json.NewDecoder(c.Request().Body).Decode(&w)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed request body", err)
+	}
+
+	sum, err := parseMoney(w.Sum)
+	if err != nil {
+		return newError(http.StatusBadRequest, CodeBadRequest, "malformed sum", err)
+	}
+
+	err = p.loyalty.Withdraw(c.Request().Context(), login, w.Order, sum)
+	if err != nil {
+		return err
+	}
+
+	result, err := p.balanceV2(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+type withdrawalV2JSON struct {
+	ID          string       `json:"id"`
+	Order       string       `json:"order"`
+	Sum         string       `json:"sum"`
+	ProcessedAt time.Time    `json:"processed_at"`
+	Refunded    string       `json:"refunded"`
+	Refunds     []refundJSON `json:"refunds"`
+}
+
+func newWithdrawalV2JSON(w loyalty.Withdrawal) withdrawalV2JSON {
+	item := withdrawalV2JSON{
+		ID:          w.ID,
+		Order:       w.OrderNumber,
+		Sum:         formatMoney(w.Sum),
+		ProcessedAt: w.ProcessedAt.UTC(),
+		Refunded:    formatMoney(w.Refunded()),
+		Refunds:     make([]refundJSON, 0, len(w.Refunds)),
+	}
+	for _, refund := range w.Refunds {
+		item.Refunds = append(item.Refunds, newRefundJSON(refund))
+	}
+	return item
+}
+
+func (p *Proc) WithdrawalsV2(c echo.Context) error {
+	// StatusOK 200 — успешная обработка запроса, в том числе пустой список
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusInternalServerError 500 — внутренняя ошибка сервера
+
+	login := c.Get("login").(string)
+
+	withdrawals, err := p.loyalty.Withdrawals(c.Request().Context(), login)
+	if err != nil {
+		return err
+	}
+
+	arr := make([]withdrawalV2JSON, 0, len(withdrawals))
+	for _, withdraw := range withdrawals {
+		arr = append(arr, newWithdrawalV2JSON(withdraw))
+	}
+
+	return c.JSON(http.StatusOK, arr)
+}
@@ -0,0 +1,274 @@
+package proc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// интервал сообщений ping от сервера; клиент отвечает pong или любым другим сообщением
+	wsHeartbeat = 30 * time.Second
+	// соединение закрывается, если от клиента нет сообщений дольше wsReadTimeout
+	wsReadTimeout  = 2 * wsHeartbeat
+	wsWriteTimeout = 10 * time.Second
+	// наибольший размер сообщения клиента
+	wsMaxMessage = 4 << 10
+)
+
+// типы сообщений WebSocket; события передаются с типом события: order, balance или tier
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsSubscribed  = "subscribed"
+	wsPing        = "ping"
+	wsPong        = "pong"
+	wsReset       = "reset"
+	wsError       = "error"
+)
+
+// wsTopics — события, на которые можно подписаться
+var wsTopics = map[string]bool{
+	events.TypeOrder:   true,
+	events.TypeBalance: true,
+	events.TypeTier:    true,
+}
+
+// wsClientMessage — сообщение клиента
+type wsClientMessage struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+// wsServerMessage — сообщение сервера. Идентификатор события передаётся строкой: он не помещается
+// в число JavaScript без потери точности.
+type wsServerMessage struct {
+	Type   string   `json:"type"`
+	ID     string   `json:"id,omitempty"`
+	Data   any      `json:"data,omitempty"`
+	Topics []string `json:"topics,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// wsSession — состояние соединения: подписки клиента и события для возобновления
+type wsSession struct {
+	topics map[string]bool
+	// replay и missed отправляются при первой подписке, когда клиент выбрал нужные события
+	replay []events.Event
+	missed bool
+	first  bool
+}
+
+func newWSSession(sub *events.Subscription) *wsSession {
+	return &wsSession{topics: make(map[string]bool), replay: sub.Replay, missed: sub.Missed, first: true}
+}
+
+// handle обрабатывает сообщение клиента и возвращает ответы на него
+func (s *wsSession) handle(raw []byte) []wsServerMessage {
+	var m wsClientMessage
+	err := json.Unmarshal(raw, &m)
+	if err != nil {
+		return []wsServerMessage{{Type: wsError, Error: "malformed message"}}
+	}
+
+	switch m.Type {
+	case wsPing:
+		return []wsServerMessage{{Type: wsPong}}
+	case wsPong:
+		return nil
+	case wsSubscribe, wsUnsubscribe:
+	default:
+		return []wsServerMessage{{Type: wsError, Error: fmt.Sprintf("unknown message type %q", m.Type)}}
+	}
+
+	if len(m.Topics) == 0 {
+		return []wsServerMessage{{Type: wsError, Error: "topics must not be empty"}}
+	}
+	for _, t := range m.Topics {
+		if !wsTopics[t] {
+			return []wsServerMessage{{Type: wsError, Error: fmt.Sprintf("unknown topic %q", t)}}
+		}
+	}
+
+	for _, t := range m.Topics {
+		if m.Type == wsSubscribe {
+			s.topics[t] = true
+		} else {
+			delete(s.topics, t)
+		}
+	}
+
+	out := []wsServerMessage{{Type: wsSubscribed, Topics: s.subscribed()}}
+	if m.Type == wsSubscribe && s.first {
+		s.first = false
+		if s.missed {
+			// часть событий потеряна: клиенту нужно перечитать заказы и баланс
+			out = append(out, wsServerMessage{Type: wsReset})
+		}
+		for _, e := range s.replay {
+			if msg, ok := s.event(e); ok {
+				out = append(out, msg)
+			}
+		}
+		s.replay = nil
+	}
+
+	return out
+}
+
+// event возвращает сообщение с событием, если клиент подписан на него
+func (s *wsSession) event(e events.Event) (wsServerMessage, bool) {
+	if !s.topics[e.Type] {
+		return wsServerMessage{}, false
+	}
+
+	data, err := eventData(e)
+	if err != nil {
+		return wsServerMessage{}, false
+	}
+	return wsServerMessage{Type: e.Type, ID: strconv.FormatUint(e.ID, 10), Data: data}, true
+}
+
+func (s *wsSession) subscribed() []string {
+	topics := []string{}
+	for _, t := range []string{events.TypeOrder, events.TypeBalance, events.TypeTier} {
+		if s.topics[t] {
+			topics = append(topics, t)
+		}
+	}
+	return topics
+}
+
+// wsCheckOrigin отклоняет подключения со страниц других сайтов: браузер передаёт cookie сессии
+// при подключении с любой страницы. Клиенты вне браузера Origin не передают.
+func wsCheckOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("malformed origin: %w", err)
+	}
+	if u.Host != r.Host {
+		return fmt.Errorf("origin %s does not match host %s", origin, r.Host)
+	}
+	config.Origin = u
+
+	return nil
+}
+
+func (p *Proc) Notifications(c echo.Context) error {
+	// StatusSwitchingProtocols 101 — соединение WebSocket установлено
+	// StatusBadRequest 400 — запрос не WebSocket или неверный last_event_id
+	// StatusUnauthorized 401 — пользователь не авторизован
+	// StatusForbidden 403 — подключение со страницы другого сайта
+
+	login := c.Get("login").(string)
+
+	if !c.IsWebSocket() {
+		return newError(http.StatusBadRequest, CodeBadRequest, "expected a WebSocket upgrade request", nil)
+	}
+
+	lastID, err := lastEventID(c)
+	if err != nil {
+		return err
+	}
+
+	srv := websocket.Server{
+		Handshake: wsCheckOrigin,
+		Handler: func(ws *websocket.Conn) {
+			p.notifications(ws, login, lastID)
+		},
+	}
+	srv.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+// notifications обслуживает соединение: сообщения клиента читаются в отдельной горутине,
+// а пишет в соединение только эта функция
+func (p *Proc) notifications(ws *websocket.Conn, login string, lastID uint64) {
+	ctx := ws.Request().Context()
+	ws.MaxPayloadBytes = wsMaxMessage
+
+	sub := p.events.Subscribe(login, lastID)
+	defer sub.Close()
+
+	session := newWSSession(sub)
+
+	messages := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(messages)
+		for {
+			// соединение унаследовало сроки сервера; они продлеваются на каждое сообщение
+			err := ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
+			if err != nil {
+				return
+			}
+
+			var raw []byte
+			err = websocket.Message.Receive(ws, &raw)
+			if err != nil {
+				p.logger.DebugContext(ctx, "websocket closed", "login", login, "error", err)
+				return
+			}
+
+			select {
+			case messages <- raw:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(msgs ...wsServerMessage) bool {
+		for _, m := range msgs {
+			err := ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err == nil {
+				err = websocket.JSON.Send(ws, m)
+			}
+			if err != nil {
+				p.logger.DebugContext(ctx, "websocket write", "login", login, "error", err)
+				return false
+			}
+		}
+		return true
+	}
+
+	heartbeat := time.NewTicker(wsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var ok bool
+		select {
+		case raw, open := <-messages:
+			if !open {
+				return
+			}
+			ok = send(session.handle(raw)...)
+		case e, open := <-sub.C:
+			if !open {
+				// подписчик отстал или сервер останавливается; клиент переподключится с last_event_id
+				return
+			}
+			msg, subscribed := session.event(e)
+			ok = !subscribed || send(msg)
+		case <-heartbeat.C:
+			ok = send(wsServerMessage{Type: wsPing})
+		}
+		if !ok {
+			return
+		}
+	}
+}
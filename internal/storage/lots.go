@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/jmoiron/sqlx"
+)
+
+type lot struct {
+	ID          string         `db:"id"`
+	Login       string         `db:"login"`
+	OrderNumber string         `db:"order_number"`
+	Amount      float64        `db:"amount"`
+	Remaining   float64        `db:"remaining"`
+	AccruedAt   string         `db:"accrued_at"`
+	ExpiresAt   sql.NullString `db:"expires_at"`
+}
+
+func (l lot) loyalty() (loyalty.Lot, error) {
+	accrued, err := time.Parse(time.RFC3339Nano, l.AccruedAt)
+	if err != nil {
+		return loyalty.Lot{}, fmt.Errorf("parse accrued_at: %w", err)
+	}
+
+	var expires time.Time
+	if l.ExpiresAt.Valid {
+		expires, err = time.Parse(time.RFC3339Nano, l.ExpiresAt.String)
+		if err != nil {
+			return loyalty.Lot{}, fmt.Errorf("parse expires_at: %w", err)
+		}
+	}
+
+	return loyalty.Lot{ID: l.ID, OrderNumber: l.OrderNumber, Amount: l.Amount, Remaining: l.Remaining, AccruedAt: accrued, ExpiresAt: expires}, nil
+}
+
+// accrue добавляет пользователю партию из sum баллов со сроком s.pointsTTL
+func (s *Storage) accrue(ctx context.Context, tx *sqlx.Tx, login, orderNumber string, sum float64) error {
+	if sum <= 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO gom_lots
+		VALUES (gen_random_uuid(), $1, $2, $3, $3, NOW(), CASE WHEN $4::double precision > 0 THEN NOW() + make_interval(secs => $4) END)
+	`, login, orderNumber, sum, s.pointsTTL.Seconds())
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+
+	return nil
+}
+
+// seedLegacyLots добавляет партию баллам, начисленным до появления партий: остатку баланса, не
+// покрытому партиями. Партия датируется первым начислением пользователя, чтобы расходоваться
+// первой, и сгорает через s.pointsTTL после её создания, а не после начисления, — иначе старые
+// баллы сгорели бы сразу после обновления. Повторный вызов ничего не добавляет.
+func (s *Storage) seedLegacyLots(ctx context.Context) (int64, error) {
+	res, err := s.sqlDB.ExecContext(ctx, `
+		INSERT INTO gom_lots
+		SELECT gen_random_uuid(), login, '', legacy, legacy, accrued_at, CASE WHEN $1::double precision > 0 THEN NOW() + make_interval(secs => $1) END
+		FROM (
+			SELECT b.login,
+				ROUND((b.current - COALESCE((SELECT SUM(remaining) FROM gom_lots l WHERE l.login = b.login), 0))::numeric, 2)::double precision AS legacy,
+				LEAST(
+					(SELECT MIN(COALESCE(processed_at, uploaded_at)) FROM gom_orders o WHERE o.login = b.login AND o.status = 'PROCESSED'),
+					(SELECT MIN(accrued_at) FROM gom_lots l WHERE l.login = b.login),
+					NOW()
+				) AS accrued_at
+			FROM gom_balances b
+		) balances
+		WHERE legacy > 0
+	`, s.pointsTTL.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("rows affected error: %w", err)
+	}
+
+	return n, nil
+}
+
+// consumeLots расходует sum с партий пользователя в порядке начисления; партии блокируются до
+// конца транзакции, поэтому одновременные списания не расходуют одну партию дважды
+func consumeLots(ctx context.Context, tx *sqlx.Tx, login string, sum float64) error {
+	rows, err := tx.QueryxContext(ctx, "SELECT * FROM gom_lots WHERE login = $1 AND remaining > 0 ORDER BY accrued_at, id FOR UPDATE", login)
+	if err != nil {
+		return fmt.Errorf("read rows: %w", err)
+	}
+
+	var lots []loyalty.Lot
+	for rows.Next() {
+		l := lot{}
+		err = rows.StructScan(&l)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("rows struct scan: %w", err)
+		}
+		lots = append(lots, loyalty.Lot{ID: l.ID, Remaining: l.Remaining})
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+
+	for i, taken := range loyalty.ConsumeLots(lots, sum) {
+		if taken == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE gom_lots SET remaining = $1 WHERE id = $2", math.Round((lots[i].Remaining-taken)*100)/100, lots[i].ID)
+		if err != nil {
+			return fmt.Errorf("db update error: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) ExpiringLots(ctx context.Context, login string) ([]loyalty.Lot, error) {
+	var result []loyalty.Lot
+
+	rows, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_lots WHERE login = $1 AND remaining > 0 AND expires_at IS NOT NULL ORDER BY expires_at, accrued_at", login)
+	if err != nil {
+		return result, fmt.Errorf("read rows: %w", err)
+	}
+	defer rows.Close()
+
+	l := lot{}
+	for rows.Next() {
+		err := rows.StructScan(&l)
+		if err != nil {
+			return result, fmt.Errorf("rows struct scan: %w", err)
+		}
+		item, err := l.loyalty()
+		if err != nil {
+			return result, err
+		}
+		result = append(result, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return result, fmt.Errorf("rows error: %w", err)
+	}
+
+	return result, nil
+}
+
+// ExpireLots списывает остатки просроченных партий, по одной транзакции на пользователя, чтобы
+// задание не держало блокировки балансов многих пользователей сразу
+func (s *Storage) ExpireLots(ctx context.Context) (int, error) {
+	var logins []string
+	err := s.sqlDB.SelectContext(ctx, &logins, "SELECT DISTINCT login FROM gom_lots WHERE remaining > 0 AND expires_at <= NOW() ORDER BY login")
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
+	var n int
+	for _, login := range logins {
+		expired, err := s.expireUserLots(ctx, login)
+		if err != nil {
+			return n, err
+		}
+		n += expired
+	}
+
+	return n, nil
+}
+
+// expireUserLots списывает остатки просроченных партий пользователя и возвращает число записей
+// о сгорании. Баланс блокируется раньше партий, как при списании, поэтому задание не
+// взаимоблокируется со списаниями пользователя.
+func (s *Storage) expireUserLots(ctx context.Context, login string) (int, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	b := loyalty.Balance{}
+	err = tx.QueryRowxContext(ctx, "SELECT current, withdrawn, reserved FROM gom_balances WHERE login = $1 FOR UPDATE", login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
+	var lots []lot
+	err = tx.SelectContext(ctx, &lots, "SELECT * FROM gom_lots WHERE login = $1 AND remaining > 0 AND expires_at <= NOW() ORDER BY accrued_at, id FOR UPDATE", login)
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
+	var n int
+	var total float64
+	for _, l := range lots {
+		sum := loyalty.ExpireAmount(b, l.Remaining)
+		if sum <= 0 {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE gom_lots SET remaining = $1 WHERE id = $2", math.Round((l.Remaining-sum)*100)/100, l.ID)
+		if err != nil {
+			return 0, fmt.Errorf("db update error: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO gom_expirations VALUES (gen_random_uuid(), $1, $2, $3, $4, NOW())", login, l.ID, l.OrderNumber, sum)
+		if err != nil {
+			return 0, fmt.Errorf("db error: %w", err)
+		}
+
+		b.Current -= sum
+		total += sum
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	e := events.Balance{}
+	err = tx.QueryRowxContext(ctx, "UPDATE gom_balances SET current = current - $1 WHERE login = $2 RETURNING current, withdrawn, reserved", total, login).Scan(&e.Current, &e.Withdrawn, &e.Reserved)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %w", err)
+	}
+
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeBalance, Balance: &e})
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commit error: %w", err)
+	}
+
+	return n, nil
+}
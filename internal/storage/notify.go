@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// канал LISTEN/NOTIFY, через который экземпляры сервиса обмениваются событиями пользователей
+const eventsChannel = "gom_events"
+
+const (
+	listenerMinReconnect = 100 * time.Millisecond
+	listenerMaxReconnect = 10 * time.Second
+	// интервал проверки соединения слушателя, когда уведомлений нет
+	listenerPing = 90 * time.Second
+)
+
+// notify отправляет событие в eventsChannel в транзакции tx: PostgreSQL доставляет уведомление
+// слушателям только после фиксации транзакции, а при откате не доставляет вовсе
+func notify(ctx context.Context, tx sqlx.ExecerContext, e events.Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", eventsChannel, string(payload))
+	if err != nil {
+		return fmt.Errorf("notify error: %w", err)
+	}
+
+	return nil
+}
+
+// listen подписывается на eventsChannel отдельным соединением и публикует полученные события
+// в шину процесса, в том числе отправленные этим же экземпляром
+func (s *Storage) listen(uri string) error {
+	s.listener = pq.NewListener(uri, listenerMinReconnect, listenerMaxReconnect, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			s.logger.Warn("events listener disconnected", "error", err)
+		case pq.ListenerEventReconnected:
+			// уведомления, отправленные во время разрыва, потеряны
+			s.logger.Warn("events listener reconnected, events sent while disconnected are lost")
+		}
+	})
+
+	err := s.listener.Listen(eventsChannel)
+	if err != nil {
+		s.listener.Close()
+		return fmt.Errorf("listen %s: %w", eventsChannel, err)
+	}
+
+	go s.dispatch()
+
+	return nil
+}
+
+func (s *Storage) dispatch() {
+	ping := time.NewTicker(listenerPing)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n, ok := <-s.listener.Notify:
+			if !ok {
+				// слушатель закрыт в Close
+				return
+			}
+			if n == nil {
+				// соединение восстановлено после разрыва
+				continue
+			}
+
+			var e events.Event
+			err := json.Unmarshal([]byte(n.Extra), &e)
+			if err != nil {
+				s.logger.Error("malformed event notification", "error", err, "payload", n.Extra)
+				continue
+			}
+			s.events.Publish(e)
+		case <-ping.C:
+			err := s.listener.Ping()
+			if err != nil {
+				s.logger.Warn("events listener ping", "error", err)
+			}
+		}
+	}
+}
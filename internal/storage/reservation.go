@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
+	"github.com/jmoiron/sqlx"
+)
+
+type reservation struct {
+	ID          string  `db:"id"`
+	Login       string  `db:"login"`
+	OrderNumber string  `db:"order_number"`
+	Sum         float64 `db:"sum"`
+	Status      string  `db:"status"`
+	CreatedAt   string  `db:"created_at"`
+	ExpiresAt   string  `db:"expires_at"`
+}
+
+func (r reservation) loyalty() (loyalty.Reservation, error) {
+	created, err := time.Parse(time.RFC3339Nano, r.CreatedAt)
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("parse created_at: %w", err)
+	}
+	expires, err := time.Parse(time.RFC3339Nano, r.ExpiresAt)
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("parse expires_at: %w", err)
+	}
+
+	return loyalty.Reservation{ID: r.ID, OrderNumber: r.OrderNumber, Sum: r.Sum, Status: r.Status, CreatedAt: created, ExpiresAt: expires}, nil
+}
+
+// Reserve резервирует баллы: резерв уменьшает доступные баллы current - reserved, баланс current
+// не меняется до подтверждения
+func (s *Storage) Reserve(ctx context.Context, login, orderNumber string, sum float64, expiresAt time.Time) (loyalty.Reservation, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = claimOrder(ctx, tx, orderNumber)
+	if err != nil {
+		return loyalty.Reservation{}, err
+	}
+
+	b := events.Balance{}
+	err = tx.QueryRowxContext(ctx, "UPDATE gom_balances SET reserved = reserved + $1 WHERE login = $2 AND current - reserved >= $1 RETURNING current, withdrawn, reserved", sum, login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
+	if err == sql.ErrNoRows {
+		return loyalty.Reservation{}, ErrInsufficientFunds
+	} else if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("db error: %w", err)
+	}
+
+	r := reservation{}
+	err = tx.QueryRowxContext(ctx, "INSERT INTO gom_reservations VALUES (gen_random_uuid(), $1, $2, $3, 'active', NOW(), $4) RETURNING *", login, orderNumber, sum, expiresAt).StructScan(&r)
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("db error: %w", err)
+	}
+
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeBalance, Balance: &b})
+	if err != nil {
+		return loyalty.Reservation{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("commit error: %w", err)
+	}
+
+	return r.loyalty()
+}
+
+// closeReservation переводит активный неистёкший резерв пользователя в status
+func closeReservation(ctx context.Context, tx *sqlx.Tx, login, id, status string) (reservation, error) {
+	r := reservation{}
+	err := tx.QueryRowxContext(ctx, "UPDATE gom_reservations SET status = $1 WHERE id = $2 AND login = $3 AND status = 'active' AND expires_at > NOW() RETURNING *", status, id, login).StructScan(&r)
+	if err == nil {
+		return r, nil
+	} else if err != sql.ErrNoRows {
+		return r, fmt.Errorf("db update error: %w", err)
+	}
+
+	var count int
+	err = tx.QueryRowxContext(ctx, "SELECT COUNT(*) FROM gom_reservations WHERE id = $1 AND login = $2", id, login).Scan(&count)
+	if err != nil {
+		return r, fmt.Errorf("read rows: %w", err)
+	}
+	if count == 0 {
+		return r, ErrNotFound
+	}
+	return r, loyalty.ErrReservationClosed
+}
+
+func (s *Storage) CaptureReservation(ctx context.Context, login, id string) (loyalty.Withdrawal, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return loyalty.Withdrawal{}, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	r, err := closeReservation(ctx, tx, login, id, loyalty.ReservationCaptured)
+	if err != nil {
+		return loyalty.Withdrawal{}, err
+	}
+
+	b := events.Balance{}
+	err = tx.QueryRowxContext(ctx, "UPDATE gom_balances SET current = current - $1, withdrawn = withdrawn + $1, reserved = reserved - $1 WHERE login = $2 RETURNING current, withdrawn, reserved", r.Sum, login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
+	if err != nil {
+		return loyalty.Withdrawal{}, fmt.Errorf("db error: %w", err)
+	}
+
+	wd := withdraw{}
+	err = tx.QueryRowxContext(ctx, "INSERT INTO gom_withdrawals VALUES (gen_random_uuid(), $1, $2, $3, NOW()) RETURNING *", login, r.OrderNumber, r.Sum).StructScan(&wd)
+	if err != nil {
+		return loyalty.Withdrawal{}, fmt.Errorf("db error: %w", err)
+	}
+
+	err = consumeLots(ctx, tx, login, r.Sum)
+	if err != nil {
+		return loyalty.Withdrawal{}, err
+	}
+
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeBalance, Balance: &b})
+	if err != nil {
+		return loyalty.Withdrawal{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loyalty.Withdrawal{}, fmt.Errorf("commit error: %w", err)
+	}
+
+	return wd.loyalty()
+}
+
+func (s *Storage) ReleaseReservation(ctx context.Context, login, id string) (loyalty.Reservation, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	r, err := closeReservation(ctx, tx, login, id, loyalty.ReservationReleased)
+	if err != nil {
+		return loyalty.Reservation{}, err
+	}
+
+	err = s.unreserve(ctx, tx, login, r.Sum)
+	if err != nil {
+		return loyalty.Reservation{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loyalty.Reservation{}, fmt.Errorf("commit error: %w", err)
+	}
+
+	return r.loyalty()
+}
+
+// unreserve возвращает sum зарезервированных баллов пользователя в доступные
+func (s *Storage) unreserve(ctx context.Context, tx *sqlx.Tx, login string, sum float64) error {
+	b := events.Balance{}
+	err := tx.QueryRowxContext(ctx, "UPDATE gom_balances SET reserved = reserved - $1 WHERE login = $2 RETURNING current, withdrawn, reserved", sum, login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+
+	return notify(ctx, tx, events.Event{Login: login, Type: events.TypeBalance, Balance: &b})
+}
+
+// ExpireReservations снимает истёкшие резервы, по одной транзакции на пользователя, чтобы задание
+// не держало блокировки балансов многих пользователей сразу. Экземпляры сервиса могут выполнять его
+// одновременно, каждый резерв снимается один раз.
+func (s *Storage) ExpireReservations(ctx context.Context) (int, error) {
+	var logins []string
+	err := s.sqlDB.SelectContext(ctx, &logins, "SELECT DISTINCT login FROM gom_reservations WHERE status = 'active' AND expires_at <= NOW() ORDER BY login")
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
+	var n int
+	for _, login := range logins {
+		expired, err := s.expireUserReservations(ctx, login)
+		if err != nil {
+			return n, err
+		}
+		n += expired
+	}
+
+	return n, nil
+}
+
+// expireUserReservations снимает истёкшие резервы пользователя и возвращает их число. Резервы
+// блокируются раньше баланса, как при подтверждении и снятии резерва.
+func (s *Storage) expireUserReservations(ctx context.Context, login string) (int, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	var sums []float64
+	err = tx.SelectContext(ctx, &sums, "UPDATE gom_reservations SET status = 'expired' WHERE login = $1 AND status = 'active' AND expires_at <= NOW() RETURNING sum", login)
+	if err != nil {
+		return 0, fmt.Errorf("db update error: %w", err)
+	}
+	if len(sums) == 0 {
+		return 0, nil
+	}
+
+	var total float64
+	for _, sum := range sums {
+		total += sum
+	}
+
+	err = s.unreserve(ctx, tx, login, total)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("commit error: %w", err)
+	}
+
+	return len(sums), nil
+}
@@ -1,25 +1,75 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"time"
 
+	"github.com/XSAM/otelsql"
+	"github.com/inkpics/gophermart/internal/config"
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 )
 
+// SchemaVersion — версия схемы, которую создаёт New; увеличивается при каждом изменении схемы
+const SchemaVersion = 7
+
+// ошибки хранилища совпадают с ошибками loyalty.Repository
+var (
+	ErrDuplicateKey      = loyalty.ErrDuplicate
+	ErrNotFound          = loyalty.ErrNotFound
+	ErrWrongCredentials  = loyalty.ErrWrongCredentials
+	ErrInsufficientFunds = loyalty.ErrInsufficientFunds
+)
+
+// Storage реализует loyalty.Repository поверх PostgreSQL
 type Storage struct {
-	sqlDB           *sqlx.DB
-	ErrDuplicateKey error
+	logger *slog.Logger
+	sqlDB  *sqlx.DB
+	// изменения статусов заказов и балансов отправляются через NOTIFY и после фиксации транзакции
+	// приходят в events на всех экземплярах сервиса
+	events   *events.Bus
+	listener *pq.Listener
+	// срок жизни начисленных баллов; 0 — баллы не сгорают
+	pointsTTL time.Duration
 }
 
+var _ loyalty.Repository = (*Storage)(nil)
+
 type order struct {
-	ID         string  `db:"id"`
-	Login      string  `db:"login"`
-	Number     string  `db:"number"`
-	Status     string  `db:"status"`
-	Accrual    float64 `db:"accrual"`
-	UploadedAt string  `db:"uploaded_at"`
+	ID            string         `db:"id"`
+	Login         string         `db:"login"`
+	Number        string         `db:"number"`
+	Status        string         `db:"status"`
+	Accrual       float64        `db:"accrual"`
+	UploadedAt    string         `db:"uploaded_at"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt string         `db:"next_attempt_at"`
+	LastError     string         `db:"last_error"`
+	ProcessedAt   sql.NullString `db:"processed_at"`
+}
+
+// loyalty переводит строку заказа в заказ пользователя
+func (o order) loyalty() (loyalty.Order, error) {
+	uploaded, err := time.Parse(time.RFC3339Nano, o.UploadedAt)
+	if err != nil {
+		return loyalty.Order{}, fmt.Errorf("parse uploaded_at: %w", err)
+	}
+
+	var processed time.Time
+	if o.ProcessedAt.Valid {
+		processed, err = time.Parse(time.RFC3339Nano, o.ProcessedAt.String)
+		if err != nil {
+			return loyalty.Order{}, fmt.Errorf("parse processed_at: %w", err)
+		}
+	}
+
+	return loyalty.Order{ID: o.ID, Number: o.Number, Status: o.Status, Accrual: o.Accrual, UploadedAt: uploaded, ProcessedAt: processed}, nil
 }
 
 type balance struct {
@@ -27,6 +77,7 @@ type balance struct {
 	Login     string  `db:"login"`
 	Current   float64 `db:"current"`
 	Withdrawn float64 `db:"withdrawn"`
+	Reserved  float64 `db:"reserved"`
 }
 
 type withdraw struct {
@@ -37,18 +88,76 @@ type withdraw struct {
 	ProcessedAt string  `db:"processed_at"`
 }
 
-func New(databaseAddr string) (*Storage, error) {
-	db, err := sqlx.Connect("postgres", databaseAddr)
+func (w withdraw) loyalty() (loyalty.Withdrawal, error) {
+	processed, err := time.Parse(time.RFC3339Nano, w.ProcessedAt)
 	if err != nil {
+		return loyalty.Withdrawal{}, fmt.Errorf("parse processed_at: %w", err)
+	}
+
+	return loyalty.Withdrawal{ID: w.ID, OrderNumber: w.OrderNumber, Sum: w.Sum, ProcessedAt: processed}, nil
+}
+
+type refund struct {
+	ID           string         `db:"id"`
+	WithdrawalID string         `db:"withdrawal_id"`
+	Login        string         `db:"login"`
+	Sum          float64        `db:"sum"`
+	Source       string         `db:"source"`
+	ExternalID   sql.NullString `db:"external_id"`
+	ProcessedAt  string         `db:"processed_at"`
+}
+
+func (r refund) loyalty() (loyalty.Refund, error) {
+	processed, err := time.Parse(time.RFC3339Nano, r.ProcessedAt)
+	if err != nil {
+		return loyalty.Refund{}, fmt.Errorf("parse processed_at: %w", err)
+	}
+
+	return loyalty.Refund{ID: r.ID, WithdrawalID: r.WithdrawalID, Sum: r.Sum, Source: r.Source, ExternalID: r.ExternalID.String, ProcessedAt: processed}, nil
+}
+
+// StatementEntry — движение баллов по счёту пользователя: начисление за заказ, списание, возврат
+// списания или сгорание остатка начисления
+type StatementEntry struct {
+	Kind        string    `db:"kind"`
+	OrderNumber string    `db:"order_number"`
+	Amount      float64   `db:"amount"`
+	At          time.Time `db:"at"`
+}
+
+type totals struct {
+	OrdersNew        int     `db:"orders_new"`
+	OrdersProcessing int     `db:"orders_processing"`
+	OrdersDead       int     `db:"orders_dead"`
+	Accrued          float64 `db:"accrued"`
+	Withdrawn        float64 `db:"withdrawn"`
+	Refunded         float64 `db:"refunded"`
+}
+
+func New(ctx context.Context, logger *slog.Logger, cfg config.Database, pointsTTL time.Duration, bus *events.Bus) (*Storage, error) {
+	sqlDB, err := otelsql.Open("postgres", cfg.URI, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+	if err != nil {
+		return nil, fmt.Errorf("db connect: %w", err)
+	}
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	db := sqlx.NewDb(sqlDB, "postgres")
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("db connect: %w", err)
 	}
 
 	s := &Storage{
-		sqlDB:           db,
-		ErrDuplicateKey: fmt.Errorf("duplicate key"),
+		logger:    logger,
+		sqlDB:     db,
+		events:    bus,
+		pointsTTL: pointsTTL,
 	}
 
-	s.sqlDB.MustExec(`
+	_, err = s.sqlDB.ExecContext(ctx, `
 		CREATE EXTENSION IF NOT EXISTS pgcrypto;
 
         CREATE TABLE IF NOT EXISTS gom_users (
@@ -66,6 +175,11 @@ func New(databaseAddr string) (*Storage, error) {
             uploaded_at timestamp with time zone
         );
 
+        ALTER TABLE gom_orders ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
+        ALTER TABLE gom_orders ADD COLUMN IF NOT EXISTS next_attempt_at timestamp with time zone NOT NULL DEFAULT NOW();
+        ALTER TABLE gom_orders ADD COLUMN IF NOT EXISTS last_error text NOT NULL DEFAULT '';
+        ALTER TABLE gom_orders ADD COLUMN IF NOT EXISTS processed_at timestamp with time zone;
+
         CREATE TABLE IF NOT EXISTS gom_balances (
             id text primary key,
             login text,
@@ -73,6 +187,8 @@ func New(databaseAddr string) (*Storage, error) {
             withdrawn double precision
         );
 
+        ALTER TABLE gom_balances ADD COLUMN IF NOT EXISTS reserved double precision NOT NULL DEFAULT 0;
+
         CREATE TABLE IF NOT EXISTS gom_withdrawals (
             id text primary key,
             login text,
@@ -80,32 +196,176 @@ func New(databaseAddr string) (*Storage, error) {
             sum double precision,
             processed_at timestamp with time zone
         );
+
+        CREATE TABLE IF NOT EXISTS gom_refunds (
+            id text primary key,
+            withdrawal_id text,
+            login text,
+            sum double precision,
+            source text,
+            external_id text,
+            processed_at timestamp with time zone
+        );
+
+        -- идентификатор возврата магазина уникален в пределах списания, а не глобально
+        ALTER TABLE gom_refunds DROP CONSTRAINT IF EXISTS gom_refunds_external_id_key;
+        CREATE UNIQUE INDEX IF NOT EXISTS gom_refunds_external_id_idx ON gom_refunds (withdrawal_id, external_id);
+
+        CREATE TABLE IF NOT EXISTS gom_reservations (
+            id text primary key,
+            login text,
+            order_number text,
+            sum double precision,
+            status text,
+            created_at timestamp with time zone,
+            expires_at timestamp with time zone
+        );
+
+        CREATE TABLE IF NOT EXISTS gom_lots (
+            id text primary key,
+            login text,
+            order_number text,
+            amount double precision,
+            remaining double precision,
+            accrued_at timestamp with time zone,
+            expires_at timestamp with time zone
+        );
+
+        CREATE INDEX IF NOT EXISTS gom_lots_login_idx ON gom_lots (login, accrued_at) WHERE remaining > 0;
+        CREATE INDEX IF NOT EXISTS gom_lots_expires_at_idx ON gom_lots (expires_at) WHERE remaining > 0;
+
+        CREATE TABLE IF NOT EXISTS gom_expirations (
+            id text primary key,
+            login text,
+            lot_id text,
+            order_number text,
+            sum double precision,
+            expired_at timestamp with time zone
+        );
+
+        CREATE TABLE IF NOT EXISTS gom_tiers (
+            login text primary key,
+            tier text,
+            changed_at timestamp with time zone
+        );
+
+        CREATE TABLE IF NOT EXISTS gom_tier_history (
+            id text primary key,
+            login text,
+            tier text,
+            previous text,
+            accrued double precision,
+            changed_at timestamp with time zone
+        );
+
+        CREATE TABLE IF NOT EXISTS gom_schema (
+            id integer primary key,
+            version integer
+        );
     `)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db migrate: %w", err)
+	}
+
+	seeded, err := s.seedLegacyLots(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db migrate: %w", err)
+	}
+	if seeded > 0 {
+		logger.InfoContext(ctx, "legacy balances moved to lots", "count", seeded)
+	}
+
+	_, err = s.sqlDB.ExecContext(ctx, "INSERT INTO gom_schema VALUES (1, $1) ON CONFLICT (id) DO UPDATE SET version = $1", SchemaVersion)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db migrate: %w", err)
+	}
+
+	logger.InfoContext(ctx, "database schema is up to date", "dsn", cfg.URI, "schema_version", SchemaVersion)
+
+	err = s.listen(cfg.URI)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db listen: %w", err)
+	}
 
 	return s, nil
 }
 
-func (s *Storage) UserRegister(login, password string) error {
-	tx, err := s.sqlDB.Begin()
+func (s *Storage) Close() error {
+	err := s.listener.Close()
+	if err != nil {
+		s.sqlDB.Close()
+		return fmt.Errorf("close listener: %w", err)
+	}
+	return s.sqlDB.Close()
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.sqlDB.PingContext(ctx)
+}
+
+func (s *Storage) Version(ctx context.Context) (int, error) {
+	var version int
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT version FROM gom_schema WHERE id = 1").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
+	return version, nil
+}
+
+func (s *Storage) Stats() sql.DBStats {
+	return s.sqlDB.Stats()
+}
+
+// Totals возвращает размер очереди расчёта и суммарные начисления, списания и возвраты по всем
+// пользователям. Списания суммируются по журналу без вычета возвратов: gom_balances.withdrawn
+// уменьшается при возврате, а счётчик не должен убывать.
+func (s *Storage) Totals(ctx context.Context) (totals, error) {
+	t := totals{}
+
+	err := s.sqlDB.QueryRowxContext(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE status = 'NEW') AS orders_new,
+			COUNT(*) FILTER (WHERE status = 'PROCESSING') AS orders_processing,
+			COUNT(*) FILTER (WHERE status = 'DEAD') AS orders_dead,
+			COALESCE(SUM(accrual) FILTER (WHERE status = 'PROCESSED'), 0) AS accrued,
+			(SELECT COALESCE(SUM(sum), 0) FROM gom_withdrawals) AS withdrawn,
+			(SELECT COALESCE(SUM(sum), 0) FROM gom_refunds) AS refunded
+		FROM gom_orders
+	`).StructScan(&t)
+	if err != nil {
+		return t, fmt.Errorf("read rows: %w", err)
+	}
+
+	return t, nil
+}
+
+func (s *Storage) UserRegister(ctx context.Context, login, password string) error {
+	tx, err := s.sqlDB.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("tx error: %w", err)
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec("INSERT INTO gom_users VALUES (gen_random_uuid(), $1, $2)", login, password)
+	_, err = tx.ExecContext(ctx, "INSERT INTO gom_users VALUES (gen_random_uuid(), $1, $2)", login, password)
 	if err != nil {
 		if err, ok := err.(*pq.Error); ok {
 			if err.Code == "23505" {
-				return s.ErrDuplicateKey
+				return ErrDuplicateKey
 			}
 		}
 		return fmt.Errorf("db error: %w", err)
 	}
 
-	_, err = tx.Exec("INSERT INTO gom_balances VALUES (gen_random_uuid(), $1, 0, 0)", login)
+	_, err = tx.ExecContext(ctx, "INSERT INTO gom_balances VALUES (gen_random_uuid(), $1, 0, 0)", login)
 	if err != nil {
 		if err, ok := err.(*pq.Error); ok {
 			if err.Code == "23505" {
-				return s.ErrDuplicateKey
+				return ErrDuplicateKey
 			}
 		}
 		return fmt.Errorf("db error: %w", err)
@@ -119,43 +379,43 @@ func (s *Storage) UserRegister(login, password string) error {
 	return nil
 }
 
-func (s *Storage) UserLogin(login, password string) error {
+func (s *Storage) UserLogin(ctx context.Context, login, password string) error {
 	var count int
-	err := s.sqlDB.QueryRowx("SELECT COUNT(*) FROM gom_users WHERE login = $1 AND password = $2", login, password).Scan(&count)
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT COUNT(*) FROM gom_users WHERE login = $1 AND password = $2", login, password).Scan(&count)
 	if err != nil {
 		return fmt.Errorf("read rows: %w", err)
 	}
 	if count < 1 {
-		return fmt.Errorf("no credentials matches: %w", err)
+		return ErrWrongCredentials
 	}
 
 	return nil
 }
 
-func (s *Storage) OrderRegistered(login, orderNumber string) (int, error) {
+func (s *Storage) OrderRegistered(ctx context.Context, login, orderNumber string) (loyalty.Ownership, error) {
 	o := order{}
-	err := s.sqlDB.QueryRowx("SELECT * FROM gom_orders WHERE number = $1 LIMIT 1", orderNumber).StructScan(&o)
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT * FROM gom_orders WHERE number = $1 LIMIT 1", orderNumber).StructScan(&o)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, nil
+			return loyalty.OwnershipNone, nil
 		}
-		return 0, fmt.Errorf("read rows: %w", err)
+		return loyalty.OwnershipNone, fmt.Errorf("read rows: %w", err)
 	}
 	if o.Login == login {
-		return 1, nil
+		return loyalty.OwnershipUser, nil
 	} else if o.Login != "" {
-		return -1, nil
+		return loyalty.OwnershipOther, nil
 	}
 
-	return 0, nil
+	return loyalty.OwnershipNone, nil
 }
 
-func (s *Storage) OrderRegister(login, orderNumber string) error {
-	_, err := s.sqlDB.Exec("INSERT INTO gom_orders VALUES (gen_random_uuid(), $1, $2, 'NEW', 0, NOW())", login, orderNumber)
+func (s *Storage) OrderRegister(ctx context.Context, login, orderNumber string) error {
+	_, err := s.sqlDB.ExecContext(ctx, "INSERT INTO gom_orders VALUES (gen_random_uuid(), $1, $2, 'NEW', 0, NOW())", login, orderNumber)
 	if err != nil {
 		if err, ok := err.(*pq.Error); ok {
 			if err.Code == "23505" {
-				return s.ErrDuplicateKey
+				return ErrDuplicateKey
 			}
 		}
 		return fmt.Errorf("db error: %w", err)
@@ -164,11 +424,80 @@ func (s *Storage) OrderRegister(login, orderNumber string) error {
 	return nil
 }
 
-func (s *Storage) Orders(login string) ([]order, error) {
-	var result []order
+// OrdersRegisterBatch регистрирует номера заказов пользователя в одной транзакции. Для каждого
+// номера возвращается то же, что и OrderRegistered до регистрации: OwnershipNone — номер
+// зарегистрирован сейчас.
+func (s *Storage) OrdersRegisterBatch(ctx context.Context, login string, orderNumbers []string) (map[string]loyalty.Ownership, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	result := make(map[string]loyalty.Ownership, len(orderNumbers))
+
+	rows, err := tx.QueryxContext(ctx, `
+        INSERT INTO gom_orders (id, login, number, status, accrual, uploaded_at)
+        SELECT gen_random_uuid(), $1, n, 'NEW', 0, NOW() FROM unnest($2::text[]) AS n
+        ON CONFLICT (number) DO NOTHING
+        RETURNING number`, login, pq.Array(orderNumbers))
+	if err != nil {
+		return nil, fmt.Errorf("db insert error: %w", err)
+	}
+	for rows.Next() {
+		var number string
+		err = rows.Scan(&number)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("rows scan: %w", err)
+		}
+		result[number] = loyalty.OwnershipNone
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	rows, err = tx.QueryxContext(ctx, "SELECT number, login FROM gom_orders WHERE number = ANY($1)", pq.Array(orderNumbers))
+	if err != nil {
+		return nil, fmt.Errorf("read rows: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var number, owner string
+		err = rows.Scan(&number, &owner)
+		if err != nil {
+			return nil, fmt.Errorf("rows scan: %w", err)
+		}
+		if _, ok := result[number]; ok {
+			continue
+		}
+		if owner == login {
+			result[number] = loyalty.OwnershipUser
+		} else {
+			result[number] = loyalty.OwnershipOther
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("commit error: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) Orders(ctx context.Context, login string) ([]loyalty.Order, error) {
+	var result []loyalty.Order
 
 	o := order{}
-	rows, err := s.sqlDB.Queryx("SELECT * FROM gom_orders WHERE login =$1", login)
+	rows, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_orders WHERE login =$1", login)
 	if err != nil {
 		return result, fmt.Errorf("read rows: %w", err)
 	}
@@ -179,7 +508,11 @@ func (s *Storage) Orders(login string) ([]order, error) {
 		if err != nil {
 			return result, fmt.Errorf("rows struct scan: %w", err)
 		}
-		result = append(result, o)
+		item, err := o.loyalty()
+		if err != nil {
+			return result, err
+		}
+		result = append(result, item)
 	}
 
 	err = rows.Err()
@@ -190,66 +523,121 @@ func (s *Storage) Orders(login string) ([]order, error) {
 	return result, nil
 }
 
-func (s *Storage) UserBalance(login string) (balance, error) {
-	b := balance{}
+func (s *Storage) Order(ctx context.Context, login, orderNumber string) (loyalty.Order, error) {
+	o := order{}
 
-	err := s.sqlDB.QueryRowx("SELECT * FROM gom_balances WHERE login = $1 LIMIT 1", login).StructScan(&b)
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT * FROM gom_orders WHERE login = $1 AND number = $2 LIMIT 1", login, orderNumber).StructScan(&o)
 	if err != nil {
-		return b, fmt.Errorf("read rows: %w", err)
+		if err == sql.ErrNoRows {
+			return loyalty.Order{}, ErrNotFound
+		}
+		return loyalty.Order{}, fmt.Errorf("read rows: %w", err)
 	}
 
-	return b, nil
+	return o.loyalty()
 }
 
-func (s *Storage) Withdraw(login, orderNumber string, sum float64) (int, error) {
+func (s *Storage) UserBalance(ctx context.Context, login string) (loyalty.Balance, error) {
 	b := balance{}
-	err := s.sqlDB.QueryRowx("SELECT * FROM gom_balances WHERE login = $1 LIMIT 1", login).StructScan(&b)
+
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT * FROM gom_balances WHERE login = $1 LIMIT 1", login).StructScan(&b)
 	if err != nil {
-		return 0, fmt.Errorf("read rows: %w", err)
+		return loyalty.Balance{}, fmt.Errorf("read rows: %w", err)
 	}
-	if b.Current < sum {
-		return 402, nil
+
+	return loyalty.Balance{Current: b.Current, Withdrawn: b.Withdrawn, Reserved: b.Reserved}, nil
+}
+
+// claimOrder проверяет, что в счёт заказа нет списания или активного резерва. Номер заказа
+// блокируется до конца транзакции, поэтому одновременные списания по одному заказу проверяются
+// по очереди.
+func claimOrder(ctx context.Context, tx *sqlx.Tx, orderNumber string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", orderNumber)
+	if err != nil {
+		return fmt.Errorf("lock order: %w", err)
 	}
 
-	tx, err := s.sqlDB.Begin()
+	var claimed bool
+	err = tx.QueryRowxContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM gom_withdrawals WHERE order_number = $1) OR
+			EXISTS (SELECT 1 FROM gom_reservations WHERE order_number = $1 AND status = 'active' AND expires_at > NOW())
+	`, orderNumber).Scan(&claimed)
 	if err != nil {
-		return 0, fmt.Errorf("tx error: %w", err)
+		return fmt.Errorf("read rows: %w", err)
+	}
+	if claimed {
+		return loyalty.ErrOrderWithdrawn
 	}
 
-	_, err = tx.Exec("UPDATE gom_balances SET current = $1, withdrawn = $2 WHERE login = $3", b.Current-sum, b.Withdrawn+sum, login)
+	return nil
+}
+
+func (s *Storage) Withdraw(ctx context.Context, login, orderNumber string, sum float64) error {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("db error: %w", err)
+		return fmt.Errorf("tx error: %w", err)
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec("INSERT INTO gom_withdrawals VALUES (gen_random_uuid(), $1, $2, $3, NOW())", login, orderNumber, sum)
+	err = claimOrder(ctx, tx, orderNumber)
 	if err != nil {
-		return 0, fmt.Errorf("db error: %w", err)
+		return err
+	}
+
+	// баланс меняется одним запросом: начисления и возвраты могут проводиться одновременно
+	b := events.Balance{}
+	err = tx.QueryRowxContext(ctx, "UPDATE gom_balances SET current = current - $1, withdrawn = withdrawn + $1 WHERE login = $2 AND current - reserved >= $1 RETURNING current, withdrawn, reserved", sum, login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
+	if err == sql.ErrNoRows {
+		return ErrInsufficientFunds
+	} else if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO gom_withdrawals VALUES (gen_random_uuid(), $1, $2, $3, NOW())", login, orderNumber, sum)
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+
+	err = consumeLots(ctx, tx, login, sum)
+	if err != nil {
+		return err
+	}
+
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeBalance, Balance: &b})
+	if err != nil {
+		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return 0, fmt.Errorf("commit error: %w", err)
+		return fmt.Errorf("commit error: %w", err)
 	}
 
-	return 0, nil
+	return nil
 }
 
-func (s *Storage) Withdrawals(login string) ([]withdraw, error) {
-	var result []withdraw
+func (s *Storage) Withdrawals(ctx context.Context, login string) ([]loyalty.Withdrawal, error) {
+	var result []loyalty.Withdrawal
 
 	wd := withdraw{}
-	rows, err := s.sqlDB.Queryx("SELECT * FROM gom_withdrawals")
+	rows, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_withdrawals WHERE login = $1 ORDER BY processed_at", login)
 	if err != nil {
 		return result, fmt.Errorf("read rows: %w", err)
 	}
 	defer rows.Close()
 
+	positions := make(map[string]int)
 	for rows.Next() {
 		err := rows.StructScan(&wd)
 		if err != nil {
 			return result, fmt.Errorf("rows struct scan: %w", err)
 		}
-		result = append(result, wd)
+		item, err := wd.loyalty()
+		if err != nil {
+			return result, err
+		}
+		positions[item.ID] = len(result)
+		result = append(result, item)
 	}
 
 	err = rows.Err()
@@ -257,19 +645,210 @@ func (s *Storage) Withdrawals(login string) ([]withdraw, error) {
 		return result, fmt.Errorf("rows error: %w", err)
 	}
 
+	r := refund{}
+	refunds, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_refunds WHERE login = $1 ORDER BY processed_at", login)
+	if err != nil {
+		return result, fmt.Errorf("read rows: %w", err)
+	}
+	defer refunds.Close()
+
+	for refunds.Next() {
+		err := refunds.StructScan(&r)
+		if err != nil {
+			return result, fmt.Errorf("rows struct scan: %w", err)
+		}
+		item, err := r.loyalty()
+		if err != nil {
+			return result, err
+		}
+		if i, ok := positions[item.WithdrawalID]; ok {
+			result[i].Refunds = append(result[i].Refunds, item)
+		}
+	}
+
+	err = refunds.Err()
+	if err != nil {
+		return result, fmt.Errorf("rows error: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) WithdrawalByOrder(ctx context.Context, orderNumber string) (loyalty.Withdrawal, error) {
+	wd := withdraw{}
+
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT * FROM gom_withdrawals WHERE order_number = $1 ORDER BY processed_at DESC LIMIT 1", orderNumber).StructScan(&wd)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return loyalty.Withdrawal{}, ErrNotFound
+		}
+		return loyalty.Withdrawal{}, fmt.Errorf("read rows: %w", err)
+	}
+
+	return wd.loyalty()
+}
+
+// Refund проводит возврат по списанию. Строка списания блокируется до конца транзакции, поэтому
+// одновременные возвраты по одному списанию проверяются по очереди и не превышают его суммы.
+func (s *Storage) Refund(ctx context.Context, r loyalty.Refund) (loyalty.Refund, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return loyalty.Refund{}, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	wd := withdraw{}
+	err = tx.QueryRowxContext(ctx, "SELECT * FROM gom_withdrawals WHERE id = $1 FOR UPDATE", r.WithdrawalID).StructScan(&wd)
+	if err == sql.ErrNoRows {
+		return loyalty.Refund{}, ErrNotFound
+	} else if err != nil {
+		return loyalty.Refund{}, fmt.Errorf("read rows: %w", err)
+	}
+
+	if r.ExternalID != "" {
+		existing := refund{}
+		err = tx.QueryRowxContext(ctx, "SELECT * FROM gom_refunds WHERE withdrawal_id = $1 AND external_id = $2", wd.ID, r.ExternalID).StructScan(&existing)
+		if err == nil {
+			item, err := existing.loyalty()
+			if err != nil {
+				return loyalty.Refund{}, err
+			}
+			return item, ErrDuplicateKey
+		} else if err != sql.ErrNoRows {
+			return loyalty.Refund{}, fmt.Errorf("read rows: %w", err)
+		}
+	}
+
+	w, err := wd.loyalty()
+	if err != nil {
+		return loyalty.Refund{}, err
+	}
+	var refunded float64
+	err = tx.QueryRowxContext(ctx, "SELECT COALESCE(SUM(sum), 0) FROM gom_refunds WHERE withdrawal_id = $1", wd.ID).Scan(&refunded)
+	if err != nil {
+		return loyalty.Refund{}, fmt.Errorf("read rows: %w", err)
+	}
+	w.Refunds = []loyalty.Refund{{Sum: refunded}}
+
+	sum, err := loyalty.RefundSum(w, r.Sum)
+	if err != nil {
+		return loyalty.Refund{}, err
+	}
+
+	created := refund{}
+	err = tx.QueryRowxContext(ctx, "INSERT INTO gom_refunds VALUES (gen_random_uuid(), $1, $2, $3, $4, NULLIF($5, ''), NOW()) RETURNING *",
+		wd.ID, wd.Login, sum, r.Source, r.ExternalID).StructScan(&created)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			if err.Code == "23505" {
+				return loyalty.Refund{}, ErrDuplicateKey
+			}
+		}
+		return loyalty.Refund{}, fmt.Errorf("db error: %w", err)
+	}
+
+	b := events.Balance{}
+	err = tx.QueryRowxContext(ctx, "UPDATE gom_balances SET current = current + $1, withdrawn = withdrawn - $1 WHERE login = $2 RETURNING current, withdrawn, reserved", sum, wd.Login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
+	if err != nil {
+		return loyalty.Refund{}, fmt.Errorf("db error: %w", err)
+	}
+
+	// возвращённые баллы — новая партия: срок считается от возврата
+	err = s.accrue(ctx, tx, wd.Login, wd.OrderNumber, sum)
+	if err != nil {
+		return loyalty.Refund{}, err
+	}
+
+	err = notify(ctx, tx, events.Event{Login: wd.Login, Type: events.TypeBalance, Balance: &b})
+	if err != nil {
+		return loyalty.Refund{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loyalty.Refund{}, fmt.Errorf("commit error: %w", err)
+	}
+
+	return created.loyalty()
+}
+
+// BalanceBefore возвращает баланс пользователя на момент before: начисления за заказы,
+// обработанные раньше before, за вычетом более ранних списаний и сгораний и с учётом возвратов
+func (s *Storage) BalanceBefore(ctx context.Context, login string, before time.Time) (float64, error) {
+	var result float64
+
+	err := s.sqlDB.QueryRowxContext(ctx, `
+		SELECT
+			COALESCE((SELECT SUM(accrual) FROM gom_orders WHERE login = $1 AND status = 'PROCESSED' AND COALESCE(processed_at, uploaded_at) < $2), 0) -
+			COALESCE((SELECT SUM(sum) FROM gom_withdrawals WHERE login = $1 AND processed_at < $2), 0) +
+			COALESCE((SELECT SUM(sum) FROM gom_refunds WHERE login = $1 AND processed_at < $2), 0) -
+			COALESCE((SELECT SUM(sum) FROM gom_expirations WHERE login = $1 AND expired_at < $2), 0)
+	`, login, before).Scan(&result)
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
 	return result, nil
 }
 
-func (s *Storage) OrdersProcessing() ([]order, error) {
+// Statement передаёт в fn движения баллов пользователя за [from, to) в хронологическом порядке,
+// читая их из базы по мере обработки, без загрузки всей истории в память. Начисление датируется
+// временем обработки заказа, как в AccruedSince.
+func (s *Storage) Statement(ctx context.Context, login string, from, to time.Time, fn func(StatementEntry) error) error {
+	rows, err := s.sqlDB.QueryxContext(ctx, `
+		SELECT 'accrual' AS kind, number AS order_number, accrual AS amount, COALESCE(processed_at, uploaded_at) AS at
+		FROM gom_orders
+		WHERE login = $1 AND status = 'PROCESSED' AND accrual > 0 AND COALESCE(processed_at, uploaded_at) >= $2 AND COALESCE(processed_at, uploaded_at) < $3
+		UNION ALL
+		SELECT 'withdrawal', order_number, sum, processed_at
+		FROM gom_withdrawals
+		WHERE login = $1 AND processed_at >= $2 AND processed_at < $3
+		UNION ALL
+		SELECT 'refund', w.order_number, r.sum, r.processed_at
+		FROM gom_refunds r JOIN gom_withdrawals w ON w.id = r.withdrawal_id
+		WHERE r.login = $1 AND r.processed_at >= $2 AND r.processed_at < $3
+		UNION ALL
+		SELECT 'expiry', order_number, sum, expired_at
+		FROM gom_expirations
+		WHERE login = $1 AND expired_at >= $2 AND expired_at < $3
+		ORDER BY at
+	`, login, from, to)
+	if err != nil {
+		return fmt.Errorf("read rows: %w", err)
+	}
+	defer rows.Close()
+
+	e := StatementEntry{}
+	for rows.Next() {
+		err := rows.StructScan(&e)
+		if err != nil {
+			return fmt.Errorf("rows struct scan: %w", err)
+		}
+
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) OrdersProcessing(ctx context.Context) ([]order, error) {
 	var result []order
 
-	_, err := s.sqlDB.Exec("UPDATE gom_orders SET status = 'PROCESSING' WHERE status = 'NEW'")
+	_, err := s.sqlDB.ExecContext(ctx, "UPDATE gom_orders SET status = 'PROCESSING' WHERE status = 'NEW'")
 	if err != nil {
 		return result, fmt.Errorf("db update error: %w", err)
 	}
 
 	o := order{}
-	rows, err := s.sqlDB.Queryx("SELECT * FROM gom_orders WHERE status = 'PROCESSING'")
+	rows, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_orders WHERE status = 'PROCESSING' AND next_attempt_at <= NOW()")
 	if err != nil {
 		return result, fmt.Errorf("read rows: %w", err)
 	}
@@ -291,55 +870,162 @@ func (s *Storage) OrdersProcessing() ([]order, error) {
 	return result, nil
 }
 
-func (s *Storage) SetOrderInvalid(orderNumber string) error {
-	_, err := s.sqlDB.Exec("UPDATE gom_orders SET status = 'INVALID' WHERE number = $1", orderNumber)
+// SetOrderInvalid и SetOrderProcessed не меняют заказы в окончательных статусах, поэтому
+// результат расчёта, полученный и опросом, и через webhook, применяется ровно один раз
+func (s *Storage) SetOrderInvalid(ctx context.Context, orderNumber string) error {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
 	if err != nil {
+		return fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	var login string
+	err = tx.QueryRowxContext(ctx, "UPDATE gom_orders SET status = 'INVALID' WHERE number = $1 AND status NOT IN ('INVALID', 'PROCESSED') RETURNING login", orderNumber).Scan(&login)
+	if err == sql.ErrNoRows {
+		// статус уже окончательный
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("db update error: %w", err)
 	}
 
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeOrder, Order: &events.Order{Number: orderNumber, Status: "INVALID"}})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit error: %w", err)
+	}
+
 	return nil
 }
 
-func (s *Storage) UserFromOrderNumber(orderNumber string) (string, error) {
+func (s *Storage) UserFromOrderNumber(ctx context.Context, orderNumber string) (string, error) {
 	var user string
-	err := s.sqlDB.QueryRowx("SELECT login FROM gom_orders WHERE number = $1 LIMIT 1", orderNumber).Scan(&user)
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT login FROM gom_orders WHERE number = $1 LIMIT 1", orderNumber).Scan(&user)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNotFound
+		}
 		return "", fmt.Errorf("read rows: %w", err)
 	}
 
 	return user, nil
 }
 
-func (s *Storage) SetOrderProcessed(orderNumber string, accrual float64) error {
-	login, err := s.UserFromOrderNumber(orderNumber)
+// SetOrderProcessed возвращает false, если заказ уже в окончательном статусе и ничего не изменилось
+func (s *Storage) SetOrderProcessed(ctx context.Context, orderNumber string, accrual float64) (bool, error) {
+	login, err := s.UserFromOrderNumber(ctx, orderNumber)
 	if err != nil {
-		return fmt.Errorf("balance update user error: %w", err)
+		return false, fmt.Errorf("balance update user error: %w", err)
 	}
 
-	b := balance{}
-	err = s.sqlDB.QueryRowx("SELECT * FROM gom_balances WHERE login = $1 LIMIT 1", login).StructScan(&b)
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("read rows: %w", err)
+		return false, fmt.Errorf("tx error: %w", err)
 	}
+	defer tx.Rollback()
 
-	tx, err := s.sqlDB.Begin()
+	res, err := tx.ExecContext(ctx, "UPDATE gom_orders SET status = 'PROCESSED', accrual = $1, processed_at = NOW() WHERE number = $2 AND status NOT IN ('INVALID', 'PROCESSED')", accrual, orderNumber)
 	if err != nil {
-		return fmt.Errorf("tx error: %w", err)
+		return false, fmt.Errorf("db update error: %w", err)
 	}
 
-	_, err = tx.Exec("UPDATE gom_orders SET status = 'PROCESSED', accrual = $1 WHERE number = $2", accrual, orderNumber)
+	n, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("db update error: %w", err)
+		return false, fmt.Errorf("rows affected error: %w", err)
+	}
+	if n == 0 {
+		return false, nil
 	}
 
-	_, err = tx.Exec("UPDATE gom_balances SET current = $1 WHERE login = $2", b.Current+accrual, login)
+	b := events.Balance{}
+	err = tx.QueryRowContext(ctx, "UPDATE gom_balances SET current = current + $1 WHERE login = $2 RETURNING current, withdrawn, reserved", accrual, login).Scan(&b.Current, &b.Withdrawn, &b.Reserved)
 	if err != nil {
-		return fmt.Errorf("db error: %w", err)
+		return false, fmt.Errorf("db error: %w", err)
+	}
+
+	err = s.accrue(ctx, tx, login, orderNumber, accrual)
+	if err != nil {
+		return false, err
+	}
+
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeOrder, Order: &events.Order{Number: orderNumber, Status: "PROCESSED", Accrual: accrual}})
+	if err != nil {
+		return false, err
+	}
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeBalance, Balance: &b})
+	if err != nil {
+		return false, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("commit error: %w", err)
+		return false, fmt.Errorf("commit error: %w", err)
+	}
+
+	return true, nil
+}
+
+// SetOrderRetry и SetOrderDead меняют только заказы в очереди расчёта: неудачный опрос, завершившийся
+// после webhook, не должен возвращать обработанный заказ в очередь и начислять баллы повторно
+func (s *Storage) SetOrderRetry(ctx context.Context, orderNumber string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	_, err := s.sqlDB.ExecContext(ctx, "UPDATE gom_orders SET attempts = $1, next_attempt_at = $2, last_error = $3 WHERE number = $4 AND status = 'PROCESSING'", attempts, nextAttemptAt, lastError, orderNumber)
+	if err != nil {
+		return fmt.Errorf("db update error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) SetOrderDead(ctx context.Context, orderNumber string, attempts int, lastError string) error {
+	_, err := s.sqlDB.ExecContext(ctx, "UPDATE gom_orders SET status = 'DEAD', attempts = $1, last_error = $2 WHERE number = $3 AND status = 'PROCESSING'", attempts, lastError, orderNumber)
+	if err != nil {
+		return fmt.Errorf("db update error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) OrdersDead(ctx context.Context) ([]order, error) {
+	var result []order
+
+	o := order{}
+	rows, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_orders WHERE status = 'DEAD' ORDER BY uploaded_at")
+	if err != nil {
+		return result, fmt.Errorf("read rows: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err := rows.StructScan(&o)
+		if err != nil {
+			return result, fmt.Errorf("rows struct scan: %w", err)
+		}
+		result = append(result, o)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return result, fmt.Errorf("rows error: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) RequeueOrder(ctx context.Context, orderNumber string) error {
+	res, err := s.sqlDB.ExecContext(ctx, "UPDATE gom_orders SET status = 'PROCESSING', attempts = 0, next_attempt_at = NOW(), last_error = '' WHERE number = $1 AND status = 'DEAD'", orderNumber)
+	if err != nil {
+		return fmt.Errorf("db update error: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected error: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
 	}
 
 	return nil
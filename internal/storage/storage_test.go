@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/inkpics/gophermart/internal/config"
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
+)
+
+// тесты работают с той же базой, что и тесты proc; логины и номера заказов случайные, поэтому
+// тесты не мешают друг другу и повторным запускам
+
+func testStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Database.URI = "host=localhost port=54320 user=postgres password=postgres dbname=postgres sslmode=disable"
+
+	s, err := New(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), cfg.Database, time.Hour, events.New(16))
+	if err != nil {
+		t.Fatalf("could not init test: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func testUser(t *testing.T, s *Storage) string {
+	t.Helper()
+
+	login := uuid.NewString()
+	err := s.UserRegister(context.Background(), login, "test")
+	if err != nil {
+		t.Fatalf("could not register user: %v", err)
+	}
+	return login
+}
+
+// testAccrual регистрирует заказ пользователя и начисляет за него sum баллов
+func testAccrual(t *testing.T, s *Storage, login string, sum float64) string {
+	t.Helper()
+
+	ctx := context.Background()
+	number := uuid.NewString()
+	err := s.OrderRegister(ctx, login, number)
+	if err != nil {
+		t.Fatalf("could not register order: %v", err)
+	}
+	_, err = s.SetOrderProcessed(ctx, number, sum)
+	if err != nil {
+		t.Fatalf("could not process order: %v", err)
+	}
+	return number
+}
+
+func testBalance(t *testing.T, s *Storage, login string, want loyalty.Balance) {
+	t.Helper()
+
+	got, err := s.UserBalance(context.Background(), login)
+	if err != nil {
+		t.Fatalf("could not read balance: %v", err)
+	}
+	if got != want {
+		t.Errorf("expected balance %+v; got %+v", want, got)
+	}
+}
+
+func TestStorage_OrdersRegisterBatch(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	a, b := testUser(t, s), testUser(t, s)
+
+	other := uuid.NewString()
+	err := s.OrderRegister(ctx, a, other)
+	if err != nil {
+		t.Fatalf("could not register order: %v", err)
+	}
+
+	fresh := uuid.NewString()
+	got, err := s.OrdersRegisterBatch(ctx, b, []string{other, fresh})
+	if err != nil {
+		t.Fatalf("could not register batch: %v", err)
+	}
+	want := map[string]loyalty.Ownership{other: loyalty.OwnershipOther, fresh: loyalty.OwnershipNone}
+	for number, ownership := range want {
+		if got[number] != ownership {
+			t.Errorf("expected ownership of %s to be %v; got %v", number, ownership, got[number])
+		}
+	}
+
+	got, err = s.OrdersRegisterBatch(ctx, b, []string{fresh})
+	if err != nil {
+		t.Fatalf("could not register batch: %v", err)
+	}
+	if got[fresh] != loyalty.OwnershipUser {
+		t.Errorf("expected ownership of a repeated number to be %v; got %v", loyalty.OwnershipUser, got[fresh])
+	}
+
+	orders, err := s.Orders(ctx, b)
+	if err != nil {
+		t.Fatalf("could not read orders: %v", err)
+	}
+	if len(orders) != 1 || orders[0].Number != fresh || orders[0].Status != "NEW" {
+		t.Errorf("expected one NEW order %s; got %+v", fresh, orders)
+	}
+}
+
+func TestStorage_SetOrderProcessed(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	number := testAccrual(t, s, login, 100)
+
+	// повторный результат расчёта, например webhook после опроса
+	changed, err := s.SetOrderProcessed(ctx, number, 100)
+	if err != nil {
+		t.Fatalf("could not process order: %v", err)
+	}
+	if changed {
+		t.Error("expected repeated result to change nothing")
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 100})
+}
+
+func TestStorage_SetOrderDeadAfterProcessed(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+
+	number := uuid.NewString()
+	err := s.OrderRegister(ctx, login, number)
+	if err != nil {
+		t.Fatalf("could not register order: %v", err)
+	}
+	_, err = s.OrdersProcessing(ctx)
+	if err != nil {
+		t.Fatalf("could not queue orders: %v", err)
+	}
+	// webhook обработал заказ, пока опрос ждал ответа с ошибкой
+	_, err = s.SetOrderProcessed(ctx, number, 100)
+	if err != nil {
+		t.Fatalf("could not process order: %v", err)
+	}
+	err = s.SetOrderRetry(ctx, number, 1, time.Now(), "late failure")
+	if err != nil {
+		t.Fatalf("could not set retry: %v", err)
+	}
+	err = s.SetOrderDead(ctx, number, 2, "late failure")
+	if err != nil {
+		t.Fatalf("could not set dead: %v", err)
+	}
+
+	err = s.RequeueOrder(ctx, number)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected processed order not to be dead; got %v", err)
+	}
+	_, err = s.SetOrderProcessed(ctx, number, 100)
+	if err != nil {
+		t.Fatalf("could not process order: %v", err)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 100})
+}
+
+func TestStorage_Withdrawals(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	user, other := testUser(t, s), testUser(t, s)
+	testAccrual(t, s, user, 100)
+	testAccrual(t, s, other, 100)
+
+	number := uuid.NewString()
+	err := s.Withdraw(ctx, user, number, 30)
+	if err != nil {
+		t.Fatalf("could not withdraw: %v", err)
+	}
+	err = s.Withdraw(ctx, other, uuid.NewString(), 40)
+	if err != nil {
+		t.Fatalf("could not withdraw: %v", err)
+	}
+
+	withdrawals, err := s.Withdrawals(ctx, user)
+	if err != nil {
+		t.Fatalf("could not read withdrawals: %v", err)
+	}
+	if len(withdrawals) != 1 || withdrawals[0].OrderNumber != number || withdrawals[0].Sum != 30 {
+		t.Errorf("expected only the user's withdrawal %s; got %+v", number, withdrawals)
+	}
+}
+
+func TestStorage_Statement(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+
+	// заказ загружен позавчера, а обработан сейчас
+	number := uuid.NewString()
+	err := s.OrderRegister(ctx, login, number)
+	if err != nil {
+		t.Fatalf("could not register order: %v", err)
+	}
+	_, err = s.sqlDB.ExecContext(ctx, "UPDATE gom_orders SET uploaded_at = NOW() - INTERVAL '2 days' WHERE number = $1", number)
+	if err != nil {
+		t.Fatalf("could not backdate order: %v", err)
+	}
+	_, err = s.SetOrderProcessed(ctx, number, 100)
+	if err != nil {
+		t.Fatalf("could not process order: %v", err)
+	}
+
+	from := time.Now().Add(-24 * time.Hour)
+	balance, err := s.BalanceBefore(ctx, login, from)
+	if err != nil {
+		t.Fatalf("could not read balance: %v", err)
+	}
+	if balance != 0 {
+		t.Errorf("expected no balance before processing; got %v", balance)
+	}
+
+	var entries []StatementEntry
+	err = s.Statement(ctx, login, from, time.Now().Add(time.Hour), func(e StatementEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read statement: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Kind != "accrual" || entries[0].OrderNumber != number || entries[0].At.Before(from) {
+		t.Errorf("expected accrual for %s within the period; got %+v", number, entries)
+	}
+}
+
+func TestStorage_Refund(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	testAccrual(t, s, login, 100)
+
+	number := uuid.NewString()
+	err := s.Withdraw(ctx, login, number, 40)
+	if err != nil {
+		t.Fatalf("could not withdraw: %v", err)
+	}
+	wd, err := s.WithdrawalByOrder(ctx, number)
+	if err != nil {
+		t.Fatalf("could not find withdrawal: %v", err)
+	}
+
+	externalID := uuid.NewString()
+	r, err := s.Refund(ctx, loyalty.Refund{WithdrawalID: wd.ID, Sum: 15, Source: loyalty.RefundByShop, ExternalID: externalID})
+	if err != nil {
+		t.Fatalf("could not refund: %v", err)
+	}
+	if r.Sum != 15 || r.ExternalID != externalID {
+		t.Errorf("expected refund of 15 with external id %s; got %+v", externalID, r)
+	}
+
+	repeated, err := s.Refund(ctx, loyalty.Refund{WithdrawalID: wd.ID, Sum: 15, Source: loyalty.RefundByShop, ExternalID: externalID})
+	if !errors.Is(err, ErrDuplicateKey) || repeated.ID != r.ID {
+		t.Errorf("expected repeated refund to return %s with %v; got %s with %v", r.ID, ErrDuplicateKey, repeated.ID, err)
+	}
+
+	_, err = s.Refund(ctx, loyalty.Refund{WithdrawalID: wd.ID, Sum: 30, Source: loyalty.RefundByAdmin})
+	if !errors.Is(err, loyalty.ErrRefundExceeded) {
+		t.Errorf("expected %v; got %v", loyalty.ErrRefundExceeded, err)
+	}
+
+	_, err = s.Refund(ctx, loyalty.Refund{WithdrawalID: uuid.NewString(), Sum: 1, Source: loyalty.RefundByAdmin})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v; got %v", ErrNotFound, err)
+	}
+
+	testBalance(t, s, login, loyalty.Balance{Current: 75, Withdrawn: 25})
+
+	// тот же идентификатор возврата магазина по другому списанию — новый возврат
+	other := uuid.NewString()
+	err = s.Withdraw(ctx, login, other, 30)
+	if err != nil {
+		t.Fatalf("could not withdraw: %v", err)
+	}
+	otherWd, err := s.WithdrawalByOrder(ctx, other)
+	if err != nil {
+		t.Fatalf("could not find withdrawal: %v", err)
+	}
+	r2, err := s.Refund(ctx, loyalty.Refund{WithdrawalID: otherWd.ID, Sum: 10, Source: loyalty.RefundByShop, ExternalID: externalID})
+	if err != nil {
+		t.Fatalf("could not refund: %v", err)
+	}
+	if r2.ID == r.ID || r2.WithdrawalID != otherWd.ID {
+		t.Errorf("expected a new refund for %s; got %+v", otherWd.ID, r2)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 55, Withdrawn: 45})
+}
+
+func TestStorage_Reservation(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	testAccrual(t, s, login, 100)
+
+	r, err := s.Reserve(ctx, login, uuid.NewString(), 30, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("could not reserve: %v", err)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 100, Reserved: 30})
+
+	_, err = s.Reserve(ctx, login, uuid.NewString(), 80, time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("expected %v; got %v", ErrInsufficientFunds, err)
+	}
+
+	wd, err := s.CaptureReservation(ctx, login, r.ID)
+	if err != nil {
+		t.Fatalf("could not capture reservation: %v", err)
+	}
+	if wd.OrderNumber != r.OrderNumber || wd.Sum != 30 {
+		t.Errorf("expected withdrawal of 30 for %s; got %+v", r.OrderNumber, wd)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 70, Withdrawn: 30})
+
+	_, err = s.CaptureReservation(ctx, login, r.ID)
+	if !errors.Is(err, loyalty.ErrReservationClosed) {
+		t.Errorf("expected %v; got %v", loyalty.ErrReservationClosed, err)
+	}
+
+	expired, err := s.Reserve(ctx, login, uuid.NewString(), 20, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("could not reserve: %v", err)
+	}
+	n, err := s.ExpireReservations(ctx)
+	if err != nil {
+		t.Fatalf("could not expire reservations: %v", err)
+	}
+	if n < 1 {
+		t.Errorf("expected at least one expired reservation; got %d", n)
+	}
+
+	var status string
+	err = s.sqlDB.QueryRowxContext(ctx, "SELECT status FROM gom_reservations WHERE id = $1", expired.ID).Scan(&status)
+	if err != nil {
+		t.Fatalf("could not read reservation: %v", err)
+	}
+	if status != loyalty.ReservationExpired {
+		t.Errorf("expected reservation status %s; got %s", loyalty.ReservationExpired, status)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 70, Withdrawn: 30})
+}
+
+func TestStorage_consumeLots(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	first := testAccrual(t, s, login, 30)
+	second := testAccrual(t, s, login, 50)
+
+	err := s.Withdraw(ctx, login, uuid.NewString(), 40)
+	if err != nil {
+		t.Fatalf("could not withdraw: %v", err)
+	}
+
+	lots, err := s.ExpiringLots(ctx, login)
+	if err != nil {
+		t.Fatalf("could not read lots: %v", err)
+	}
+	if len(lots) != 1 || lots[0].OrderNumber != second || lots[0].Remaining != 40 {
+		t.Errorf("expected lot %s to be spent and 40 left in %s; got %+v", first, second, lots)
+	}
+}
+
+func TestStorage_seedLegacyLots(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	testAccrual(t, s, login, 100)
+
+	// начисление до появления партий: баланс без партии
+	legacy := uuid.NewString()
+	err := s.OrderRegister(ctx, login, legacy)
+	if err != nil {
+		t.Fatalf("could not register order: %v", err)
+	}
+	_, err = s.sqlDB.ExecContext(ctx, "UPDATE gom_orders SET status = 'PROCESSED', accrual = 50, processed_at = NOW() - INTERVAL '1 day' WHERE number = $1", legacy)
+	if err != nil {
+		t.Fatalf("could not process order: %v", err)
+	}
+	_, err = s.sqlDB.ExecContext(ctx, "UPDATE gom_balances SET current = current + 50 WHERE login = $1", login)
+	if err != nil {
+		t.Fatalf("could not update balance: %v", err)
+	}
+
+	_, err = s.seedLegacyLots(ctx)
+	if err != nil {
+		t.Fatalf("could not seed lots: %v", err)
+	}
+	_, err = s.seedLegacyLots(ctx)
+	if err != nil {
+		t.Fatalf("could not seed lots: %v", err)
+	}
+
+	// старые баллы расходуются первыми
+	err = s.Withdraw(ctx, login, uuid.NewString(), 30)
+	if err != nil {
+		t.Fatalf("could not withdraw: %v", err)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 120, Withdrawn: 30})
+
+	lots, err := s.ExpiringLots(ctx, login)
+	if err != nil {
+		t.Fatalf("could not read lots: %v", err)
+	}
+	var seeded []loyalty.Lot
+	for _, l := range lots {
+		if l.OrderNumber == "" {
+			seeded = append(seeded, l)
+		}
+	}
+	if len(lots) != 2 || len(seeded) != 1 || seeded[0].Amount != 50 || seeded[0].Remaining != 20 {
+		t.Errorf("expected one legacy lot with 20 of 50 left; got %+v", lots)
+	}
+	if len(seeded) == 1 && seeded[0].ExpiresAt.Before(time.Now().Add(30*time.Minute)) {
+		t.Errorf("expected legacy lot to expire a points TTL after seeding; got %v", seeded[0].ExpiresAt)
+	}
+}
+
+func TestStorage_ExpireLots(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	first := testAccrual(t, s, login, 50)
+	testAccrual(t, s, login, 20)
+
+	_, err := s.Reserve(ctx, login, uuid.NewString(), 60, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("could not reserve: %v", err)
+	}
+	_, err = s.sqlDB.ExecContext(ctx, "UPDATE gom_lots SET expires_at = NOW() - INTERVAL '1 second' WHERE order_number = $1", first)
+	if err != nil {
+		t.Fatalf("could not backdate lot: %v", err)
+	}
+
+	// доступно 70 - 60 = 10: зарезервированные баллы не сгорают
+	_, err = s.ExpireLots(ctx)
+	if err != nil {
+		t.Fatalf("could not expire lots: %v", err)
+	}
+	testBalance(t, s, login, loyalty.Balance{Current: 60, Reserved: 60})
+
+	var remaining float64
+	err = s.sqlDB.QueryRowxContext(ctx, "SELECT remaining FROM gom_lots WHERE order_number = $1", first).Scan(&remaining)
+	if err != nil {
+		t.Fatalf("could not read lot: %v", err)
+	}
+	if remaining != 40 {
+		t.Errorf("expected 40 left in expired lot; got %v", remaining)
+	}
+
+	_, err = s.ExpireLots(ctx)
+	if err != nil {
+		t.Fatalf("could not expire lots: %v", err)
+	}
+	var expirations int
+	err = s.sqlDB.QueryRowxContext(ctx, "SELECT COUNT(*) FROM gom_expirations WHERE login = $1", login).Scan(&expirations)
+	if err != nil {
+		t.Fatalf("could not read expirations: %v", err)
+	}
+	if expirations != 1 {
+		t.Errorf("expected one expiration while points are reserved; got %d", expirations)
+	}
+}
+
+func TestStorage_SetTier(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+
+	tier, err := s.UserTier(ctx, login)
+	if err != nil {
+		t.Fatalf("could not read tier: %v", err)
+	}
+	if tier != loyalty.TierBase {
+		t.Errorf("expected tier %s; got %s", loyalty.TierBase, tier)
+	}
+
+	change := loyalty.TierChange{Tier: loyalty.TierSilver, Previous: loyalty.TierBase, Accrued: 1000}
+	got, changed, err := s.SetTier(ctx, login, change)
+	if err != nil {
+		t.Fatalf("could not set tier: %v", err)
+	}
+	if !changed || got.Tier != loyalty.TierSilver || got.Previous != loyalty.TierBase {
+		t.Errorf("expected change to %s; got %+v, changed %v", loyalty.TierSilver, got, changed)
+	}
+
+	// другой экземпляр сервиса пересчитал статус по устаревшему Previous
+	_, changed, err = s.SetTier(ctx, login, change)
+	if err != nil {
+		t.Fatalf("could not set tier: %v", err)
+	}
+	if changed {
+		t.Error("expected stale change to be skipped")
+	}
+
+	history, err := s.TierHistory(ctx, login)
+	if err != nil {
+		t.Fatalf("could not read tier history: %v", err)
+	}
+	if len(history) != 1 {
+		t.Errorf("expected one history entry; got %+v", history)
+	}
+
+	logins, err := s.TieredUsers(ctx)
+	if err != nil {
+		t.Fatalf("could not read tiered users: %v", err)
+	}
+	found := false
+	for _, l := range logins {
+		found = found || l == login
+	}
+	if !found {
+		t.Errorf("expected %s among tiered users", login)
+	}
+}
+
+func TestStorage_UntieredUsers(t *testing.T) {
+	s := testStorage(t)
+	ctx := context.Background()
+	login := testUser(t, s)
+	since := time.Now().Add(-time.Hour)
+	testAccrual(t, s, login, 600)
+	testAccrual(t, s, login, 500)
+
+	untiered := func() bool {
+		t.Helper()
+		logins, err := s.UntieredUsers(ctx, since, 1000)
+		if err != nil {
+			t.Fatalf("could not read untiered users: %v", err)
+		}
+		for _, l := range logins {
+			if l == login {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !untiered() {
+		t.Errorf("expected %s among untiered users", login)
+	}
+
+	_, _, err := s.SetTier(ctx, login, loyalty.TierChange{Tier: loyalty.TierSilver, Previous: loyalty.TierBase, Accrued: 1100})
+	if err != nil {
+		t.Fatalf("could not set tier: %v", err)
+	}
+	if untiered() {
+		t.Errorf("expected %s to leave untiered users", login)
+	}
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/inkpics/gophermart/internal/events"
+	"github.com/inkpics/gophermart/internal/loyalty"
+)
+
+type tierChange struct {
+	ID        string  `db:"id"`
+	Login     string  `db:"login"`
+	Tier      string  `db:"tier"`
+	Previous  string  `db:"previous"`
+	Accrued   float64 `db:"accrued"`
+	ChangedAt string  `db:"changed_at"`
+}
+
+func (c tierChange) loyalty() (loyalty.TierChange, error) {
+	changed, err := time.Parse(time.RFC3339Nano, c.ChangedAt)
+	if err != nil {
+		return loyalty.TierChange{}, fmt.Errorf("parse changed_at: %w", err)
+	}
+
+	return loyalty.TierChange{ID: c.ID, Tier: c.Tier, Previous: c.Previous, Accrued: c.Accrued, ChangedAt: changed}, nil
+}
+
+// AccruedSince считает начисления по времени обработки заказа; у заказов, обработанных до
+// появления processed_at, — по времени загрузки
+func (s *Storage) AccruedSince(ctx context.Context, login string, since time.Time) (float64, error) {
+	var result float64
+
+	err := s.sqlDB.QueryRowxContext(ctx, "SELECT COALESCE(SUM(accrual), 0) FROM gom_orders WHERE login = $1 AND status = 'PROCESSED' AND COALESCE(processed_at, uploaded_at) >= $2", login, since).Scan(&result)
+	if err != nil {
+		return 0, fmt.Errorf("read rows: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) UserTier(ctx context.Context, login string) (string, error) {
+	var tiers []string
+
+	err := s.sqlDB.SelectContext(ctx, &tiers, "SELECT tier FROM gom_tiers WHERE login = $1", login)
+	if err != nil {
+		return "", fmt.Errorf("read rows: %w", err)
+	}
+	if len(tiers) == 0 {
+		return loyalty.TierBase, nil
+	}
+
+	return tiers[0], nil
+}
+
+// SetTier меняет статус, только если он всё ещё change.Previous, поэтому одновременный пересчёт
+// на нескольких экземплярах записывает смену один раз
+func (s *Storage) SetTier(ctx context.Context, login string, change loyalty.TierChange) (loyalty.TierChange, bool, error) {
+	tx, err := s.sqlDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return loyalty.TierChange{}, false, fmt.Errorf("tx error: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO gom_tiers VALUES ($1, $2, NOW())
+		ON CONFLICT (login) DO UPDATE SET tier = $2, changed_at = NOW() WHERE gom_tiers.tier = $3
+	`, login, change.Tier, change.Previous)
+	if err != nil {
+		return loyalty.TierChange{}, false, fmt.Errorf("db error: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return loyalty.TierChange{}, false, fmt.Errorf("rows affected error: %w", err)
+	}
+	if n == 0 {
+		return loyalty.TierChange{}, false, nil
+	}
+
+	c := tierChange{}
+	err = tx.QueryRowxContext(ctx, "INSERT INTO gom_tier_history VALUES (gen_random_uuid(), $1, $2, $3, $4, NOW()) RETURNING *", login, change.Tier, change.Previous, change.Accrued).StructScan(&c)
+	if err != nil {
+		return loyalty.TierChange{}, false, fmt.Errorf("db error: %w", err)
+	}
+
+	err = notify(ctx, tx, events.Event{Login: login, Type: events.TypeTier, Tier: &events.Tier{Tier: change.Tier, Previous: change.Previous}})
+	if err != nil {
+		return loyalty.TierChange{}, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return loyalty.TierChange{}, false, fmt.Errorf("commit error: %w", err)
+	}
+
+	result, err := c.loyalty()
+	if err != nil {
+		return loyalty.TierChange{}, false, err
+	}
+	return result, true, nil
+}
+
+func (s *Storage) TieredUsers(ctx context.Context) ([]string, error) {
+	var result []string
+
+	err := s.sqlDB.SelectContext(ctx, &result, "SELECT login FROM gom_tiers WHERE tier <> 'base' ORDER BY login")
+	if err != nil {
+		return nil, fmt.Errorf("read rows: %w", err)
+	}
+
+	return result, nil
+}
+
+// UntieredUsers считает начисления так же, как AccruedSince
+func (s *Storage) UntieredUsers(ctx context.Context, since time.Time, threshold float64) ([]string, error) {
+	var result []string
+
+	err := s.sqlDB.SelectContext(ctx, &result, `
+		SELECT o.login FROM gom_orders o
+		LEFT JOIN gom_tiers t ON t.login = o.login
+		WHERE o.status = 'PROCESSED' AND COALESCE(o.processed_at, o.uploaded_at) >= $1 AND COALESCE(t.tier, 'base') = 'base'
+		GROUP BY o.login
+		HAVING SUM(o.accrual) >= $2
+		ORDER BY o.login
+	`, since, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("read rows: %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *Storage) TierHistory(ctx context.Context, login string) ([]loyalty.TierChange, error) {
+	var result []loyalty.TierChange
+
+	rows, err := s.sqlDB.QueryxContext(ctx, "SELECT * FROM gom_tier_history WHERE login = $1 ORDER BY changed_at", login)
+	if err != nil {
+		return result, fmt.Errorf("read rows: %w", err)
+	}
+	defer rows.Close()
+
+	c := tierChange{}
+	for rows.Next() {
+		err := rows.StructScan(&c)
+		if err != nil {
+			return result, fmt.Errorf("rows struct scan: %w", err)
+		}
+		item, err := c.loyalty()
+		if err != nil {
+			return result, err
+		}
+		result = append(result, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return result, fmt.Errorf("rows error: %w", err)
+	}
+
+	return result, nil
+}
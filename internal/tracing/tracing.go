@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+const ServiceName = "gophermart"
+
+// Setup настраивает глобальный TracerProvider и распространение контекста W3C Trace Context.
+// exporter принимает значения:
+//   - "" или "none" — трассировка выключена, спаны не экспортируются;
+//   - "stdout" — спаны пишутся в stdout;
+//   - "file:<путь>" — спаны дописываются в файл;
+//   - "otlp" — экспорт по OTLP/HTTP, адрес задаётся переменными OTEL_EXPORTER_OTLP_*.
+//
+// Возвращаемую функцию нужно вызвать при остановке, чтобы выгрузить накопленные спаны.
+func Setup(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var out io.Closer
+	var err error
+
+	switch {
+	case exporter == "" || exporter == "none":
+		return func(context.Context) error { return nil }, nil
+	case exporter == "stdout":
+		exp, err = stdouttrace.New()
+	case strings.HasPrefix(exporter, "file:"):
+		f, ferr := os.OpenFile(strings.TrimPrefix(exporter, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if ferr != nil {
+			return nil, fmt.Errorf("open trace file: %w", ferr)
+		}
+		out = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case exporter == "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if out != nil {
+			out.Close()
+		}
+		return err
+	}, nil
+}
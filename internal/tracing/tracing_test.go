@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+
+	shutdown, err := Setup(context.Background(), "file:"+path)
+	if err != nil {
+		t.Fatalf("could not set up tracing: %v", err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test-span")
+	span.End()
+
+	err = shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("could not shut down tracing: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read trace file: %v", err)
+	}
+	if !strings.Contains(string(data), `"Name":"test-span"`) {
+		t.Errorf("expected trace file to contain span; got %s", data)
+	}
+}
+
+func TestSetup_Unknown(t *testing.T) {
+	_, err := Setup(context.Background(), "zipkin")
+	if err == nil {
+		t.Errorf("expected error for unknown exporter")
+	}
+}